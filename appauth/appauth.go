@@ -6,126 +6,253 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"slices"
+	"log/slog"
+	"time"
 
 	"github.com/coreos/go-oidc/v3/oidc"
 	"golang.org/x/oauth2"
 
+	"github.com/Luzifer/go_helpers/appauth/pkg/cache"
 	"github.com/Luzifer/go_helpers/appauth/pkg/cache/mem"
 )
 
-// New creats a new Auth adapter
+const defaultVerificationCacheSize = 1024
+
+// New creats a new Auth adapter (see NewWithContext)
 func New(cfg Config) (*Auth, error) {
-	if cfg.IssuerURL == "" || cfg.ClientID == "" || cfg.ClientSecret == "" || cfg.PopupRedirectURL == "" {
-		return nil, errors.New("IssuerURL, ClientID, ClientSecret, PopupRedirectURL are required")
+	return NewWithContext(context.Background(), cfg)
+}
+
+// NewWithContext creates a new Auth adapter discovering the providers
+// using the given context. The context does not limit the lifetime of
+// the adapter, use Close to stop the re-discovery.
+func NewWithContext(ctx context.Context, cfg Config) (*Auth, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
 	}
 
 	if len(cfg.Scopes) == 0 {
 		cfg.Scopes = []string{oidc.ScopeOpenID, "profile", "email"}
 	}
 
-	provider, err := oidc.NewProvider(context.Background(), cfg.IssuerURL)
+	templates, err := parsePopupTemplates(cfg.PopupTemplates)
 	if err != nil {
-		return nil, fmt.Errorf("creating OIDC provider: %w", err)
+		return nil, fmt.Errorf("parsing popup templates: %w", err)
 	}
 
 	a := &Auth{
-		cfg:      cfg,
-		provider: provider,
-		verifier: provider.Verifier(&oidc.Config{
-			// We're using a library expecting ID-tokens to validate access
-			// tokens which have different audience (ID audience is the client
-			// access audience is the issuing server)
-			SkipClientIDCheck: true,
-		}),
+		cfg: cfg,
 		oauth2: oauth2.Config{
 			ClientID:     cfg.ClientID,
 			ClientSecret: cfg.ClientSecret,
 			RedirectURL:  cfg.PopupRedirectURL,
-			Endpoint:     provider.Endpoint(),
 			Scopes:       cfg.Scopes,
 		},
 
-		sessionCache: mem.New(),
+		logger: newLogger(cfg),
+
+		templates: templates,
+	}
+
+	a.initStores()
+
+	if err = a.discoverIssuers(ctx); err != nil {
+		a.Close()
+		return nil, err
 	}
 
-	if cfg.Cache != nil {
-		a.sessionCache = cfg.Cache
+	if cfg.RediscoveryInterval > 0 {
+		var rediscoveryCtx context.Context
+		rediscoveryCtx, a.stopRediscovery = context.WithCancel(context.WithoutCancel(ctx))
+		go a.rediscoverPeriodically(rediscoveryCtx)
 	}
 
 	return a, nil
 }
 
-func (*Auth) authorize(u *User, opts Opts) bool {
-	// If no requirements, authenticated is enough
-	if len(opts.AnyRole) == 0 && len(opts.AnyGroup) == 0 {
-		return true
+// Close stops the background work of the adapter: the periodic
+// re-discovery (see Config.RediscoveryInterval) and the janitor of the
+// default in-memory session store
+func (a *Auth) Close() {
+	if a.stopRediscovery != nil {
+		a.stopRediscovery()
 	}
 
-	if len(opts.AnyRole) > 0 {
-		for _, requiredRole := range opts.AnyRole {
-			if slices.Contains(u.Roles, requiredRole) {
-				return true
-			}
+	if a.defaultStore != nil {
+		_ = a.defaultStore.Close() //nolint:errcheck // Closing the in-memory store never fails
+	}
+}
+
+// discoverIssuers discovers the IssuerURL and the static Issuers
+// tolerating failures when the discovery is lazy
+func (a *Auth) discoverIssuers(ctx context.Context) error {
+	if err := a.discoverWithRetry(ctx); err != nil {
+		if !a.cfg.LazyDiscovery {
+			return err
 		}
+		a.log().Warn("discovering provider, retrying on demand", slog.String("issuer", a.cfg.IssuerURL), slog.Any("error", err))
 	}
 
-	if len(opts.AnyGroup) > 0 {
-		for _, requiredGroup := range opts.AnyGroup {
-			if slices.Contains(u.Groups, requiredGroup) {
-				return true
+	for _, iss := range a.cfg.Issuers {
+		if _, err := a.tenant(ctx, iss); err != nil {
+			if !a.cfg.LazyDiscovery {
+				return fmt.Errorf("creating issuer %q: %w", iss.IssuerURL, err)
 			}
+			a.log().Warn("discovering provider, retrying on demand", slog.String("issuer", iss.IssuerURL), slog.Any("error", err))
 		}
 	}
 
-	return false
+	return nil
+}
+
+// initStores sets up the configured or default session store and
+// caches
+func (a *Auth) initStores() {
+	switch {
+	case a.cfg.SessionStore != nil:
+		a.sessionStore = a.cfg.SessionStore
+	case a.cfg.Cache != nil:
+		a.sessionStore = cache.FromCache(a.cfg.Cache)
+	default:
+		a.defaultStore = mem.New(mem.WithJanitorInterval(mem.DefaultJanitorInterval))
+		a.sessionStore = a.defaultStore
+	}
+
+	a.dpopReplayCache = a.cfg.DPoPReplayCache
+	if a.dpopReplayCache == nil {
+		a.dpopReplayCache = mem.NewReplayCache()
+	}
+
+	switch {
+	case a.cfg.DisableVerificationCache:
+		// Leave the verificationCache unset to verify every request
+	case a.cfg.VerificationCache != nil:
+		a.verificationCache = a.cfg.VerificationCache
+	default:
+		a.verificationCache = mem.NewVerificationCache(defaultVerificationCacheSize)
+	}
+}
+
+// verifyAccessToken verifies the token against the given tenant and
+// returns the user it was issued to
+func (a *Auth) verifyAccessToken(ctx context.Context, t *tenant, raw string) (*User, error) {
+	key := t.verificationKey(raw)
+	if u, ok := a.cachedVerification(ctx, key); ok {
+		return u, nil
+	}
+
+	var (
+		u       *User
+		expires time.Time
+		err     error
+	)
+
+	switch a.cfg.TokenVerification {
+	case TokenVerificationIntrospection:
+		u, expires, err = a.verifyByIntrospection(ctx, t, raw)
+	case TokenVerificationJWT:
+		u, expires, err = a.verifyByJWT(ctx, t, raw)
+	default:
+		u, expires, err = a.verifyByUserInfo(ctx, t, raw)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	u.Issuer = t.issuerURL
+	u.Tenant = t.name
+
+	a.storeVerification(ctx, key, u, expires)
+	return u, nil
 }
 
-func (a *Auth) verifyAccessToken(ctx context.Context, raw string) (*User, error) {
+func (a *Auth) verifyByUserInfo(ctx context.Context, t *tenant, raw string) (*User, time.Time, error) {
 	// Verify signature + issuer etc. by parsing as an IDToken-ish structure.
 	// This works for JWT access tokens because OIDC provider keys verify JWTs.
-	tok, err := a.verifier.Verify(ctx, raw)
+	tok, err := t.verifier.Verify(ctx, raw)
 	if err != nil {
-		return nil, fmt.Errorf("verifying access token: %w", err)
+		return nil, time.Time{}, fmt.Errorf("verifying access token: %w", err)
 	}
 
 	// Best effort: parse JWT claims for fallback role extraction.
 	var tokenClaims map[string]any
 	if err := tok.Claims(&tokenClaims); err != nil {
-		a.logf("auth: parsing access token claims for role fallback failed err=%v", err)
+		a.log().Debug("parsing access token claims for role fallback failed", slog.Any("error", err))
 	}
 
-	ui, err := a.provider.UserInfo(ctx, oauth2.StaticTokenSource(&oauth2.Token{
+	// Service accounts (client credentials grant) have no user to ask
+	// the userinfo endpoint about, the token claims are all we get
+	if len(tokenClaims) > 0 {
+		if u := t.userFromClaims(tokenClaims); a.detectServiceAccount(u, tokenClaims) {
+			u.Scopes = extractScopes(tokenClaims)
+			u.DPoPKey = confirmationKey(tokenClaims)
+			return u, tok.Expiry, nil
+		}
+	}
+
+	ui, err := t.provider.UserInfo(ctx, oauth2.StaticTokenSource(&oauth2.Token{
 		AccessToken: raw,
 		TokenType:   "Bearer",
 	}))
 	if err != nil {
-		return nil, fmt.Errorf("getting userinfo: %w", err)
+		return nil, time.Time{}, fmt.Errorf("getting userinfo: %w", err)
 	}
 
 	// Claims into map so we can inspect aud/groups/roles flexibly
 	var claims map[string]any
 	if err := ui.Claims(&claims); err != nil {
-		return nil, fmt.Errorf("parsing claims into map: %w", err)
+		return nil, time.Time{}, fmt.Errorf("parsing claims into map: %w", err)
 	}
 
 	if err := verifySubjectConsistency(tokenClaims, claims); err != nil {
-		return nil, fmt.Errorf("verifying token subject: %w", err)
+		return nil, time.Time{}, fmt.Errorf("verifying token subject: %w", err)
+	}
+
+	u := t.userFromClaims(claims)
+	u.Scopes = extractScopes(tokenClaims)
+	u.DPoPKey = confirmationKey(tokenClaims)
+
+	// Some providers (e.g. Entra ID) only put roles and groups into the
+	// access token, so fall back to its claims
+	if len(u.Roles) == 0 && len(tokenClaims) > 0 {
+		u.Roles = t.effectiveClaimMapping().roles(tokenClaims, t.clientID)
 	}
 
-	u := &User{
-		Sub:   str(claims["sub"]),
-		Email: str(claims["email"]),
-		Name:  str(claims["name"]),
-		Raw:   claims,
+	if len(u.Groups) == 0 && len(tokenClaims) > 0 {
+		u.Groups = t.effectiveClaimMapping().groups(tokenClaims, t.clientID)
 	}
 
-	u.Groups = extractStringSlice(claims["groups"])
-	u.Roles = extractRoles(claims, a.cfg.ClientID)
+	// The userinfo usually does not describe the authentication, the
+	// token does
+	u.applyAuthenticationContext(tokenClaims)
 
-	if len(u.Roles) == 0 && len(tokenClaims) > 0 {
-		u.Roles = extractRoles(tokenClaims, a.cfg.ClientID)
+	return u, tok.Expiry, nil
+}
+
+// validate checks the required settings of the Config
+func (c Config) validate() error {
+	if c.IssuerURL == "" || c.ClientID == "" || c.ClientSecret == "" {
+		return errors.New("IssuerURL, ClientID, ClientSecret are required")
 	}
 
-	return u, nil
+	if c.PopupRedirectURL == "" && c.LoginRedirectURL == "" {
+		return errors.New("at least one of PopupRedirectURL, LoginRedirectURL is required")
+	}
+
+	if err := c.ClaimMapping.validate(); err != nil {
+		return fmt.Errorf("validating claim mapping: %w", err)
+	}
+
+	if c.TokenVerification == TokenVerificationJWT && len(c.Audiences) == 0 {
+		return errors.New("audiences are required for TokenVerificationJWT")
+	}
+
+	for _, iss := range c.Issuers {
+		if iss.IssuerURL == "" {
+			return errors.New("IssuerURL is required for all Issuers")
+		}
+	}
+
+	return nil
 }
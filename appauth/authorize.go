@@ -0,0 +1,141 @@
+package appauth
+
+import (
+	"net/http"
+	"reflect"
+	"slices"
+)
+
+// ClaimEquals creates a ClaimMatcher requiring the claim to equal the
+// given value (e.g. ClaimEquals("email_verified", true))
+func ClaimEquals(claim string, value any) ClaimMatcher {
+	return ClaimMatcher{Claim: claim, Values: []any{value}}
+}
+
+// ClaimIn creates a ClaimMatcher requiring the claim to equal one of
+// the given values (e.g. ClaimIn("tenant", "a", "b"))
+func ClaimIn(claim string, values ...any) ClaimMatcher {
+	return ClaimMatcher{Claim: claim, Values: values}
+}
+
+func (c ClaimMatcher) matches(claims map[string]any) bool {
+	v, ok := claims[c.Claim]
+	if !ok {
+		return false
+	}
+
+	candidates := []any{v}
+	if arr, ok := v.([]any); ok {
+		candidates = arr
+	}
+
+	for _, candidate := range candidates {
+		if slices.ContainsFunc(c.Values, func(want any) bool { return claimValueEqual(candidate, want) }) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// authorize checks the user against the opts and their nested Opts.
+// The step-up requirements of the opts themselves are checked by
+// RequireAuth, the ones of nested Opts are checked here.
+func (a *Auth) authorize(u *User, r *http.Request, opts Opts) bool {
+	if !opts.matchesAny(u) || !opts.matchesAll(u) || !opts.matchesClaims(u) {
+		return false
+	}
+
+	if opts.Check != nil && !opts.Check(u, r) {
+		return false
+	}
+
+	for _, sub := range opts.AllOf {
+		if !a.authorizeNested(u, r, sub) {
+			return false
+		}
+	}
+
+	if len(opts.AnyOf) > 0 && !slices.ContainsFunc(opts.AnyOf, func(sub Opts) bool { return a.authorizeNested(u, r, sub) }) {
+		return false
+	}
+
+	return true
+}
+
+// authorizeNested checks the user against nested Opts including their
+// step-up requirements
+func (a *Auth) authorizeNested(u *User, r *http.Request, opts Opts) bool {
+	return a.sufficientAuthentication(u, opts) && a.authorize(u, r, opts)
+}
+
+// matchesAll checks the user to have all of the AllRoles, AllGroups
+// and AllScopes
+func (o Opts) matchesAll(u *User) bool {
+	return containsAll(u.Roles, o.AllRoles) &&
+		containsAll(u.Groups, o.AllGroups) &&
+		containsAll(u.Scopes, o.AllScopes)
+}
+
+// matchesAny checks the user to have one of the AnyRole or AnyGroup or
+// to be a service account of one of the AnyClient
+func (o Opts) matchesAny(u *User) bool {
+	if len(o.AnyRole) == 0 && len(o.AnyGroup) == 0 && len(o.AnyClient) == 0 {
+		return true
+	}
+
+	return containsAny(u.Roles, o.AnyRole) ||
+		containsAny(u.Groups, o.AnyGroup) ||
+		(u.ServiceAccount && slices.Contains(o.AnyClient, u.ClientID))
+}
+
+// matchesClaims checks all Claims matchers to match the user
+func (o Opts) matchesClaims(u *User) bool {
+	for _, m := range o.Claims {
+		if !m.matches(u.Raw) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// claimValueEqual compares claim values while treating all numeric
+// types as equal (JSON decodes numbers into float64)
+func claimValueEqual(have, want any) bool {
+	if h, ok := toFloat(have); ok {
+		w, ok := toFloat(want)
+		return ok && h == w
+	}
+
+	return reflect.DeepEqual(have, want)
+}
+
+func containsAll(have, want []string) bool {
+	for _, w := range want {
+		if !slices.Contains(have, w) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func containsAny(have, want []string) bool {
+	return slices.ContainsFunc(want, func(w string) bool { return slices.Contains(have, w) })
+}
+
+func toFloat(v any) (float64, bool) {
+	rv := reflect.ValueOf(v)
+
+	switch rv.Kind() {
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), true
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(rv.Uint()), true
+	default:
+		return 0, false
+	}
+}
@@ -0,0 +1,68 @@
+package appauth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthorize(t *testing.T) {
+	a := &Auth{}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	u := &User{
+		Roles:  []string{"admin", "myclient/api-read"},
+		Groups: []string{"engineering"},
+		Scopes: []string{"api:read", "openid"},
+		Raw: map[string]any{
+			"email_verified": true,
+			"tenant":         "acme",
+			"level":          float64(3),
+			"teams":          []any{"blue", "red"},
+		},
+	}
+
+	for name, tc := range map[string]struct {
+		opts Opts
+		want bool
+	}{
+		"empty":                   {Opts{}, true},
+		"any role":                {Opts{AnyRole: []string{"nope", "admin"}}, true},
+		"any group or role":       {Opts{AnyRole: []string{"nope"}, AnyGroup: []string{"engineering"}}, true},
+		"any role missing":        {Opts{AnyRole: []string{"nope"}}, false},
+		"all roles":               {Opts{AllRoles: []string{"admin", "myclient/api-read"}}, true},
+		"all roles missing":       {Opts{AllRoles: []string{"admin", "nope"}}, false},
+		"all groups missing":      {Opts{AllGroups: []string{"engineering", "nope"}}, false},
+		"scopes":                  {Opts{AllScopes: []string{"api:read"}}, true},
+		"scopes missing":          {Opts{AllScopes: []string{"api:write"}}, false},
+		"claim bool":              {Opts{Claims: []ClaimMatcher{ClaimEquals("email_verified", true)}}, true},
+		"claim in":                {Opts{Claims: []ClaimMatcher{ClaimIn("tenant", "other", "acme")}}, true},
+		"claim int vs float":      {Opts{Claims: []ClaimMatcher{ClaimEquals("level", 3)}}, true},
+		"claim array element":     {Opts{Claims: []ClaimMatcher{ClaimEquals("teams", "red")}}, true},
+		"claim missing":           {Opts{Claims: []ClaimMatcher{ClaimEquals("nope", true)}}, false},
+		"claim mismatch":          {Opts{Claims: []ClaimMatcher{ClaimEquals("tenant", "other")}}, false},
+		"check":                   {Opts{Check: func(*User, *http.Request) bool { return false }}, false},
+		"and of role and missing": {Opts{AnyRole: []string{"admin"}, AllScopes: []string{"api:write"}}, false},
+		"all of":                  {Opts{AllOf: []Opts{{AnyRole: []string{"admin"}}, {AllScopes: []string{"api:write"}}}}, false},
+		"any of":                  {Opts{AnyOf: []Opts{{AnyRole: []string{"nope"}}, {AllScopes: []string{"api:read"}}}}, true},
+		"any client human":        {Opts{AnyClient: []string{"svc"}}, false},
+		"any client or role":      {Opts{AnyClient: []string{"svc"}, AnyRole: []string{"admin"}}, true},
+		"any of none":             {Opts{AnyOf: []Opts{{AnyRole: []string{"nope"}}, {AllScopes: []string{"api:write"}}}}, false},
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.want, a.authorize(u, r, tc.opts))
+		})
+	}
+}
+
+func TestAuthorizeServiceAccount(t *testing.T) {
+	a := &Auth{}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	u := &User{ClientID: "svc", ServiceAccount: true}
+
+	assert.True(t, a.authorize(u, r, Opts{AnyClient: []string{"svc"}}))
+	assert.False(t, a.authorize(u, r, Opts{AnyClient: []string{"other"}}))
+	assert.False(t, a.authorize(&User{ClientID: "svc"}, r, Opts{AnyClient: []string{"svc"}}))
+}
@@ -0,0 +1,186 @@
+package appauth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/Luzifer/go_helpers/appauth/pkg/cache"
+)
+
+const backChannelLogoutEvent = "http://schemas.openid.net/event/backchannel-logout"
+
+type (
+	// logoutTokenClaims contains the claims of a back-channel logout
+	// token relevant to identify the sessions to end
+	logoutTokenClaims struct {
+		Subject string         `json:"sub"`
+		SID     string         `json:"sid"`
+		Nonce   string         `json:"nonce"`
+		Events  map[string]any `json:"events"`
+	}
+)
+
+// ServeBackChannelLogout is a mountable HTTP HandleFunc implementing
+// the OIDC Back-Channel Logout 1.0 receiver. It MUST be registered as
+// back-channel logout URI at the provider.
+//
+// The `logout_token` is verified against the provider keys and all
+// sessions matching its `sid` (or its `sub` if no `sid` is given) are
+// removed from the cache. This requires the cache to implement the
+// cache.ProviderSessionIndex or cache.SubjectIndex.
+func (a *Auth) ServeBackChannelLogout(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims, err := a.verifyLogoutToken(r.Context(), r.PostFormValue("logout_token"))
+	if err != nil {
+		a.log().Warn("invalid back-channel logout token", slog.Any("error", err))
+		writeBackChannelError(w, "invalid_request", "invalid logout token")
+		return
+	}
+
+	sessions, err := a.backChannelSessions(r.Context(), claims)
+	if err != nil {
+		a.log().Error("finding back-channel logout sessions", slog.String("sub", claims.Subject), slog.String("sid", claims.SID), slog.Any("error", err))
+		writeBackChannelError(w, "server_error", "finding sessions failed")
+		return
+	}
+
+	for key, sess := range sessions {
+		if err = a.sessionStore.DeleteSession(r.Context(), key); err != nil {
+			a.log().Error("removing back-channel logout session", slog.String("sub", claims.Subject), slog.String("sid", claims.SID), slog.Any("error", err))
+			writeBackChannelError(w, "server_error", "removing session failed")
+			return
+		}
+		a.emit(r, Event{Type: EventSessionRevoked, Subject: sess.Subject, SessionHash: key, Reason: "back-channel logout"})
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// backChannelSessions collects the sessions to end for the logout
+// token through the indexes supported by the cache
+func (a *Auth) backChannelSessions(ctx context.Context, claims logoutTokenClaims) (map[string]cache.Session, error) {
+	if claims.SID == "" {
+		return a.subjectSessions(ctx, claims.Subject)
+	}
+
+	var (
+		sessions map[string]cache.Session
+		err      error
+	)
+
+	if idx, ok := a.sessionStore.(cache.ProviderSessionIndex); ok {
+		sessions, err = idx.ListProviderSessions(ctx, claims.SID)
+	} else {
+		err = cache.ErrUnsupported
+	}
+
+	switch {
+	case err == nil:
+		// Sessions found through the sid index
+
+	case !errors.Is(err, cache.ErrUnsupported):
+		return nil, fmt.Errorf("listing provider sessions: %w", err)
+
+	case claims.Subject != "":
+		if sessions, err = a.subjectSessions(ctx, claims.Subject); err != nil {
+			return nil, err
+		}
+
+	default:
+		return nil, ErrSessionListingUnsupported
+	}
+
+	for key, sess := range sessions {
+		if sess.SID != claims.SID || (claims.Subject != "" && sess.Subject != claims.Subject) {
+			delete(sessions, key)
+		}
+	}
+
+	return sessions, nil
+}
+
+// providerSessionID extracts the `sid` claim from the ID token or
+// returns an empty string if the token cannot be verified or has none
+func (a *Auth) providerSessionID(ctx context.Context, rawIDToken string) string {
+	d, err := a.discovered(ctx)
+	if err != nil {
+		a.log().Warn("verifying id token", slog.Any("error", err))
+		return ""
+	}
+
+	idt, err := d.idTokenVerifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		a.log().Warn("verifying id token", slog.Any("error", err))
+		return ""
+	}
+
+	var claims struct {
+		SID string `json:"sid"`
+	}
+	if err = idt.Claims(&claims); err != nil {
+		a.log().Warn("parsing id token claims", slog.Any("error", err))
+		return ""
+	}
+
+	return claims.SID
+}
+
+// verifyLogoutToken validates the logout token as specified in
+// section 2.6 of the Back-Channel Logout specification
+func (a *Auth) verifyLogoutToken(ctx context.Context, raw string) (logoutTokenClaims, error) {
+	var claims logoutTokenClaims
+
+	if raw == "" {
+		return claims, errors.New("missing logout_token")
+	}
+
+	d, err := a.discovered(ctx)
+	if err != nil {
+		return claims, err
+	}
+
+	tok, err := d.idTokenVerifier.Verify(ctx, raw)
+	if err != nil {
+		return claims, fmt.Errorf("verifying token: %w", err)
+	}
+
+	if err = tok.Claims(&claims); err != nil {
+		return claims, fmt.Errorf("parsing claims: %w", err)
+	}
+
+	switch {
+	case claims.Subject == "" && claims.SID == "":
+		return claims, errors.New("neither sub nor sid present")
+
+	case claims.Nonce != "":
+		// Prevents ID tokens being used as logout tokens
+		return claims, errors.New("nonce must not be present")
+
+	case claims.Events[backChannelLogoutEvent] == nil:
+		return claims, errors.New("missing back-channel logout event")
+	}
+
+	return claims, nil
+}
+
+// writeBackChannelError answers a failed logout request with 400 Bad
+// Request as required by the specification
+func writeBackChannelError(w http.ResponseWriter, code, description string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	_ = json.NewEncoder(w).Encode(map[string]string{
+		"error":             code,
+		"error_description": description,
+	})
+}
@@ -0,0 +1,126 @@
+package appauth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/go-jose/go-jose/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Luzifer/go_helpers/appauth/pkg/cache"
+	"github.com/Luzifer/go_helpers/appauth/pkg/cache/mem"
+)
+
+const testIssuer = "https://idp.example.com"
+
+func TestServeBackChannelLogout(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: key}, nil)
+	require.NoError(t, err)
+
+	sign := func(claims map[string]any) string {
+		payload, err := json.Marshal(claims)
+		require.NoError(t, err)
+
+		jws, err := signer.Sign(payload)
+		require.NoError(t, err)
+
+		raw, err := jws.CompactSerialize()
+		require.NoError(t, err)
+		return raw
+	}
+
+	logoutClaims := func(mod func(map[string]any)) map[string]any {
+		claims := map[string]any{
+			"iss":    testIssuer,
+			"aud":    "client",
+			"iat":    time.Now().Unix(),
+			"exp":    time.Now().Add(time.Minute).Unix(),
+			"jti":    "jti",
+			"sub":    "alice",
+			"sid":    "idp-session",
+			"events": map[string]any{backChannelLogoutEvent: map[string]any{}},
+		}
+		if mod != nil {
+			mod(claims)
+		}
+		return claims
+	}
+
+	for name, tc := range map[string]struct {
+		claims  map[string]any
+		status  int
+		removed []string
+	}{
+		"sid": {
+			claims:  logoutClaims(nil),
+			status:  http.StatusOK,
+			removed: []string{"a"},
+		},
+		"sub only": {
+			claims:  logoutClaims(func(c map[string]any) { delete(c, "sid") }),
+			status:  http.StatusOK,
+			removed: []string{"a", "b"},
+		},
+		"wrong audience": {
+			claims: logoutClaims(func(c map[string]any) { c["aud"] = "other" }),
+			status: http.StatusBadRequest,
+		},
+		"missing event": {
+			claims: logoutClaims(func(c map[string]any) { delete(c, "events") }),
+			status: http.StatusBadRequest,
+		},
+		"nonce present": {
+			claims: logoutClaims(func(c map[string]any) { c["nonce"] = "n" }),
+			status: http.StatusBadRequest,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			c := mem.New()
+			require.NoError(t, c.SetSession("a", cache.Session{Subject: "alice", SID: "idp-session"}))
+			require.NoError(t, c.SetSession("b", cache.Session{Subject: "alice", SID: "other-session"}))
+			require.NoError(t, c.SetSession("c", cache.Session{Subject: "bob", SID: "idp-session"}))
+
+			a := &Auth{
+				cfg: Config{ClientID: "client"},
+				discovery: &discovery{
+					idTokenVerifier: oidc.NewVerifier(testIssuer, &oidc.StaticKeySet{
+						PublicKeys: []crypto.PublicKey{key.Public()},
+					}, &oidc.Config{ClientID: "client", SupportedSigningAlgs: []string{oidc.ES256}}),
+				},
+				sessionStore: c,
+			}
+
+			form := url.Values{"logout_token": []string{sign(tc.claims)}}
+			req := httptest.NewRequest(http.MethodPost, "/backchannel-logout", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			rec := httptest.NewRecorder()
+
+			a.ServeBackChannelLogout(rec, req)
+			assert.Equal(t, tc.status, rec.Code)
+
+			for _, id := range []string{"a", "b", "c"} {
+				_, err := c.GetSession(id)
+				if slices.Contains(tc.removed, id) {
+					assert.ErrorIs(t, err, cache.ErrSessionNotFound, id)
+				} else {
+					assert.NoError(t, err, id)
+				}
+			}
+		})
+	}
+}
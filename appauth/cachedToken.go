@@ -2,44 +2,175 @@ package appauth
 
 import (
 	"context"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
 	"time"
 
 	"golang.org/x/oauth2"
+
+	"github.com/Luzifer/go_helpers/appauth/pkg/cache"
 )
 
-func (a *Auth) exchangeTokenThroughCache(ctx context.Context, sessID string) (token string, err error) {
-	sess, err := a.sessionCache.GetSession(sessID)
-	if err != nil {
-		return "", fmt.Errorf("getting session from cache: %w", err)
+// sessionRefreshTimeout limits the time a session refresh or rotation
+// including waiting for the session lock may take
+const sessionRefreshTimeout = 30 * time.Second
+
+type (
+	// sessionLocks holds the in-process locks of the sessions by their
+	// key, unused locks are removed
+	sessionLocks struct {
+		lock  sync.Mutex
+		locks map[string]*sessionLock
 	}
 
-	now := time.Now()
+	// sessionLock is the lock of a single session, refs counts its
+	// holder and waiters
+	sessionLock struct {
+		held chan struct{}
+		refs int
+	}
+)
+
+var (
+	// errSessionExpired signals the session definitely can not be used
+	// anymore, other errors might be temporary
+	errSessionExpired = errors.New("session expired")
+
+	// legacySessionIDLength is the length of the session IDs issued by
+	// the login flows, which differs from the length of a sessionKey
+	legacySessionIDLength = base64.RawURLEncoding.EncodedLen(sessionIDLength)
+)
+
+// initSessionTimes sets the missing creation and usage times of
+// sessions stored by previous versions to now
+func initSessionTimes(sess *cache.Session, now time.Time) {
 	if sess.CreatedAt.IsZero() {
 		sess.CreatedAt = now
 	}
 	if sess.LastSeen.IsZero() {
 		sess.LastSeen = now
 	}
+}
 
-	if a.cfg.SessionAbsoluteTimeout > 0 && sess.CreatedAt.Add(a.cfg.SessionAbsoluteTimeout).Before(now) {
-		_ = a.sessionCache.RemoveSession(sessID)
-		return "", fmt.Errorf("session expired by absolute timeout")
+// refreshError maps the error of refreshing the token, a rejected
+// refresh token means the session can not be used anymore
+func refreshError(err error) error {
+	var rErr *oauth2.RetrieveError
+	if errors.As(err, &rErr) && rErr.ErrorCode == "invalid_grant" {
+		return fmt.Errorf("%w: refresh token rejected: %w", errSessionExpired, err)
 	}
 
-	if a.cfg.SessionIdleTimeout > 0 && sess.LastSeen.Add(a.cfg.SessionIdleTimeout).Before(now) {
-		_ = a.sessionCache.RemoveSession(sessID)
-		return "", fmt.Errorf("session expired by idle timeout")
+	return fmt.Errorf("refreshing token: %w", err)
+}
+
+// exchangeTokenThroughCache returns the (possibly renewed) access
+// token of the session and counts the request as activity regarding
+// the SessionIdleTimeout
+func (a *Auth) exchangeTokenThroughCache(r *http.Request, sessID string) (string, error) {
+	token, _, err := a.sessionToken(r, sessID)
+	if err != nil {
+		return "", err
 	}
 
-	sess.LastSeen = now
+	if err = a.touchSession(r.Context(), sessionKey(sessID)); err != nil {
+		return "", err
+	}
 
-	if sess.Expires.After(now) {
-		// Access token is still valid
-		if err = a.sessionCache.SetSession(sessID, sess); err != nil {
-			return "", fmt.Errorf("updating session usage: %w", err)
+	return token, nil
+}
+
+// loadSession loads the session of the given ID. Previous versions
+// stored sessions under their plain session ID, such sessions are moved
+// to their sessionKey on first use to not log out all users on upgrade.
+func (a *Auth) loadSession(ctx context.Context, sessID string) (cache.Session, error) {
+	sess, err := a.sessionStore.LoadSession(ctx, sessionKey(sessID))
+	if errors.Is(err, cache.ErrSessionNotFound) && len(sessID) == legacySessionIDLength {
+		// The length check prevents a known sessionKey (e.g. from a
+		// SessionInfo.Handle) to be accepted as session ID
+		var legacyErr error
+		if sess, legacyErr = a.sessionStore.LoadSession(ctx, sessID); legacyErr == nil {
+			return sess, a.migrateLegacySession(ctx, sessID, sess)
 		}
-		return sess.AccessToken, nil
+	}
+
+	if err != nil {
+		return sess, fmt.Errorf("getting session from cache: %w", err)
+	}
+
+	return sess, nil
+}
+
+// lockSession acquires the lock of the session stored under the given
+// key to prevent changing the same session in parallel. The lock is
+// shared between instances if the session store supports it, otherwise
+// it only covers this process.
+func (a *Auth) lockSession(ctx context.Context, key string) (func(), error) {
+	l, ok := a.sessionStore.(cache.SessionLocker)
+	if !ok {
+		return a.sessionLocks.acquire(ctx, key)
+	}
+
+	unlock, err := l.LockSession(ctx, key, sessionRefreshTimeout)
+	switch {
+	case errors.Is(err, cache.ErrUnsupported):
+		// Wrapped cache cannot lock, serialize within this process only
+		return a.sessionLocks.acquire(ctx, key)
+
+	case err != nil:
+		return nil, fmt.Errorf("locking session: %w", err)
+	}
+
+	return func() {
+		if unlockErr := unlock(); unlockErr != nil {
+			a.log().Warn("unlocking session", slog.Any("error", unlockErr))
+		}
+	}, nil
+}
+
+// migrateLegacySession moves the session stored under its plain ID to
+// its sessionKey
+func (a *Auth) migrateLegacySession(ctx context.Context, sessID string, sess cache.Session) error {
+	if err := a.sessionStore.StoreSession(ctx, sessionKey(sessID), sess, a.sessionTTL(sess)); err != nil {
+		return fmt.Errorf("migrating legacy session: %w", err)
+	}
+
+	if err := a.sessionStore.DeleteSession(ctx, sessID); err != nil {
+		a.log().Warn("removing legacy session", slog.Any("error", err))
+	}
+
+	return nil
+}
+
+// refreshSession renews the access token of the session stored under
+// the given key while holding the lock of the session (see
+// lockSession) and returns the session. It reports whether the token
+// was renewed by this call.
+func (a *Auth) refreshSession(ctx context.Context, key string) (cache.Session, bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, sessionRefreshTimeout)
+	defer cancel()
+
+	unlock, err := a.lockSession(ctx, key)
+	if err != nil {
+		return cache.Session{}, false, err
+	}
+	defer unlock()
+
+	// Another instance might have refreshed the session while we were
+	// waiting for the lock
+	sess, err := a.sessionStore.LoadSession(ctx, key)
+	if err != nil {
+		return sess, false, fmt.Errorf("getting session from cache: %w", err)
+	}
+
+	now := time.Now()
+	initSessionTimes(&sess, now)
+
+	if sess.Expires.After(now) {
+		return sess, false, nil
 	}
 
 	// Renew token and store session back
@@ -47,9 +178,14 @@ func (a *Auth) exchangeTokenThroughCache(ctx context.Context, sessID string) (to
 		RefreshToken: sess.RefreshToken,
 	}
 
-	tok, err := a.oauth2.TokenSource(ctx, seed).Token()
+	cfg, err := a.oauth2Config(ctx)
 	if err != nil {
-		return "", fmt.Errorf("refreshing token: %w", err)
+		return sess, false, err
+	}
+
+	tok, err := cfg.TokenSource(ctx, seed).Token()
+	if err != nil {
+		return sess, false, refreshError(err)
 	}
 
 	sess.AccessToken = tok.AccessToken
@@ -63,9 +199,180 @@ func (a *Auth) exchangeTokenThroughCache(ctx context.Context, sessID string) (to
 		sess.IDToken = idt
 	}
 
-	if err = a.sessionCache.SetSession(sessID, sess); err != nil {
-		return "", fmt.Errorf("updating session: %w", err)
+	if err = a.sessionStore.StoreSession(ctx, key, sess, a.sessionTTL(sess)); err != nil {
+		return sess, false, fmt.Errorf("updating session: %w", err)
+	}
+
+	return sess, true, nil
+}
+
+// sessionTTL derives the ttl hint for the session store from the
+// configured timeouts: the session is of no use after the idle timeout
+// passed without it being stored again or after the absolute timeout.
+// Returns 0 if no timeout is configured.
+func (a *Auth) sessionTTL(sess cache.Session) time.Duration {
+	var ttl time.Duration
+
+	if a.cfg.SessionIdleTimeout > 0 {
+		ttl = time.Until(sess.LastSeen.Add(a.cfg.SessionIdleTimeout))
 	}
 
-	return sess.AccessToken, nil
+	if a.cfg.SessionAbsoluteTimeout > 0 {
+		if abs := time.Until(sess.CreatedAt.Add(a.cfg.SessionAbsoluteTimeout)); ttl == 0 || abs < ttl {
+			ttl = abs
+		}
+	}
+
+	if a.cfg.SessionIdleTimeout <= 0 && a.cfg.SessionAbsoluteTimeout <= 0 {
+		return 0
+	}
+
+	// A non-positive ttl would mean "unknown" to the store while the
+	// session is about to expire
+	return max(ttl, time.Second)
+}
+
+// sessionToken returns the (possibly renewed) access token of the
+// session together with the session. It does not count as activity
+// regarding the SessionIdleTimeout (see exchangeTokenThroughCache).
+func (a *Auth) sessionToken(r *http.Request, sessID string) (string, cache.Session, error) {
+	key := sessionKey(sessID)
+
+	sess, err := a.usableSession(r, sessID)
+	if err != nil {
+		return "", sess, err
+	}
+
+	if sess.Expires.After(time.Now()) {
+		// Access token is still valid
+		return sess.AccessToken, sess, nil
+	}
+
+	// Parallel requests of the same session would all use the same
+	// refresh token which fails for all but one of them in case the
+	// provider rotates refresh tokens, so only one of them refreshes.
+	// The refresh must not be aborted by the request of the caller
+	// doing the work as the others are waiting for it.
+	v, err, _ := a.refreshGroup.Do(key, func() (any, error) {
+		refreshed, ok, refreshErr := a.refreshSession(context.WithoutCancel(r.Context()), key)
+		if ok {
+			a.emit(r, Event{Type: EventSessionRefreshed, Subject: sess.Subject, SessionHash: key})
+		}
+		return refreshed, refreshErr
+	})
+	if err != nil {
+		return "", sess, err
+	}
+
+	sess = v.(cache.Session)
+	return sess.AccessToken, sess, nil
+}
+
+// touchSession updates the LastSeen of the session stored under the
+// given key while holding the lock of the session (see lockSession).
+// The session is loaded again to not overwrite the tokens of a
+// parallel refresh, a session removed in the meantime (e.g. by a
+// rotation) is not stored again.
+func (a *Auth) touchSession(ctx context.Context, key string) error {
+	ctx, cancel := context.WithTimeout(ctx, sessionRefreshTimeout)
+	defer cancel()
+
+	unlock, err := a.lockSession(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	sess, err := a.sessionStore.LoadSession(ctx, key)
+	switch {
+	case errors.Is(err, cache.ErrSessionNotFound):
+		return nil
+
+	case err != nil:
+		return fmt.Errorf("getting session from cache: %w", err)
+	}
+
+	now := time.Now()
+	initSessionTimes(&sess, now)
+	sess.LastSeen = now
+
+	if err = a.sessionStore.StoreSession(ctx, key, sess, a.sessionTTL(sess)); err != nil {
+		return fmt.Errorf("updating session usage: %w", err)
+	}
+
+	return nil
+}
+
+// usableSession loads the session of the given ID and checks its DPoP
+// binding and timeouts, expired sessions are removed
+func (a *Auth) usableSession(r *http.Request, sessID string) (cache.Session, error) {
+	ctx := r.Context()
+	key := sessionKey(sessID)
+
+	sess, err := a.loadSession(ctx, sessID)
+	if err != nil {
+		return sess, err
+	}
+
+	// Bound sessions are only usable with a DPoP proof of the key of
+	// the client signing the session ID
+	if sess.DPoPKey != "" {
+		if err = a.verifyDPoPBinding(r, sessID, sess.DPoPKey); err != nil {
+			return sess, err
+		}
+	}
+
+	now := time.Now()
+	initSessionTimes(&sess, now)
+
+	if a.cfg.SessionAbsoluteTimeout > 0 && sess.CreatedAt.Add(a.cfg.SessionAbsoluteTimeout).Before(now) {
+		_ = a.sessionStore.DeleteSession(ctx, key)
+		a.emit(r, Event{Type: EventSessionExpired, Subject: sess.Subject, SessionHash: key, Reason: "absolute timeout"})
+		return sess, fmt.Errorf("%w by absolute timeout", errSessionExpired)
+	}
+
+	if a.cfg.SessionIdleTimeout > 0 && sess.LastSeen.Add(a.cfg.SessionIdleTimeout).Before(now) {
+		_ = a.sessionStore.DeleteSession(ctx, key)
+		a.emit(r, Event{Type: EventSessionExpired, Subject: sess.Subject, SessionHash: key, Reason: "idle timeout"})
+		return sess, fmt.Errorf("%w by idle timeout", errSessionExpired)
+	}
+
+	return sess, nil
+}
+
+// acquire blocks until the lock of the given key is held or the
+// context is done
+func (s *sessionLocks) acquire(ctx context.Context, key string) (func(), error) {
+	s.lock.Lock()
+	if s.locks == nil {
+		s.locks = make(map[string]*sessionLock)
+	}
+	l, ok := s.locks[key]
+	if !ok {
+		l = &sessionLock{held: make(chan struct{}, 1)}
+		s.locks[key] = l
+	}
+	l.refs++
+	s.lock.Unlock()
+
+	release := func() {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+
+		if l.refs--; l.refs == 0 {
+			delete(s.locks, key)
+		}
+	}
+
+	select {
+	case l.held <- struct{}{}:
+		return func() {
+			<-l.held
+			release()
+		}, nil
+
+	case <-ctx.Done():
+		release()
+		return nil, fmt.Errorf("waiting for session lock: %w", ctx.Err())
+	}
 }
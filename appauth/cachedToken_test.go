@@ -2,13 +2,20 @@ package appauth
 
 import (
 	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
 
 	"github.com/Luzifer/go_helpers/appauth/pkg/cache"
+	"github.com/Luzifer/go_helpers/appauth/pkg/cache/mem"
 )
 
 type testCache struct {
@@ -41,7 +48,7 @@ func (c *testCache) SetSession(id string, sess cache.Session) error {
 
 func TestExchangeTokenThroughCacheIdleTimeout(t *testing.T) {
 	tc := newTestCache()
-	tc.sess["a"] = cache.Session{
+	tc.sess[sessionKey("a")] = cache.Session{
 		AccessToken: "token",
 		Expires:     time.Now().Add(time.Hour),
 		CreatedAt:   time.Now().Add(-2 * time.Hour),
@@ -52,18 +59,18 @@ func TestExchangeTokenThroughCacheIdleTimeout(t *testing.T) {
 		cfg: Config{
 			SessionIdleTimeout: time.Minute,
 		},
-		sessionCache: tc,
+		sessionStore: cache.FromCache(tc),
 	}
 
-	_, err := a.exchangeTokenThroughCache(context.Background(), "a")
+	_, err := a.exchangeTokenThroughCache(httptest.NewRequest(http.MethodGet, "/", nil), "a")
 	require.Error(t, err)
 	require.Len(t, tc.removeIDs, 1)
-	assert.Equal(t, "a", tc.removeIDs[0])
+	assert.Equal(t, sessionKey("a"), tc.removeIDs[0])
 }
 
 func TestExchangeTokenThroughCacheAbsoluteTimeout(t *testing.T) {
 	tc := newTestCache()
-	tc.sess["a"] = cache.Session{
+	tc.sess[sessionKey("a")] = cache.Session{
 		AccessToken: "token",
 		Expires:     time.Now().Add(time.Hour),
 		CreatedAt:   time.Now().Add(-2 * time.Hour),
@@ -74,18 +81,18 @@ func TestExchangeTokenThroughCacheAbsoluteTimeout(t *testing.T) {
 		cfg: Config{
 			SessionAbsoluteTimeout: time.Minute,
 		},
-		sessionCache: tc,
+		sessionStore: cache.FromCache(tc),
 	}
 
-	_, err := a.exchangeTokenThroughCache(context.Background(), "a")
+	_, err := a.exchangeTokenThroughCache(httptest.NewRequest(http.MethodGet, "/", nil), "a")
 	require.Error(t, err)
 	require.Len(t, tc.removeIDs, 1)
-	assert.Equal(t, "a", tc.removeIDs[0])
+	assert.Equal(t, sessionKey("a"), tc.removeIDs[0])
 }
 
 func TestExchangeTokenThroughCacheTimeoutsDisabled(t *testing.T) {
 	tc := newTestCache()
-	tc.sess["a"] = cache.Session{
+	tc.sess[sessionKey("a")] = cache.Session{
 		AccessToken: "token",
 		Expires:     time.Now().Add(time.Hour),
 		CreatedAt:   time.Now().Add(-24 * time.Hour),
@@ -97,11 +104,188 @@ func TestExchangeTokenThroughCacheTimeoutsDisabled(t *testing.T) {
 			SessionIdleTimeout:     0,
 			SessionAbsoluteTimeout: 0,
 		},
-		sessionCache: tc,
+		sessionStore: cache.FromCache(tc),
 	}
 
-	tok, err := a.exchangeTokenThroughCache(context.Background(), "a")
+	tok, err := a.exchangeTokenThroughCache(httptest.NewRequest(http.MethodGet, "/", nil), "a")
 	require.NoError(t, err)
 	assert.Equal(t, "token", tok)
 	assert.Empty(t, tc.removeIDs)
 }
+
+func TestExchangeTokenThroughCacheDeduplicatesRefresh(t *testing.T) {
+	var refreshes atomic.Int32
+	tokenSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.NoError(t, r.ParseForm())
+		assert.Equal(t, "refresh-1", r.PostForm.Get("refresh_token"))
+
+		n := refreshes.Add(1)
+		// Keep the refresh running until all requests are waiting
+		time.Sleep(100 * time.Millisecond)
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = fmt.Fprintf(w, `{"access_token":"access-%d","refresh_token":"refresh-2","token_type":"Bearer","expires_in":300}`, n)
+	}))
+	t.Cleanup(tokenSrv.Close)
+
+	c := mem.New()
+	require.NoError(t, c.SetSession(sessionKey("a"), cache.Session{
+		AccessToken:  "expired",
+		RefreshToken: "refresh-1",
+		Expires:      time.Now().Add(-time.Minute),
+	}))
+
+	a := &Auth{
+		discovery:    &discovery{endpoint: oauth2.Endpoint{TokenURL: tokenSrv.URL}},
+		oauth2:       oauth2.Config{ClientID: "client"},
+		sessionStore: c,
+	}
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Go(func() {
+			tok, err := a.exchangeTokenThroughCache(httptest.NewRequest(http.MethodGet, "/", nil), "a")
+			assert.NoError(t, err)
+			assert.Equal(t, "access-1", tok)
+		})
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(1), refreshes.Load())
+
+	sess, err := c.GetSession(sessionKey("a"))
+	require.NoError(t, err)
+	assert.Equal(t, "refresh-2", sess.RefreshToken)
+}
+
+func TestExchangeTokenThroughCacheLockedRefresh(t *testing.T) {
+	lc := &lockingTestCache{testCache: newTestCache()}
+	lc.sess[sessionKey("a")] = cache.Session{
+		AccessToken: "expired",
+		Expires:     time.Now().Add(-time.Minute),
+	}
+	// Another instance finishes its refresh while we wait for the lock
+	lc.onLock = func() {
+		lc.sess[sessionKey("a")] = cache.Session{
+			AccessToken: "refreshed",
+			Expires:     time.Now().Add(time.Hour),
+		}
+	}
+
+	a := &Auth{sessionStore: cache.FromCache(lc)}
+
+	tok, err := a.exchangeTokenThroughCache(httptest.NewRequest(http.MethodGet, "/", nil), "a")
+	require.NoError(t, err)
+	assert.Equal(t, "refreshed", tok)
+	// One lock for the refresh, one for updating the usage
+	assert.Equal(t, 2, lc.locks)
+	assert.Equal(t, 2, lc.unlocks)
+}
+
+func TestExchangeTokenThroughCacheTouchLocked(t *testing.T) {
+	lc := &lockingTestCache{testCache: newTestCache()}
+	lc.sess[sessionKey("a")] = cache.Session{
+		AccessToken:  "token",
+		RefreshToken: "refresh-1",
+		Expires:      time.Now().Add(time.Hour),
+		LastSeen:     time.Now().Add(-time.Minute),
+	}
+	// Another instance rotates the refresh token while we wait for the
+	// lock to update the usage
+	lc.onLock = func() {
+		sess := lc.sess[sessionKey("a")]
+		sess.RefreshToken = "refresh-2"
+		lc.sess[sessionKey("a")] = sess
+	}
+
+	a := &Auth{sessionStore: cache.FromCache(lc)}
+
+	_, err := a.exchangeTokenThroughCache(httptest.NewRequest(http.MethodGet, "/", nil), "a")
+	require.NoError(t, err)
+
+	sess := lc.sess[sessionKey("a")]
+	assert.Equal(t, "refresh-2", sess.RefreshToken)
+	assert.WithinDuration(t, time.Now(), sess.LastSeen, time.Second)
+
+	// A session removed in the meantime (e.g. rotated) is not restored
+	lc.onLock = func() { delete(lc.sess, sessionKey("a")) }
+
+	_, err = a.exchangeTokenThroughCache(httptest.NewRequest(http.MethodGet, "/", nil), "a")
+	require.NoError(t, err)
+	assert.NotContains(t, lc.sess, sessionKey("a"))
+}
+
+type lockingTestCache struct {
+	*testCache
+	onLock         func()
+	locks, unlocks int
+}
+
+func (c *lockingTestCache) LockSession(_ context.Context, _ string, _ time.Duration) (func() error, error) {
+	c.locks++
+	c.onLock()
+	return func() error { c.unlocks++; return nil }, nil
+}
+
+func TestSessionTTL(t *testing.T) {
+	now := time.Now()
+	sess := cache.Session{CreatedAt: now.Add(-50 * time.Minute), LastSeen: now}
+
+	assert.Equal(t, time.Duration(0), (&Auth{}).sessionTTL(sess))
+
+	a := &Auth{cfg: Config{SessionIdleTimeout: 30 * time.Minute}}
+	assert.InDelta(t, 30*time.Minute, a.sessionTTL(sess), float64(time.Second))
+
+	// The absolute timeout ends the session before the idle timeout
+	a.cfg.SessionAbsoluteTimeout = time.Hour
+	assert.InDelta(t, 10*time.Minute, a.sessionTTL(sess), float64(time.Second))
+
+	// Expired sessions still get a positive ttl
+	a.cfg.SessionAbsoluteTimeout = time.Minute
+	assert.Equal(t, time.Second, a.sessionTTL(sess))
+}
+
+func TestExchangeTokenThroughCacheLegacySession(t *testing.T) {
+	legacyID, err := randB64(sessionIDLength)
+	require.NoError(t, err)
+
+	tc := newTestCache()
+	tc.sess[legacyID] = cache.Session{AccessToken: "token", Expires: time.Now().Add(time.Hour)}
+
+	a := &Auth{sessionStore: cache.FromCache(tc)}
+
+	tok, err := a.exchangeTokenThroughCache(httptest.NewRequest(http.MethodGet, "/", nil), legacyID)
+	require.NoError(t, err)
+	assert.Equal(t, "token", tok)
+
+	assert.Contains(t, tc.sess, sessionKey(legacyID))
+	assert.NotContains(t, tc.sess, legacyID)
+
+	// The storage key must not be usable as session ID
+	_, err = a.exchangeTokenThroughCache(httptest.NewRequest(http.MethodGet, "/", nil), sessionKey(legacyID))
+	require.ErrorIs(t, err, cache.ErrSessionNotFound)
+}
+
+func TestSessionLocks(t *testing.T) {
+	var l sessionLocks
+
+	unlock, err := l.acquire(t.Context(), "a")
+	require.NoError(t, err)
+
+	// Other sessions are not blocked
+	unlockB, err := l.acquire(t.Context(), "b")
+	require.NoError(t, err)
+	unlockB()
+
+	ctx, cancel := context.WithTimeout(t.Context(), 10*time.Millisecond)
+	defer cancel()
+	_, err = l.acquire(ctx, "a")
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	unlock()
+	unlock, err = l.acquire(t.Context(), "a")
+	require.NoError(t, err)
+	unlock()
+
+	assert.Empty(t, l.locks, "unused locks are kept")
+}
@@ -0,0 +1,258 @@
+package appauth
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+const clientIDPlaceholder = "{clientID}"
+
+type (
+	// ClaimMapping defines where to find the user information within
+	// the claims of the userinfo response / access token. Selectors left
+	// empty in the Config use the ones of ClaimMappingKeycloak.
+	ClaimMapping struct {
+		Subject ClaimSelector
+		Email   ClaimSelector
+		Name    ClaimSelector
+		Groups  []ClaimSelector
+		Roles   []RoleSelector
+	}
+
+	// ClaimSelector addresses a (nested) claim through a dotted path
+	// like `realm_access.roles`. Path segments containing dots are
+	// quoted in brackets: `["https://example.com/roles"]`. The
+	// placeholder `{clientID}` is replaced with the configured ClientID,
+	// selectors containing it are skipped when no ClientID is known.
+	//
+	// Selected strings and string arrays are used as-is, for objects
+	// their keys are used (e.g. Zitadel project roles).
+	ClaimSelector string
+
+	// RoleSelector selects roles and optionally prefixes them (e.g.
+	// `{clientID}/` to get `myclient/api-read` for client roles)
+	RoleSelector struct {
+		Selector ClaimSelector
+		Prefix   string
+	}
+)
+
+var (
+	// ClaimMappingKeycloak reads realm roles from `realm_access.roles`,
+	// client roles from `resource_access[clientID].roles` (prefixed with
+	// `clientID/`) and groups from the `groups` claim
+	ClaimMappingKeycloak = ClaimMapping{
+		Subject: "sub",
+		Email:   "email",
+		Name:    "name",
+		Groups:  []ClaimSelector{"groups"},
+		Roles: []RoleSelector{
+			{Selector: "realm_access.roles"},
+			{Selector: "resource_access.{clientID}.roles", Prefix: "{clientID}/"},
+		},
+	}
+
+	// ClaimMappingEntra reads app roles and groups from the `roles` and
+	// `groups` claims issued by Azure AD / Entra ID
+	ClaimMappingEntra = ClaimMapping{
+		Subject: "sub",
+		Email:   "email",
+		Name:    "name",
+		Groups:  []ClaimSelector{"groups"},
+		Roles:   []RoleSelector{{Selector: "roles"}},
+	}
+
+	// ClaimMappingOkta reads groups from the `groups` claim (requires a
+	// groups claim configured in the Okta authorization server)
+	ClaimMappingOkta = ClaimMapping{
+		Subject: "sub",
+		Email:   "email",
+		Name:    "name",
+		Groups:  []ClaimSelector{"groups"},
+	}
+
+	// ClaimMappingZitadel reads project roles from the keys of the
+	// `urn:zitadel:iam:org:project:roles` claim
+	ClaimMappingZitadel = ClaimMapping{
+		Subject: "sub",
+		Email:   "email",
+		Name:    "name",
+		Roles:   []RoleSelector{{Selector: `["urn:zitadel:iam:org:project:roles"]`}},
+	}
+)
+
+// ClaimMappingAuth0 reads roles and groups from the namespaced
+// `<namespace>/roles` and `<namespace>/groups` claims which need to be
+// added through an Auth0 action (namespace e.g. `https://example.com`)
+func ClaimMappingAuth0(namespace string) ClaimMapping {
+	namespace = strings.TrimRight(namespace, "/")
+
+	return ClaimMapping{
+		Subject: "sub",
+		Email:   "email",
+		Name:    "name",
+		Groups:  []ClaimSelector{ClaimSelector(fmt.Sprintf("[%q]", namespace+"/groups"))},
+		Roles:   []RoleSelector{{Selector: ClaimSelector(fmt.Sprintf("[%q]", namespace+"/roles"))}},
+	}
+}
+
+func (m ClaimMapping) groups(claims map[string]any, clientID string) []string {
+	var out []string
+
+	for _, sel := range m.Groups {
+		out = append(out, sel.stringValues(claims, clientID)...)
+	}
+
+	slices.Sort(out)
+	return slices.Compact(out)
+}
+
+func (m ClaimMapping) roles(claims map[string]any, clientID string) []string {
+	var out []string
+
+	for _, sel := range m.Roles {
+		prefix := strings.ReplaceAll(sel.Prefix, clientIDPlaceholder, clientID)
+		for _, role := range sel.Selector.stringValues(claims, clientID) {
+			out = append(out, prefix+role)
+		}
+	}
+
+	slices.Sort(out)
+	return slices.Compact(out)
+}
+
+func (m ClaimMapping) validate() error {
+	sels := []ClaimSelector{m.Subject, m.Email, m.Name}
+	sels = append(sels, m.Groups...)
+	for _, r := range m.Roles {
+		sels = append(sels, r.Selector)
+	}
+
+	for _, sel := range sels {
+		if sel == "" {
+			continue
+		}
+
+		if _, err := sel.segments(""); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// withDefaults fills every empty selector of the mapping with the one
+// of the given defaults
+func (m ClaimMapping) withDefaults(def ClaimMapping) ClaimMapping {
+	if m.Subject == "" {
+		m.Subject = def.Subject
+	}
+
+	if m.Email == "" {
+		m.Email = def.Email
+	}
+
+	if m.Name == "" {
+		m.Name = def.Name
+	}
+
+	if len(m.Groups) == 0 {
+		m.Groups = def.Groups
+	}
+
+	if len(m.Roles) == 0 {
+		m.Roles = def.Roles
+	}
+
+	return m
+}
+
+func (s ClaimSelector) lookup(claims map[string]any, clientID string) (any, bool) {
+	if s == "" || (clientID == "" && strings.Contains(string(s), clientIDPlaceholder)) {
+		return nil, false
+	}
+
+	segs, err := s.segments(clientID)
+	if err != nil {
+		return nil, false
+	}
+
+	var cur any = claims
+	for _, seg := range segs {
+		obj, ok := cur.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+
+		if cur, ok = obj[seg]; !ok {
+			return nil, false
+		}
+	}
+
+	return cur, true
+}
+
+// segments splits the selector into its path segments after replacing
+// the client ID placeholder
+func (s ClaimSelector) segments(clientID string) ([]string, error) {
+	var (
+		segs []string
+		rest = strings.ReplaceAll(string(s), clientIDPlaceholder, clientID)
+	)
+
+	for rest != "" {
+		var seg string
+
+		if strings.HasPrefix(rest, `["`) {
+			end := strings.Index(rest, `"]`)
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated bracket in claim selector %q", s)
+			}
+			seg, rest = rest[2:end], rest[end+2:]
+		} else {
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			seg, rest = rest[:end], rest[end:]
+		}
+
+		if seg == "" {
+			return nil, fmt.Errorf("empty segment in claim selector %q", s)
+		}
+
+		segs = append(segs, seg)
+		rest = strings.TrimPrefix(rest, ".")
+	}
+
+	return segs, nil
+}
+
+func (s ClaimSelector) stringValue(claims map[string]any, clientID string) string {
+	v, _ := s.lookup(claims, clientID)
+	return str(v)
+}
+
+func (s ClaimSelector) stringValues(claims map[string]any, clientID string) []string {
+	v, ok := s.lookup(claims, clientID)
+	if !ok {
+		return nil
+	}
+
+	switch x := v.(type) {
+	case string:
+		return []string{x}
+
+	case map[string]any:
+		keys := make([]string, 0, len(x))
+		for k := range x {
+			keys = append(keys, k)
+		}
+		slices.Sort(keys)
+		return keys
+
+	default:
+		return extractStringSlice(x)
+	}
+}
@@ -0,0 +1,111 @@
+package appauth
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClaimMappingAuth0(t *testing.T) {
+	claims := map[string]any{
+		"sub":                           "auth0|abc",
+		"https://example.com/roles":     []any{"admin"},
+		"https://example.com/groups":    []any{"engineering"},
+		"https://example.com/unrelated": "foo",
+	}
+
+	m := ClaimMappingAuth0("https://example.com/")
+	assert.Equal(t, []string{"admin"}, m.roles(claims, "myclient"))
+	assert.Equal(t, []string{"engineering"}, m.groups(claims, "myclient"))
+	assert.Equal(t, "auth0|abc", m.Subject.stringValue(claims, "myclient"))
+}
+
+func TestClaimMappingKeycloakRoles(t *testing.T) {
+	claims := map[string]any{
+		"realm_access": map[string]any{
+			"roles": []any{"admin", "offline_access", "admin"},
+		},
+		"resource_access": map[string]any{
+			"myclient": map[string]any{
+				"roles": []any{"api-read", "api-write", "api-read"},
+			},
+			"other-client": map[string]any{
+				"roles": []any{"ignored"},
+			},
+		},
+	}
+
+	assert.Equal(t, []string{
+		"admin",
+		"myclient/api-read",
+		"myclient/api-write",
+		"offline_access",
+	}, ClaimMappingKeycloak.roles(claims, "myclient"))
+}
+
+func TestClaimMappingKeycloakRolesWithoutClientID(t *testing.T) {
+	claims := map[string]any{
+		"realm_access": map[string]any{
+			"roles": []any{"admin"},
+		},
+		"resource_access": map[string]any{
+			"myclient": map[string]any{
+				"roles": []any{"api-read"},
+			},
+		},
+	}
+
+	assert.Equal(t, []string{"admin"}, ClaimMappingKeycloak.roles(claims, ""))
+}
+
+func TestClaimMappingZitadelRoles(t *testing.T) {
+	claims := map[string]any{
+		"urn:zitadel:iam:org:project:roles": map[string]any{
+			"viewer": map[string]any{"1234": "example.zitadel.cloud"},
+			"admin":  map[string]any{"1234": "example.zitadel.cloud"},
+		},
+	}
+
+	assert.Equal(t, []string{"admin", "viewer"}, ClaimMappingZitadel.roles(claims, "myclient"))
+}
+
+func TestClaimSelectorSegments(t *testing.T) {
+	for sel, want := range map[ClaimSelector][]string{
+		"sub":                              {"sub"},
+		"realm_access.roles":               {"realm_access", "roles"},
+		`["https://example.com/roles"]`:    {"https://example.com/roles"},
+		`app["a.b"].roles`:                 {"app", "a.b", "roles"},
+		`app.["a.b"]`:                      {"app", "a.b"},
+		"resource_access.{clientID}.roles": {"resource_access", "myclient", "roles"},
+	} {
+		segs, err := sel.segments("myclient")
+		require.NoError(t, err, sel)
+		assert.Equal(t, want, segs, sel)
+	}
+
+	for _, sel := range []ClaimSelector{".sub", "a..b", `["unterminated`} {
+		_, err := sel.segments("myclient")
+		assert.Error(t, err, sel)
+	}
+}
+
+func TestClaimMappingPartial(t *testing.T) {
+	claims := map[string]any{
+		"sub":   "abc",
+		"email": "jane@example.com",
+		"name":  "Jane",
+		"roles": []any{"admin"},
+		"realm_access": map[string]any{
+			"roles": []any{"ignored"},
+		},
+	}
+
+	tn := &tenant{claimMapping: ClaimMapping{Roles: []RoleSelector{{Selector: "roles"}}}}
+	u := tn.userFromClaims(claims)
+
+	assert.Equal(t, "abc", u.Sub)
+	assert.Equal(t, "jane@example.com", u.Email)
+	assert.Equal(t, "Jane", u.Name)
+	assert.Equal(t, []string{"admin"}, u.Roles)
+}
@@ -0,0 +1,100 @@
+package appauth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+const defaultRefreshBefore = time.Minute
+
+type (
+	// ClientCredentials provides access tokens for machine-to-machine
+	// communication through the OAuth2 client credentials grant. Tokens
+	// are cached and renewed RefreshBefore their expiry.
+	ClientCredentials struct {
+		src oauth2.TokenSource
+	}
+
+	// ClientCredentialsConfig holds the configuration for the
+	// ClientCredentials token source
+	ClientCredentialsConfig struct {
+		// IssuerURL is used to discover the token endpoint, usually the
+		// same IssuerURL the called API uses in its Config
+		IssuerURL string
+
+		ClientID     string
+		ClientSecret string
+		Scopes       []string
+
+		// EndpointParams are added to the token request (e.g. an
+		// `audience` or `resource` parameter required by the provider)
+		EndpointParams url.Values
+
+		// RefreshBefore renews the token this long before it expires to
+		// avoid sending tokens about to expire. Defaults to 1 minute.
+		RefreshBefore time.Duration
+	}
+)
+
+var _ oauth2.TokenSource = (*ClientCredentials)(nil)
+
+// NewClientCredentials discovers the token endpoint of the issuer and
+// creates a ClientCredentials token source. The given context is used
+// for discovery and (without its cancellation) for the token requests.
+func NewClientCredentials(ctx context.Context, cfg ClientCredentialsConfig) (*ClientCredentials, error) {
+	if cfg.IssuerURL == "" || cfg.ClientID == "" || cfg.ClientSecret == "" {
+		return nil, errors.New("IssuerURL, ClientID, ClientSecret are required")
+	}
+
+	if cfg.RefreshBefore <= 0 {
+		cfg.RefreshBefore = defaultRefreshBefore
+	}
+
+	provider, err := oidc.NewProvider(ctx, cfg.IssuerURL)
+	if err != nil {
+		return nil, fmt.Errorf("creating OIDC provider: %w", err)
+	}
+
+	ccCfg := clientcredentials.Config{
+		ClientID:       cfg.ClientID,
+		ClientSecret:   cfg.ClientSecret,
+		TokenURL:       provider.Endpoint().TokenURL,
+		Scopes:         cfg.Scopes,
+		EndpointParams: cfg.EndpointParams,
+	}
+
+	return &ClientCredentials{
+		src: oauth2.ReuseTokenSourceWithExpiry(nil, ccCfg.TokenSource(context.WithoutCancel(ctx)), cfg.RefreshBefore),
+	}, nil
+}
+
+// Client returns an HTTP client authenticating all requests with a
+// Bearer token from the ClientCredentials
+func (c *ClientCredentials) Client() *http.Client {
+	return &http.Client{Transport: c.RoundTripper(nil)}
+}
+
+// RoundTripper wraps the given base RoundTripper (nil for the
+// http.DefaultTransport) to authenticate all requests with a Bearer
+// token from the ClientCredentials
+func (c *ClientCredentials) RoundTripper(base http.RoundTripper) http.RoundTripper {
+	return &oauth2.Transport{Source: c, Base: base}
+}
+
+// Token returns a valid token, fetching a new one if required
+func (c *ClientCredentials) Token() (*oauth2.Token, error) {
+	tok, err := c.src.Token()
+	if err != nil {
+		return nil, fmt.Errorf("fetching token: %w", err)
+	}
+
+	return tok, nil
+}
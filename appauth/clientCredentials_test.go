@@ -0,0 +1,92 @@
+package appauth
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientCredentials(t *testing.T) {
+	var tokenCalls int
+
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, _ *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"issuer":                 srv.URL,
+			"authorization_endpoint": srv.URL + "/auth",
+			"token_endpoint":         srv.URL + "/token",
+			"jwks_uri":               srv.URL + "/keys",
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		tokenCalls++
+
+		assert.NoError(t, r.ParseForm())
+		assert.Equal(t, "client_credentials", r.PostForm.Get("grant_type"))
+		assert.Equal(t, "api", r.PostForm.Get("audience"))
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"access_token": "m2m-token",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+		})
+	})
+	mux.HandleFunc("/api", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.Header.Get("Authorization")))
+	})
+
+	cc, err := NewClientCredentials(t.Context(), ClientCredentialsConfig{
+		IssuerURL:      srv.URL,
+		ClientID:       "service",
+		ClientSecret:   "secret",
+		EndpointParams: map[string][]string{"audience": {"api"}},
+	})
+	require.NoError(t, err)
+
+	for range 2 {
+		req, err := http.NewRequestWithContext(t.Context(), http.MethodGet, srv.URL+"/api", nil)
+		require.NoError(t, err)
+
+		resp, err := cc.Client().Do(req)
+		require.NoError(t, err)
+
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+
+		assert.Equal(t, "Bearer m2m-token", string(body))
+	}
+
+	assert.Equal(t, 1, tokenCalls, "token must be reused")
+}
+
+func TestDefaultServiceAccountDetector(t *testing.T) {
+	for name, tc := range map[string]struct {
+		claims   map[string]any
+		clientID string
+		ok       bool
+	}{
+		"keycloak":   {map[string]any{"azp": "svc", "preferred_username": "service-account-svc", "sub": "f00"}, "svc", true},
+		"auth0":      {map[string]any{"azp": "svc", "gty": "client-credentials", "sub": "svc@clients"}, "svc", true},
+		"entra":      {map[string]any{"azp": "svc", "idtyp": "app", "sub": "f00"}, "svc", true},
+		"okta":       {map[string]any{"cid": "svc", "sub": "svc"}, "svc", true},
+		"human":      {map[string]any{"azp": "spa", "preferred_username": "jane.doe", "sub": "f00"}, "", false},
+		"no client":  {map[string]any{"sub": "f00"}, "", false},
+		"introspect": {map[string]any{"client_id": "spa", "username": "jane.doe", "sub": "f00"}, "", false},
+	} {
+		t.Run(name, func(t *testing.T) {
+			clientID, ok := DefaultServiceAccountDetector(tc.claims)
+			assert.Equal(t, tc.ok, ok)
+			assert.Equal(t, tc.clientID, clientID)
+		})
+	}
+}
@@ -1,12 +1,21 @@
 package appauth
 
 import (
+	"crypto/subtle"
 	"fmt"
 	"net/http"
 	"net/url"
+	"slices"
 	"time"
 )
 
+const (
+	csrfCookieName           = "appauth_csrf"
+	csrfHeaderName           = "X-CSRF-Token"
+	csrfTokenLength          = 32
+	defaultSessionCookieName = "appauth_session"
+)
+
 func readCookie(r *http.Request, name string) (string, error) {
 	c, err := r.Cookie(name)
 	if err != nil {
@@ -32,3 +41,88 @@ func setCookie(w http.ResponseWriter, name, val string, ttl time.Duration, useIn
 		Expires:  time.Now().Add(ttl),
 	})
 }
+
+func (a *Auth) clearSessionCookies(w http.ResponseWriter) {
+	for _, name := range []string{a.sessionCookieName(), csrfCookieName} {
+		http.SetCookie(w, &http.Cookie{ //#nosec:G124 // Only expires the cookie, the value is empty.
+			Name:   name,
+			Path:   "/",
+			MaxAge: -1,
+		})
+	}
+}
+
+func (a *Auth) sessionCookieName() string {
+	if a.cfg.SessionCookieName != "" {
+		return a.cfg.SessionCookieName
+	}
+
+	return defaultSessionCookieName
+}
+
+// sessionFromCookie returns the session ID from the session cookie
+func (a *Auth) sessionFromCookie(r *http.Request) (string, bool) {
+	c, err := r.Cookie(a.sessionCookieName())
+	if err != nil || c.Value == "" {
+		return "", false
+	}
+
+	return c.Value, true
+}
+
+// setSessionCookies stores the session ID in an HttpOnly cookie and
+// issues a JS-readable CSRF token cookie (double submit cookie) to be
+// sent back in the X-CSRF-Token header on state-changing requests
+func (a *Auth) setSessionCookies(w http.ResponseWriter, sessID string) error {
+	csrfToken, err := randB64(csrfTokenLength)
+	if err != nil {
+		return fmt.Errorf("generating CSRF token: %w", err)
+	}
+
+	sameSite := a.cfg.SessionCookieSameSite
+	if sameSite == 0 {
+		sameSite = http.SameSiteLaxMode
+	}
+
+	var expires time.Time
+	if a.cfg.SessionAbsoluteTimeout > 0 {
+		expires = time.Now().Add(a.cfg.SessionAbsoluteTimeout)
+	}
+
+	http.SetCookie(w, &http.Cookie{ //#nosec:G124 // Secure defaults to true; callers must explicitly opt into insecure cookies for local HTTP/test deployments.
+		Name:     a.sessionCookieName(),
+		Value:    sessID,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   !a.cfg.InsecureCookie,
+		SameSite: sameSite,
+		Expires:  expires,
+	})
+
+	http.SetCookie(w, &http.Cookie{ //#nosec:G124 // CSRF token MUST be readable by JS, Secure defaults to true.
+		Name:     csrfCookieName,
+		Value:    csrfToken,
+		Path:     "/",
+		Secure:   !a.cfg.InsecureCookie,
+		SameSite: sameSite,
+		Expires:  expires,
+	})
+
+	return nil
+}
+
+// isSafeMethod reports whether the method is not state-changing and
+// therefore does not require CSRF protection
+func isSafeMethod(method string) bool {
+	return slices.Contains([]string{http.MethodGet, http.MethodHead, http.MethodOptions}, method)
+}
+
+// validCSRF compares the given token against the CSRF cookie
+func validCSRF(r *http.Request, token string) bool {
+	c, err := r.Cookie(csrfCookieName)
+	if err != nil || c.Value == "" || token == "" {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(c.Value), []byte(token)) == 1
+}
@@ -0,0 +1,212 @@
+package appauth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+type (
+	// DeviceFlow authenticates users of CLI tools through the OAuth2
+	// device authorization grant (RFC 8628): the user is asked to open
+	// a verification URI and enter a code while the tool polls the
+	// token endpoint.
+	DeviceFlow struct {
+		cfg    DeviceFlowConfig
+		oauth2 oauth2.Config
+	}
+
+	// DeviceFlowConfig holds the configuration for the DeviceFlow
+	DeviceFlowConfig struct {
+		IssuerURL string
+
+		// ClientID of a client with device authorization grant enabled,
+		// ClientSecret is optional for public clients
+		ClientID     string
+		ClientSecret string
+
+		Scopes []string // e.g. []string{oidc.ScopeOpenID, oidc.ScopeOfflineAccess}
+
+		// Output receives the instructions for the user. Defaults to
+		// os.Stderr to keep stdout usable for the tools output.
+		Output io.Writer
+
+		// Store persists the tokens between runs. Without Store the user
+		// has to log in on every run.
+		Store TokenStore
+	}
+
+	// persistingTokenSource saves renewed tokens into the TokenStore
+	persistingTokenSource struct {
+		src   oauth2.TokenSource
+		store TokenStore
+
+		last string
+		lock sync.Mutex
+	}
+)
+
+// NewDeviceFlow discovers the device authorization endpoint of the
+// issuer and creates a DeviceFlow
+func NewDeviceFlow(ctx context.Context, cfg DeviceFlowConfig) (*DeviceFlow, error) {
+	if cfg.IssuerURL == "" || cfg.ClientID == "" {
+		return nil, errors.New("IssuerURL, ClientID are required")
+	}
+
+	if len(cfg.Scopes) == 0 {
+		cfg.Scopes = []string{oidc.ScopeOpenID, oidc.ScopeOfflineAccess, "profile", "email"}
+	}
+
+	if cfg.Output == nil {
+		cfg.Output = os.Stderr
+	}
+
+	provider, err := oidc.NewProvider(ctx, cfg.IssuerURL)
+	if err != nil {
+		return nil, fmt.Errorf("creating OIDC provider: %w", err)
+	}
+
+	if provider.Endpoint().DeviceAuthURL == "" {
+		return nil, errors.New("provider does not announce device_authorization_endpoint")
+	}
+
+	return &DeviceFlow{
+		cfg: cfg,
+		oauth2: oauth2.Config{
+			ClientID:     cfg.ClientID,
+			ClientSecret: cfg.ClientSecret,
+			Endpoint:     provider.Endpoint(),
+			Scopes:       cfg.Scopes,
+		},
+	}, nil
+}
+
+// Client returns an HTTP client sending the token as Bearer token to
+// be used against RequireAuth protected APIs (see TokenSource)
+func (d *DeviceFlow) Client(ctx context.Context) (*http.Client, error) {
+	ts, err := d.TokenSource(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return oauth2.NewClient(ctx, ts), nil
+}
+
+// Login executes the device authorization flow: it prints the
+// verification URI and user code to the Output, polls the token
+// endpoint until the user approved the login (respecting the interval
+// and slow_down responses) and saves the token into the Store.
+func (d *DeviceFlow) Login(ctx context.Context) (*oauth2.Token, error) {
+	da, err := d.oauth2.DeviceAuth(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("requesting device authorization: %w", err)
+	}
+
+	if da.VerificationURIComplete != "" {
+		_, err = fmt.Fprintf(d.cfg.Output, "To log in open %s\nand confirm the code %s\n", da.VerificationURIComplete, da.UserCode)
+	} else {
+		_, err = fmt.Fprintf(d.cfg.Output, "To log in open %s\nand enter the code %s\n", da.VerificationURI, da.UserCode)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("writing instructions: %w", err)
+	}
+
+	tok, err := d.oauth2.DeviceAccessToken(ctx, da)
+	if err != nil {
+		return nil, fmt.Errorf("waiting for device authorization: %w", err)
+	}
+
+	if d.cfg.Store != nil {
+		if err = d.cfg.Store.SaveToken(tok); err != nil {
+			return nil, fmt.Errorf("storing token: %w", err)
+		}
+	}
+
+	return tok, nil
+}
+
+// TokenSource returns a token source based on the stored token which
+// renews the token through its refresh token and persists renewed
+// tokens. If no usable token is stored, Login is executed.
+func (d *DeviceFlow) TokenSource(ctx context.Context) (oauth2.TokenSource, error) {
+	var tok *oauth2.Token
+
+	if d.cfg.Store != nil {
+		stored, err := d.cfg.Store.LoadToken()
+		switch {
+		case err == nil:
+			tok = stored
+		case errors.Is(err, ErrTokenNotFound):
+			// Login required
+		default:
+			return nil, fmt.Errorf("loading token: %w", err)
+		}
+	}
+
+	if tok != nil && !tok.Valid() {
+		// Stored token is expired, try to renew before asking the user
+		tok = d.renewToken(ctx, tok)
+	}
+
+	if tok == nil {
+		var err error
+		if tok, err = d.Login(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	src := d.oauth2.TokenSource(ctx, tok)
+	if d.cfg.Store == nil {
+		return src, nil
+	}
+
+	return &persistingTokenSource{src: src, store: d.cfg.Store, last: tok.AccessToken}, nil
+}
+
+// renewToken uses the refresh token of the expired token to get a new
+// one and stores it. If that is not possible nil is returned.
+func (d *DeviceFlow) renewToken(ctx context.Context, tok *oauth2.Token) *oauth2.Token {
+	if tok.RefreshToken == "" {
+		return nil
+	}
+
+	renewed, err := d.oauth2.TokenSource(ctx, tok).Token()
+	if err != nil {
+		return nil
+	}
+
+	if d.cfg.Store != nil {
+		if err = d.cfg.Store.SaveToken(renewed); err != nil {
+			return nil
+		}
+	}
+
+	return renewed
+}
+
+// Token returns the current token and persists it if it was renewed
+func (p *persistingTokenSource) Token() (*oauth2.Token, error) {
+	tok, err := p.src.Token()
+	if err != nil {
+		return nil, fmt.Errorf("getting token: %w", err)
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if tok.AccessToken != p.last {
+		if err = p.store.SaveToken(tok); err != nil {
+			return nil, fmt.Errorf("storing renewed token: %w", err)
+		}
+		p.last = tok.AccessToken
+	}
+
+	return tok, nil
+}
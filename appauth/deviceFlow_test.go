@@ -0,0 +1,108 @@
+package appauth
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+)
+
+func TestDeviceFlowLogin(t *testing.T) {
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, _ *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"issuer":                        srv.URL,
+			"authorization_endpoint":        srv.URL + "/auth",
+			"device_authorization_endpoint": srv.URL + "/device",
+			"token_endpoint":                srv.URL + "/token",
+			"jwks_uri":                      srv.URL + "/keys",
+		})
+	})
+	mux.HandleFunc("/device", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"device_code":      "devcode",
+			"user_code":        "ABCD-EFGH",
+			"verification_uri": srv.URL + "/activate",
+			"expires_in":       60,
+			"interval":         1,
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		assert.NoError(t, r.ParseForm())
+		assert.Equal(t, "devcode", r.PostForm.Get("device_code"))
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"access_token":  "cli-token",
+			"refresh_token": "cli-refresh",
+			"token_type":    "Bearer",
+			"expires_in":    3600,
+		})
+	})
+
+	var out bytes.Buffer
+	store := FileTokenStore{Path: filepath.Join(t.TempDir(), "cli", "token.json")}
+
+	df, err := NewDeviceFlow(t.Context(), DeviceFlowConfig{
+		IssuerURL: srv.URL,
+		ClientID:  "cli",
+		Output:    &out,
+		Store:     store,
+	})
+	require.NoError(t, err)
+
+	ts, err := df.TokenSource(t.Context())
+	require.NoError(t, err)
+
+	tok, err := ts.Token()
+	require.NoError(t, err)
+	assert.Equal(t, "cli-token", tok.AccessToken)
+	assert.Contains(t, out.String(), "ABCD-EFGH")
+	assert.Contains(t, out.String(), srv.URL+"/activate")
+
+	stored, err := store.LoadToken()
+	require.NoError(t, err)
+	assert.Equal(t, "cli-refresh", stored.RefreshToken)
+
+	// Second run must use the stored token without asking the user
+	out.Reset()
+	_, err = df.TokenSource(t.Context())
+	require.NoError(t, err)
+	assert.Empty(t, out.String())
+}
+
+func TestFileTokenStore(t *testing.T) {
+	store := FileTokenStore{Path: filepath.Join(t.TempDir(), "token.json")}
+
+	_, err := store.LoadToken()
+	require.ErrorIs(t, err, ErrTokenNotFound)
+
+	exp := time.Now().Add(time.Hour).Truncate(time.Second)
+	require.NoError(t, store.SaveToken(&oauth2.Token{AccessToken: "a", RefreshToken: "r", Expiry: exp}))
+
+	tok, err := store.LoadToken()
+	require.NoError(t, err)
+	assert.Equal(t, "a", tok.AccessToken)
+	assert.Equal(t, "r", tok.RefreshToken)
+	assert.True(t, exp.Equal(tok.Expiry))
+
+	// Permissions of an existing file are fixed on save
+	require.NoError(t, os.Chmod(store.Path, 0o644)) //#nosec:G302 // Test of too wide permissions
+	require.NoError(t, store.SaveToken(&oauth2.Token{AccessToken: "b"}))
+
+	info, err := os.Stat(store.Path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(tokenStoreFilePerms), info.Mode().Perm())
+}
@@ -0,0 +1,228 @@
+package appauth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/Luzifer/go_helpers/backoff"
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// defaultDiscoveryRetryTime limits the default Config.DiscoveryRetry
+	defaultDiscoveryRetryTime = 30 * time.Second
+
+	// discoveryTimeout limits the discovery shared by parallel requests
+	// as it is not bound to any of their contexts
+	discoveryTimeout = 30 * time.Second
+)
+
+// discovery holds the configuration discovered from the provider of
+// the IssuerURL. It is replaced as a whole by the re-discovery.
+type discovery struct {
+	provider *oidc.Provider
+	verifier *oidc.IDTokenVerifier // We will verify JWTs; access tokens are JWTs in KC by default.
+	// idTokenVerifier checks the audience to be the client and is
+	// used for ID tokens and back-channel logout tokens
+	idTokenVerifier *oidc.IDTokenVerifier
+
+	endpoint oauth2.Endpoint
+	meta     providerMetadata
+}
+
+// ErrProviderUnavailable is returned by Ready and the flows requiring
+// the provider while its discovery did not succeed yet
+var ErrProviderUnavailable = errors.New("identity provider not discovered")
+
+// accessTokenVerifier creates the verifier for JWT access tokens
+func accessTokenVerifier(provider *oidc.Provider, cfg Config) *oidc.IDTokenVerifier {
+	return provider.Verifier(&oidc.Config{
+		// We're using a library expecting ID-tokens to validate access
+		// tokens which have different audience (ID audience is the client
+		// access audience is the issuing server)
+		SkipClientIDCheck: true,
+		// The validity period is checked by verifyByJWT which respects
+		// the configured ClockSkew
+		SkipExpiryCheck: cfg.TokenVerification == TokenVerificationJWT,
+	})
+}
+
+// defaultDiscoveryRetry retries the discovery with the exponential
+// backoff of the backoff helper for up to defaultDiscoveryRetryTime
+func defaultDiscoveryRetry(_ context.Context, discover func() error) error {
+	return backoff.NewBackoff().WithMaxTotalTime(defaultDiscoveryRetryTime).Retry(discover) //nolint:wrapcheck // Wrapped by discoverWithRetry
+}
+
+// discoverProvider fetches the discovery document of the IssuerURL
+func discoverProvider(ctx context.Context, cfg Config) (*discovery, error) {
+	provider, err := oidc.NewProvider(ctx, cfg.IssuerURL)
+	if err != nil {
+		return nil, fmt.Errorf("creating OIDC provider: %w", err)
+	}
+
+	d := &discovery{
+		provider:        provider,
+		verifier:        accessTokenVerifier(provider, cfg),
+		idTokenVerifier: provider.Verifier(&oidc.Config{ClientID: cfg.ClientID}),
+		endpoint:        provider.Endpoint(),
+	}
+
+	if err = provider.Claims(&d.meta); err != nil {
+		return nil, fmt.Errorf("parsing provider metadata: %w", err)
+	}
+
+	if cfg.TokenVerification == TokenVerificationIntrospection && cfg.IntrospectionURL == "" && d.meta.IntrospectionEndpoint == "" {
+		return nil, errors.New("provider does not announce introspection_endpoint and no IntrospectionURL is set")
+	}
+
+	return d, nil
+}
+
+// Ready reports whether the provider has been discovered and is meant
+// to be used as readiness check of the service. If the discovery did
+// not succeed yet (see Config.LazyDiscovery) it is attempted, waiting
+// for it until the given context is done.
+func (a *Auth) Ready(ctx context.Context) error {
+	_, err := a.discovered(ctx)
+	return err
+}
+
+// discover fetches the discovery document of the IssuerURL and replaces
+// the current configuration with it
+func (a *Auth) discover(ctx context.Context) (*discovery, error) {
+	d, err := discoverProvider(ctx, a.cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	a.discoveryLock.Lock()
+	defer a.discoveryLock.Unlock()
+
+	a.discovery = d
+	return d, nil
+}
+
+// discoverWithRetry runs the initial discovery through the configured
+// DiscoveryRetry
+func (a *Auth) discoverWithRetry(ctx context.Context) error {
+	attempt := func() error {
+		if err := ctx.Err(); err != nil {
+			return backoff.NewErrCannotRetry(fmt.Errorf("discovering provider: %w", err))
+		}
+
+		if _, err := a.discover(ctx); err != nil {
+			if ctx.Err() != nil {
+				return backoff.NewErrCannotRetry(err)
+			}
+			return err
+		}
+
+		return nil
+	}
+
+	retry := a.cfg.DiscoveryRetry
+	if retry == nil {
+		if a.cfg.LazyDiscovery {
+			// Requests retry the discovery on demand, no need to block New
+			return attempt()
+		}
+		retry = defaultDiscoveryRetry
+	}
+
+	if err := retry(ctx, attempt); err != nil {
+		return fmt.Errorf("retrying discovery: %w", err)
+	}
+
+	return nil
+}
+
+// discovered returns the current provider configuration, discovering
+// it if no discovery succeeded before
+func (a *Auth) discovered(ctx context.Context) (*discovery, error) {
+	a.discoveryLock.RLock()
+	d := a.discovery
+	a.discoveryLock.RUnlock()
+
+	if d != nil {
+		return d, nil
+	}
+
+	// Parallel requests share the discovery which must therefore not
+	// be aborted by the cancellation of the request starting it
+	res := a.discoveryGroup.DoChan("", func() (any, error) {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), discoveryTimeout)
+		defer cancel()
+
+		return a.discover(ctx)
+	})
+
+	select {
+	case <-ctx.Done():
+		return nil, fmt.Errorf("%w: %w", ErrProviderUnavailable, ctx.Err())
+	case r := <-res:
+		if r.Err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrProviderUnavailable, r.Err)
+		}
+		return r.Val.(*discovery), nil
+	}
+}
+
+// oauth2Config returns the OAuth2 client configuration using the
+// endpoints of the current provider configuration
+func (a *Auth) oauth2Config(ctx context.Context) (oauth2.Config, error) {
+	d, err := a.discovered(ctx)
+	if err != nil {
+		return oauth2.Config{}, err
+	}
+
+	cfg := a.oauth2
+	cfg.Endpoint = d.endpoint
+
+	return cfg, nil
+}
+
+// rediscover refreshes the discovery of the IssuerURL and all known
+// tenants, each limited by the discoveryTimeout to not let a hanging
+// provider stop the re-discovery of the others
+func (a *Auth) rediscover(ctx context.Context) {
+	attemptCtx, cancel := context.WithTimeout(ctx, discoveryTimeout)
+	_, err := a.discover(attemptCtx)
+	cancel()
+	if err != nil {
+		a.log().Warn("re-discovering provider", slog.String("issuer", a.cfg.IssuerURL), slog.Any("error", err))
+	}
+
+	for _, t := range a.knownTenants() {
+		attemptCtx, cancel := context.WithTimeout(ctx, discoveryTimeout)
+		nt, err := newTenant(attemptCtx, t.issuer(), a.cfg)
+		cancel()
+		if err != nil {
+			a.log().Warn("re-discovering provider", slog.String("issuer", t.issuerURL), slog.Any("error", err))
+			continue
+		}
+
+		a.replaceTenant(nt)
+	}
+}
+
+// rediscoverPeriodically refreshes the discovery of the IssuerURL and
+// all known tenants until the context is cancelled. Failed discoveries
+// keep the previous configuration.
+func (a *Auth) rediscoverPeriodically(ctx context.Context) {
+	ticker := time.NewTicker(a.cfg.RediscoveryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		a.rediscover(ctx)
+	}
+}
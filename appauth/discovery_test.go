@@ -0,0 +1,218 @@
+package appauth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Luzifer/go_helpers/backoff"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newDiscoveryServer serves a discovery document while available is
+// set, the end_session_endpoint contains the current revision
+func newDiscoveryServer(t *testing.T, available *atomic.Bool, revision *atomic.Int32) *httptest.Server {
+	t.Helper()
+
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		if !available.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"issuer":                 srv.URL,
+			"authorization_endpoint": srv.URL + "/auth",
+			"token_endpoint":         srv.URL + "/token",
+			"jwks_uri":               srv.URL + "/certs",
+			"end_session_endpoint":   srv.URL + "/logout/" + string(rune('a'+revision.Load())),
+		})
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+func TestDiscoveryRetry(t *testing.T) {
+	var (
+		available atomic.Bool
+		revision  atomic.Int32
+	)
+	srv := newDiscoveryServer(t, &available, &revision)
+
+	attempts := 0
+	a, err := New(Config{
+		IssuerURL:        srv.URL,
+		ClientID:         "client",
+		ClientSecret:     "secret",
+		LoginRedirectURL: "https://app.example.com/callback",
+		DiscoveryRetry: func(_ context.Context, discover func() error) error {
+			var err error
+			for range 3 {
+				attempts++
+				if err = discover(); err == nil {
+					return nil
+				}
+				available.Store(true)
+			}
+			return err
+		},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 2, attempts)
+	assert.NoError(t, a.Ready(t.Context()))
+}
+
+func TestDiscoveryRetryCancel(t *testing.T) {
+	var (
+		available atomic.Bool
+		revision  atomic.Int32
+	)
+	srv := newDiscoveryServer(t, &available, &revision)
+
+	// The backoff without limits is stopped by the context
+	ctx, cancel := context.WithTimeout(t.Context(), 300*time.Millisecond)
+	defer cancel()
+
+	_, err := NewWithContext(ctx, Config{
+		IssuerURL:        srv.URL,
+		ClientID:         "client",
+		ClientSecret:     "secret",
+		LoginRedirectURL: "https://app.example.com/callback",
+		DiscoveryRetry: func(_ context.Context, discover func() error) error {
+			return backoff.NewBackoff().Retry(discover) //nolint:wrapcheck // Test helper
+		},
+	})
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestLazyDiscovery(t *testing.T) {
+	var (
+		available atomic.Bool
+		revision  atomic.Int32
+	)
+	srv := newDiscoveryServer(t, &available, &revision)
+
+	cfg := Config{
+		IssuerURL:        srv.URL,
+		ClientID:         "client",
+		ClientSecret:     "secret",
+		LoginRedirectURL: "https://app.example.com/callback",
+		ErrorRenderer:    BearerErrorRenderer(""),
+	}
+
+	// Without LazyDiscovery New retries until the context is done
+	ctx, cancel := context.WithTimeout(t.Context(), 300*time.Millisecond)
+	defer cancel()
+	_, err := NewWithContext(ctx, cfg)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	cfg.LazyDiscovery = true
+	a, err := New(cfg)
+	require.NoError(t, err)
+	require.ErrorIs(t, a.Ready(t.Context()), ErrProviderUnavailable)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Session abc")
+	rec := httptest.NewRecorder()
+	a.RequireAuth(http.NotFoundHandler(), Opts{}).ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+
+	rec = httptest.NewRecorder()
+	a.ServeLogin(rec, httptest.NewRequest(http.MethodGet, "/login", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+
+	available.Store(true)
+	require.NoError(t, a.Ready(t.Context()))
+
+	rec = httptest.NewRecorder()
+	a.ServeLogin(rec, httptest.NewRequest(http.MethodGet, "/login", nil))
+	assert.Equal(t, http.StatusFound, rec.Code)
+}
+
+func TestRediscovery(t *testing.T) {
+	var (
+		available atomic.Bool
+		revision  atomic.Int32
+	)
+	available.Store(true)
+	srv := newDiscoveryServer(t, &available, &revision)
+
+	a, err := New(Config{
+		IssuerURL:             srv.URL,
+		ClientID:              "client",
+		ClientSecret:          "secret",
+		LoginRedirectURL:      "https://app.example.com/callback",
+		PostLogoutRedirectURL: "https://app.example.com/",
+		RediscoveryInterval:   10 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	t.Cleanup(a.Close)
+
+	assert.Contains(t, a.endSessionURL(t.Context(), ""), srv.URL+"/logout/a")
+
+	// A failing re-discovery keeps the previous configuration
+	available.Store(false)
+	time.Sleep(50 * time.Millisecond)
+	assert.Contains(t, a.endSessionURL(t.Context(), ""), srv.URL+"/logout/a")
+
+	revision.Store(1)
+	available.Store(true)
+	assert.Eventually(t, func() bool {
+		d, err := a.discovered(t.Context())
+		return err == nil && d.meta.EndSessionEndpoint == srv.URL+"/logout/b"
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestDiscoverySharedCancel(t *testing.T) {
+	var (
+		srv      *httptest.Server
+		requests atomic.Int32
+		started  = make(chan struct{})
+		release  = make(chan struct{})
+	)
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		if requests.Add(1) == 1 {
+			close(started)
+		}
+		<-release
+
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"issuer":                 srv.URL,
+			"authorization_endpoint": srv.URL + "/auth",
+			"token_endpoint":         srv.URL + "/token",
+			"jwks_uri":               srv.URL + "/certs",
+		})
+	}))
+	t.Cleanup(srv.Close)
+
+	a := &Auth{cfg: Config{IssuerURL: srv.URL}}
+
+	// The request starting the discovery gives up while it is running
+	ctx, cancel := context.WithCancel(t.Context())
+	first := make(chan error, 1)
+	go func() {
+		_, err := a.discovered(ctx)
+		first <- err
+	}()
+	<-started
+
+	second := make(chan error, 1)
+	go func() {
+		_, err := a.discovered(t.Context())
+		second <- err
+	}()
+
+	cancel()
+	require.ErrorIs(t, <-first, context.Canceled)
+
+	close(release)
+	require.NoError(t, <-second)
+	assert.Equal(t, int32(1), requests.Load())
+}
@@ -0,0 +1,224 @@
+package appauth
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+
+	"github.com/Luzifer/go_helpers/appauth/pkg/cache"
+)
+
+const (
+	defaultDPoPProofMaxAge = time.Minute
+	dpopHeader             = "DPoP"
+	dpopProofType          = "dpop+jwt"
+)
+
+// dpopProofClaims holds the claims of a DPoP proof as specified in
+// section 4.2 of RFC 9449
+type dpopProofClaims struct {
+	ID              string `json:"jti"`
+	Method          string `json:"htm"`
+	URL             string `json:"htu"`
+	IssuedAt        int64  `json:"iat"`
+	AccessTokenHash string `json:"ath"`
+}
+
+var (
+	// dpopSigningAlgs lists the asymmetric algorithms accepted for DPoP
+	// proofs, symmetric algorithms are not allowed by RFC 9449
+	dpopSigningAlgs = []jose.SignatureAlgorithm{
+		jose.ES256, jose.ES384, jose.ES512,
+		jose.PS256, jose.PS384, jose.PS512,
+		jose.RS256, jose.RS384, jose.RS512,
+		jose.EdDSA,
+	}
+
+	errDPoPProof = errors.New("invalid DPoP proof")
+)
+
+// confirmationKey returns the JWK thumbprint the token is bound to
+// through the `cnf.jkt` claim or an empty string for bearer tokens
+func confirmationKey(claims map[string]any) string {
+	cnf, _ := claims["cnf"].(map[string]any)
+	return str(cnf["jkt"])
+}
+
+// validDPoPKey checks the given value to be a JWK SHA-256 thumbprint
+func validDPoPKey(jkt string) bool {
+	thumb, err := base64.RawURLEncoding.DecodeString(jkt)
+	return err == nil && len(thumb) == sha256.Size
+}
+
+// checkDPoPBinding requires tokens bound to a DPoP key to come with a
+// proof of it and accepts proofs only for bound tokens. Sessions are
+// bound themselves (see exchangeTokenThroughCache).
+func (a *Auth) checkDPoPBinding(r *http.Request, tokenType string, u *User, dpopKey string) (AuthError, bool) {
+	if tokenType != "Session" && u.DPoPKey != dpopKey {
+		a.log().Info("DPoP binding mismatch", slog.String("path", r.URL.Path), slog.String("type", tokenType))
+		return a.rejectToken(r, "", errDPoPBinding()), false
+	}
+
+	return AuthError{}, true
+}
+
+// checkDPoPProofClaims validates the claims of the proof against the
+// request and the credential presented with it
+func (a *Auth) checkDPoPProofClaims(r *http.Request, claims dpopProofClaims, credential string) error {
+	var (
+		ath    = sha256.Sum256([]byte(credential))
+		iat    = time.Unix(claims.IssuedAt, 0)
+		maxAge = a.dpopProofMaxAge()
+		now    = time.Now()
+	)
+
+	switch {
+	case claims.ID == "":
+		return errors.New("missing jti")
+
+	case claims.Method != r.Method:
+		return fmt.Errorf("htm %q does not match request", claims.Method)
+
+	case !a.matchesRequestURL(claims.URL, r):
+		return fmt.Errorf("htu %q does not match request", claims.URL)
+
+	case iat.After(now.Add(a.cfg.ClockSkew)), iat.Add(maxAge + a.cfg.ClockSkew).Before(now):
+		return errors.New("iat out of accepted range")
+
+	case claims.AccessTokenHash != base64.RawURLEncoding.EncodeToString(ath[:]):
+		return errors.New("ath does not match credential")
+	}
+
+	return nil
+}
+
+func (a *Auth) dpopProofMaxAge() time.Duration {
+	if a.cfg.DPoPProofMaxAge > 0 {
+		return a.cfg.DPoPProofMaxAge
+	}
+
+	return defaultDPoPProofMaxAge
+}
+
+// matchesRequestURL compares the `htu` of a proof with the URL of the
+// request ignoring query and fragment. Requests are usually received
+// through a TLS terminating proxy, so https is expected unless
+// InsecureCookie is set.
+func (a *Auth) matchesRequestURL(htu string, r *http.Request) bool {
+	u, err := url.Parse(htu)
+	if err != nil {
+		return false
+	}
+
+	scheme := "https"
+	if r.TLS == nil && a.cfg.InsecureCookie {
+		scheme = "http"
+	}
+
+	return strings.EqualFold(u.Scheme, scheme) &&
+		strings.EqualFold(u.Host, r.Host) &&
+		u.EscapedPath() == r.URL.EscapedPath()
+}
+
+// requestDPoPKey verifies the DPoP proof of requests using the DPoP
+// authorization scheme and returns the thumbprint of its key. Other
+// schemes have no key.
+func (a *Auth) requestDPoPKey(r *http.Request, tokenType, token string) (string, AuthError, bool) {
+	if tokenType != dpopHeader {
+		return "", AuthError{}, true
+	}
+
+	dpopKey, err := a.verifyDPoPProof(r, token)
+	if err != nil {
+		a.log().Info("invalid DPoP proof", slog.String("path", r.URL.Path), slog.Any("error", err))
+		return "", a.rejectToken(r, "", errInvalidDPoPProof()), false
+	}
+
+	return dpopKey, AuthError{}, true
+}
+
+// verifyDPoPBinding requires a valid DPoP proof of the given key for
+// the credential
+func (a *Auth) verifyDPoPBinding(r *http.Request, credential, key string) error {
+	jkt, err := a.verifyDPoPProof(r, credential)
+	if err != nil {
+		return err
+	}
+
+	if jkt != key {
+		return fmt.Errorf("%w: proof key does not match bound key", errDPoPProof)
+	}
+
+	return nil
+}
+
+// verifyDPoPProof validates the DPoP proof of the request (RFC 9449
+// section 4.3) for the given credential and returns the thumbprint of
+// the key it was signed with
+func (a *Auth) verifyDPoPProof(r *http.Request, credential string) (string, error) {
+	proofs := r.Header.Values(dpopHeader)
+	if len(proofs) != 1 {
+		return "", fmt.Errorf("%w: expected exactly one proof", errDPoPProof)
+	}
+
+	jws, err := jose.ParseSigned(proofs[0], dpopSigningAlgs)
+	if err != nil {
+		return "", fmt.Errorf("%w: parsing proof: %w", errDPoPProof, err)
+	}
+
+	if len(jws.Signatures) != 1 {
+		return "", fmt.Errorf("%w: expected exactly one signature", errDPoPProof)
+	}
+
+	header := jws.Signatures[0].Protected
+	if typ, _ := header.ExtraHeaders[jose.HeaderType].(string); typ != dpopProofType {
+		return "", fmt.Errorf("%w: unexpected typ %q", errDPoPProof, typ)
+	}
+
+	jwk := header.JSONWebKey
+	if jwk == nil || !jwk.IsPublic() || !jwk.Valid() {
+		return "", fmt.Errorf("%w: missing or invalid jwk", errDPoPProof)
+	}
+
+	payload, err := jws.Verify(jwk)
+	if err != nil {
+		return "", fmt.Errorf("%w: verifying signature: %w", errDPoPProof, err)
+	}
+
+	var claims dpopProofClaims
+	if err = json.Unmarshal(payload, &claims); err != nil {
+		return "", fmt.Errorf("%w: parsing claims: %w", errDPoPProof, err)
+	}
+
+	if err = a.checkDPoPProofClaims(r, claims, credential); err != nil {
+		return "", fmt.Errorf("%w: %w", errDPoPProof, err)
+	}
+
+	thumb, err := jwk.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return "", fmt.Errorf("%w: calculating thumbprint: %w", errDPoPProof, err)
+	}
+	jkt := base64.RawURLEncoding.EncodeToString(thumb)
+
+	// The jti only needs to be unique per key, keep it until the proof
+	// would be rejected by its iat anyway
+	expires := time.Unix(claims.IssuedAt, 0).Add(a.dpopProofMaxAge() + a.cfg.ClockSkew)
+	if err = a.dpopReplayCache.UseOnce(r.Context(), jkt+":"+claims.ID, expires); err != nil {
+		if errors.Is(err, cache.ErrReplayed) {
+			return "", fmt.Errorf("%w: proof was used before", errDPoPProof)
+		}
+		return "", fmt.Errorf("checking proof replay: %w", err)
+	}
+
+	return jkt, nil
+}
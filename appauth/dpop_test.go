@@ -0,0 +1,185 @@
+package appauth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Luzifer/go_helpers/appauth/pkg/cache"
+	"github.com/Luzifer/go_helpers/appauth/pkg/cache/mem"
+)
+
+// dpopTestKey creates a client key and returns its thumbprint and a
+// function to create DPoP proofs with it
+func dpopTestKey(t *testing.T) (string, func(method, htu, credential string, mod func(map[string]any)) string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	thumb, err := (&jose.JSONWebKey{Key: key.Public()}).Thumbprint(crypto.SHA256)
+	require.NoError(t, err)
+
+	signer, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: jose.ES256, Key: key},
+		(&jose.SignerOptions{EmbedJWK: true}).WithType(dpopProofType),
+	)
+	require.NoError(t, err)
+
+	return base64.RawURLEncoding.EncodeToString(thumb), func(method, htu, credential string, mod func(map[string]any)) string {
+		jti, err := randB64(stateLength)
+		require.NoError(t, err)
+
+		ath := sha256.Sum256([]byte(credential))
+		claims := map[string]any{
+			"jti": jti,
+			"htm": method,
+			"htu": htu,
+			"iat": time.Now().Unix(),
+			"ath": base64.RawURLEncoding.EncodeToString(ath[:]),
+		}
+		if mod != nil {
+			mod(claims)
+		}
+
+		payload, err := json.Marshal(claims)
+		require.NoError(t, err)
+
+		jws, err := signer.Sign(payload)
+		require.NoError(t, err)
+
+		raw, err := jws.CompactSerialize()
+		require.NoError(t, err)
+		return raw
+	}
+}
+
+func TestRequireAuthDPoP(t *testing.T) {
+	jkt, proof := dpopTestKey(t)
+	_, otherProof := dpopTestKey(t)
+
+	vc := mem.NewVerificationCache(10)
+	for raw, u := range map[string]User{
+		"bound":   {Sub: "abc", DPoPKey: jkt},
+		"unbound": {Sub: "abc"},
+	} {
+		data, err := json.Marshal(u)
+		require.NoError(t, err)
+		require.NoError(t, vc.SetVerification(t.Context(), tokenHash(raw), data, time.Now().Add(time.Hour)))
+	}
+
+	a := &Auth{
+		cfg: Config{
+			ErrorRenderer:     BearerErrorRenderer(""),
+			TokenVerification: TokenVerificationIntrospection,
+		},
+		discovery:         &discovery{},
+		dpopReplayCache:   mem.NewReplayCache(),
+		verificationCache: vc,
+	}
+
+	h := a.RequireAuth(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusNoContent) }), Opts{})
+
+	serve := func(auth, dpop string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api", nil)
+		req.Header.Set("Authorization", auth)
+		if dpop != "" {
+			req.Header.Set("DPoP", dpop)
+		}
+
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	const htu = "https://example.com/api"
+
+	valid := proof(http.MethodGet, htu, "bound", nil)
+	assert.Equal(t, http.StatusNoContent, serve("DPoP bound", valid).Code)
+
+	rec := serve("DPoP bound", valid)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code, "replayed proof")
+	assert.Contains(t, rec.Header().Get("WWW-Authenticate"), `DPoP error="invalid_dpop_proof"`)
+
+	for name, tc := range map[string]struct {
+		auth, dpop string
+	}{
+		"bound as bearer": {"Bearer bound", ""},
+		"unbound as dpop": {"DPoP unbound", proof(http.MethodGet, htu, "unbound", nil)},
+		"other key":       {"DPoP bound", otherProof(http.MethodGet, htu, "bound", nil)},
+		"missing proof":   {"DPoP bound", ""},
+		"method":          {"DPoP bound", proof(http.MethodPost, htu, "bound", nil)},
+		"url":             {"DPoP bound", proof(http.MethodGet, "https://example.com/other", "bound", nil)},
+		"access token":    {"DPoP bound", proof(http.MethodGet, htu, "unbound", nil)},
+		"expired":         {"DPoP bound", proof(http.MethodGet, htu, "bound", func(c map[string]any) { c["iat"] = time.Now().Add(-time.Hour).Unix() })},
+		"missing jti":     {"DPoP bound", proof(http.MethodGet, htu, "bound", func(c map[string]any) { delete(c, "jti") })},
+		"malformed proof": {"DPoP bound", "not-a-jwt"},
+	} {
+		rec := serve(tc.auth, tc.dpop)
+		assert.Equal(t, http.StatusUnauthorized, rec.Code, name)
+	}
+
+	assert.Equal(t, http.StatusNoContent, serve("Bearer unbound", "").Code)
+}
+
+func TestDPoPBoundSession(t *testing.T) {
+	jkt, proof := dpopTestKey(t)
+
+	tc := newTestCache()
+	tc.sess[sessionKey("sess")] = cache.Session{
+		AccessToken: "valid",
+		Expires:     time.Now().Add(time.Hour),
+		DPoPKey:     jkt,
+	}
+
+	a := &Auth{
+		cfg:             Config{InsecureCookie: true},
+		sessionStore:    cache.FromCache(tc),
+		dpopReplayCache: mem.NewReplayCache(),
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api", nil)
+	_, err := a.exchangeTokenThroughCache(req, "sess")
+	require.ErrorIs(t, err, errDPoPProof)
+
+	req.Header.Set("DPoP", proof(http.MethodGet, "http://example.com/api", "sess", nil))
+	tok, err := a.exchangeTokenThroughCache(req, "sess")
+	require.NoError(t, err)
+	assert.Equal(t, "valid", tok)
+}
+
+func TestPopupStartDPoPKey(t *testing.T) {
+	a := &Auth{
+		cfg:       Config{PopupRedirectURL: "https://app.example.com/popup"},
+		discovery: &discovery{},
+	}
+
+	rec := httptest.NewRecorder()
+	a.ServePopup(rec, httptest.NewRequest(http.MethodGet, "/popup?dpop_jkt=invalid", nil))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	jkt, _ := dpopTestKey(t)
+	rec = httptest.NewRecorder()
+	a.ServePopup(rec, httptest.NewRequest(http.MethodGet, "/popup?dpop_jkt="+jkt, nil))
+	require.Equal(t, http.StatusFound, rec.Code)
+
+	var bound string
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == "oidc_dpop_jkt" {
+			bound = c.Value
+		}
+	}
+	assert.Equal(t, jkt, bound)
+}
@@ -0,0 +1,56 @@
+package appauth
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/oauth2"
+)
+
+const maxEndpointResponseSize = 1 << 20 // 1 MiB
+
+// httpClient returns the client injected through the oauth2.HTTPClient
+// context key (same mechanism the oauth2 library uses) or the default
+// HTTP client
+func httpClient(ctx context.Context) *http.Client {
+	if c, ok := ctx.Value(oauth2.HTTPClient).(*http.Client); ok && c != nil {
+		return c
+	}
+
+	return http.DefaultClient
+}
+
+// postClientForm sends the given form to a provider endpoint using
+// HTTP basic client authentication (RFC 6749 Section 2.3.1) and
+// returns the response body for successful requests
+func postClientForm(ctx context.Context, endpoint, clientID, clientSecret string, form url.Values) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("creating request: %w", err)
+	}
+
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(clientID), url.QueryEscape(clientSecret))
+
+	resp, err := httpClient(ctx).Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("executing request: %w", err)
+	}
+	defer resp.Body.Close() //nolint:errcheck // Body is fully read below
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxEndpointResponseSize))
+	if err != nil {
+		return nil, fmt.Errorf("reading response body: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	return body, nil
+}
@@ -0,0 +1,214 @@
+package appauth
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RFC 6750 Section 3.1 error codes
+const (
+	ErrorCodeInvalidRequest    = "invalid_request"
+	ErrorCodeInvalidToken      = "invalid_token"
+	ErrorCodeInsufficientScope = "insufficient_scope"
+
+	// ErrorCodeInsufficientUserAuthentication is defined by RFC 9470
+	// Section 3
+	ErrorCodeInsufficientUserAuthentication = "insufficient_user_authentication"
+
+	// ErrorCodeInvalidDPoPProof is defined by RFC 9449 Section 7.1
+	ErrorCodeInvalidDPoPProof = "invalid_dpop_proof"
+)
+
+type (
+	// AuthError describes why a request was rejected by RequireAuth
+	AuthError struct {
+		// Status is the HTTP status code suggested by RFC 6750
+		Status int
+		// Code is the RFC 6750 error code, empty when the request did not
+		// contain any credentials
+		Code string
+		// Description is a human readable description which is safe to
+		// be sent to the client
+		Description string
+		// Scope contains the scopes required for the request
+		Scope []string
+		// ACRValues and MaxAge describe the authentication required for
+		// the request (RFC 9470 Section 3)
+		ACRValues []string
+		MaxAge    time.Duration
+		// Scheme is the authentication scheme of the challenge, empty
+		// for Bearer
+		Scheme string
+
+		// staleSession marks errors caused by an unknown or expired
+		// session whose cookies can be cleared
+		staleSession bool
+	}
+
+	// ErrorRenderer writes the response for a request rejected by
+	// RequireAuth
+	ErrorRenderer func(w http.ResponseWriter, r *http.Request, err AuthError)
+)
+
+// BearerErrorRenderer creates an ErrorRenderer responding with RFC 6750
+// compliant status codes and WWW-Authenticate header without body
+func BearerErrorRenderer(realm string) ErrorRenderer {
+	return func(w http.ResponseWriter, _ *http.Request, err AuthError) {
+		w.Header().Set("WWW-Authenticate", err.WWWAuthenticate(realm))
+		w.WriteHeader(err.Status)
+	}
+}
+
+// ProblemErrorRenderer creates an ErrorRenderer responding with RFC 6750
+// compliant status codes and WWW-Authenticate header and a JSON problem
+// details body (RFC 9457)
+func ProblemErrorRenderer(realm string) ErrorRenderer {
+	return func(w http.ResponseWriter, _ *http.Request, err AuthError) {
+		w.Header().Set("WWW-Authenticate", err.WWWAuthenticate(realm))
+		w.Header().Set("Content-Type", "application/problem+json")
+		w.WriteHeader(err.Status)
+
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"type":   "about:blank",
+			"title":  http.StatusText(err.Status),
+			"status": err.Status,
+			"detail": err.Description,
+		})
+	}
+}
+
+// StealthErrorRenderer hides the existence of the protected route by
+// answering every rejection with 404 Not Found. This is the default.
+func StealthErrorRenderer(w http.ResponseWriter, r *http.Request, _ AuthError) {
+	http.NotFound(w, r)
+}
+
+// Error implements the error interface
+func (e AuthError) Error() string {
+	if e.Code == "" {
+		return e.Description
+	}
+
+	return strings.Join([]string{e.Code, e.Description}, ": ")
+}
+
+// WWWAuthenticate renders the RFC 6750 WWW-Authenticate header value
+// for the error
+func (e AuthError) WWWAuthenticate(realm string) string {
+	var params []string
+
+	if realm != "" {
+		params = append(params, authParam("realm", realm))
+	}
+
+	if e.Code != "" {
+		params = append(params, authParam("error", e.Code))
+
+		if e.Description != "" {
+			params = append(params, authParam("error_description", e.Description))
+		}
+	}
+
+	if len(e.Scope) > 0 {
+		params = append(params, authParam("scope", strings.Join(e.Scope, " ")))
+	}
+
+	if len(e.ACRValues) > 0 {
+		params = append(params, authParam("acr_values", strings.Join(e.ACRValues, " ")))
+	}
+
+	if e.MaxAge > 0 {
+		params = append(params, authParam("max_age", strconv.Itoa(int(e.MaxAge/time.Second))))
+	}
+
+	scheme := e.Scheme
+	if scheme == "" {
+		scheme = "Bearer"
+	}
+
+	if scheme == dpopHeader {
+		algs := make([]string, 0, len(dpopSigningAlgs))
+		for _, alg := range dpopSigningAlgs {
+			algs = append(algs, string(alg))
+		}
+		params = append(params, authParam("algs", strings.Join(algs, " ")))
+	}
+
+	if len(params) == 0 {
+		return scheme
+	}
+
+	return scheme + " " + strings.Join(params, ", ")
+}
+
+func (a *Auth) renderError(w http.ResponseWriter, r *http.Request, err AuthError) {
+	if a.cfg.ErrorRenderer == nil {
+		StealthErrorRenderer(w, r, err)
+		return
+	}
+
+	a.cfg.ErrorRenderer(w, r, err)
+}
+
+func authParam(key, value string) string {
+	value = strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value)
+	return key + `="` + value + `"`
+}
+
+func errCSRF() AuthError {
+	return AuthError{Status: http.StatusForbidden, Code: ErrorCodeInvalidRequest, Description: "missing or invalid CSRF token"}
+}
+
+func errDPoPBinding() AuthError {
+	return AuthError{Status: http.StatusUnauthorized, Code: ErrorCodeInvalidToken, Description: "access token not bound to the DPoP proof key", Scheme: dpopHeader}
+}
+
+func errForbidden(opts Opts) AuthError {
+	return AuthError{
+		Status:      http.StatusForbidden,
+		Code:        ErrorCodeInsufficientScope,
+		Description: "insufficient permissions",
+		Scope:       opts.AllScopes,
+	}
+}
+
+func errInsufficientUserAuthentication(opts Opts) AuthError {
+	return AuthError{
+		Status:      http.StatusUnauthorized,
+		Code:        ErrorCodeInsufficientUserAuthentication,
+		Description: "a different authentication level is required",
+		ACRValues:   opts.AnyACR,
+		MaxAge:      opts.MaxAuthAge,
+	}
+}
+
+func errInvalidDPoPProof() AuthError {
+	return AuthError{Status: http.StatusUnauthorized, Code: ErrorCodeInvalidDPoPProof, Description: "DPoP proof invalid", Scheme: dpopHeader}
+}
+
+func errInvalidRequest(desc string) AuthError {
+	return AuthError{Status: http.StatusBadRequest, Code: ErrorCodeInvalidRequest, Description: desc}
+}
+
+func errInvalidToken(desc string) AuthError {
+	return AuthError{Status: http.StatusUnauthorized, Code: ErrorCodeInvalidToken, Description: desc}
+}
+
+func errMissingCredentials() AuthError {
+	return AuthError{Status: http.StatusUnauthorized, Description: "missing credentials"}
+}
+
+func errSessionUnavailable() AuthError {
+	return AuthError{Status: http.StatusServiceUnavailable, Description: "session temporarily unavailable"}
+}
+
+func errStaleSession() AuthError {
+	return AuthError{Status: http.StatusUnauthorized, Code: ErrorCodeInvalidToken, Description: "session expired or invalid", staleSession: true}
+}
+
+func errProviderUnavailable() AuthError {
+	return AuthError{Status: http.StatusServiceUnavailable, Description: "identity provider unavailable"}
+}
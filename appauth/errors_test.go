@@ -0,0 +1,63 @@
+package appauth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Luzifer/go_helpers/appauth/pkg/cache/mem"
+)
+
+func TestRequireAuthErrorRenderers(t *testing.T) {
+	vc := mem.NewVerificationCache(10)
+	data, err := json.Marshal(&User{Sub: "abc", Scopes: []string{"openid"}})
+	require.NoError(t, err)
+	require.NoError(t, vc.SetVerification(t.Context(), tokenHash("valid"), data, time.Now().Add(time.Hour)))
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusTeapot) })
+
+	for name, tc := range map[string]struct {
+		renderer   ErrorRenderer
+		authHeader string
+		opts       Opts
+		wantStatus int
+		wantHeader string
+	}{
+		"stealth missing":   {nil, "", Opts{}, http.StatusNotFound, ""},
+		"stealth forbidden": {nil, "Bearer valid", Opts{AllScopes: []string{"api"}}, http.StatusNotFound, ""},
+		"bearer missing":    {BearerErrorRenderer("api"), "", Opts{}, http.StatusUnauthorized, `Bearer realm="api"`},
+		"bearer scheme":     {BearerErrorRenderer(""), "Basic foo", Opts{}, http.StatusBadRequest, `Bearer error="invalid_request", error_description="unsupported authorization scheme"`},
+		"bearer forbidden":  {BearerErrorRenderer(""), "Bearer valid", Opts{AllScopes: []string{"api"}}, http.StatusForbidden, `Bearer error="insufficient_scope", error_description="insufficient permissions", scope="api"`},
+		"bearer success":    {BearerErrorRenderer(""), "Bearer valid", Opts{AllScopes: []string{"openid"}}, http.StatusTeapot, ""},
+	} {
+		t.Run(name, func(t *testing.T) {
+			a := &Auth{cfg: Config{ErrorRenderer: tc.renderer}, discovery: &discovery{}, verificationCache: vc}
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tc.authHeader != "" {
+				req.Header.Set("Authorization", tc.authHeader)
+			}
+			rec := httptest.NewRecorder()
+
+			a.RequireAuth(next, tc.opts).ServeHTTP(rec, req)
+
+			assert.Equal(t, tc.wantStatus, rec.Code)
+			assert.Equal(t, tc.wantHeader, rec.Header().Get("WWW-Authenticate"))
+		})
+	}
+}
+
+func TestProblemErrorRenderer(t *testing.T) {
+	rec := httptest.NewRecorder()
+	ProblemErrorRenderer("api")(rec, httptest.NewRequest(http.MethodGet, "/", nil), errInvalidToken("access token invalid or expired"))
+
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Equal(t, "application/problem+json", rec.Header().Get("Content-Type"))
+	assert.Equal(t, `Bearer realm="api", error="invalid_token", error_description="access token invalid or expired"`, rec.Header().Get("WWW-Authenticate"))
+	assert.JSONEq(t, `{"type":"about:blank","title":"Unauthorized","status":401,"detail":"access token invalid or expired"}`, rec.Body.String())
+}
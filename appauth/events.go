@@ -0,0 +1,96 @@
+package appauth
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// Event types emitted through Config.OnEvent
+const (
+	EventLoginStarted        EventType = "login_started"
+	EventLoginSucceeded      EventType = "login_succeeded"
+	EventLoginFailed         EventType = "login_failed"
+	EventSessionCreated      EventType = "session_created"
+	EventSessionRefreshed    EventType = "session_refreshed"
+	EventSessionExpired      EventType = "session_expired"
+	EventSessionRevoked      EventType = "session_revoked"
+	EventSessionRotated      EventType = "session_rotated"
+	EventTokenRejected       EventType = "token_rejected"
+	EventAuthorizationDenied EventType = "authorization_denied"
+)
+
+type (
+	// Event describes something happening within the authentication
+	// lifecycle and is meant to build an audit trail. Fields not known
+	// for the event are left empty.
+	Event struct {
+		Type EventType
+		Time time.Time
+
+		// Subject is the `sub` of the user involved
+		Subject string
+		// SessionHash identifies the session without exposing the
+		// session ID (see SessionInfo.Handle)
+		SessionHash string
+		// PreviousSessionHash identifies the replaced session of an
+		// EventSessionRotated
+		PreviousSessionHash string
+		// ClientIP and Path are taken from the request causing the
+		// event, they are empty for events not caused by a request
+		ClientIP string
+		Path     string
+		// Reason explains failures, denials and revocations
+		Reason string
+	}
+
+	// EventType names the kind of an Event
+	EventType string
+)
+
+// SlogEventHandler creates a handler for Config.OnEvent writing the
+// events to the given logger: failures, rejections and denials are
+// logged as warnings, everything else as info.
+func SlogEventHandler(logger *slog.Logger) func(Event) {
+	return func(ev Event) {
+		level := slog.LevelInfo
+		switch ev.Type {
+		case EventLoginFailed, EventTokenRejected, EventAuthorizationDenied:
+			level = slog.LevelWarn
+		}
+
+		attrs := []slog.Attr{slog.String("event", string(ev.Type))}
+		for _, a := range []slog.Attr{
+			slog.String("sub", ev.Subject),
+			slog.String("session_hash", ev.SessionHash),
+			slog.String("previous_session_hash", ev.PreviousSessionHash),
+			slog.String("client_ip", ev.ClientIP),
+			slog.String("path", ev.Path),
+			slog.String("reason", ev.Reason),
+		} {
+			if a.Value.String() != "" {
+				attrs = append(attrs, a)
+			}
+		}
+
+		logger.LogAttrs(context.Background(), level, "appauth: "+string(ev.Type), attrs...)
+	}
+}
+
+// emit passes the event to the OnEvent hook enriching it with the
+// time and the client IP and path of the request (nil if the event
+// was not caused by a request)
+func (a *Auth) emit(r *http.Request, ev Event) {
+	if a.cfg.OnEvent == nil {
+		return
+	}
+
+	ev.Time = time.Now()
+	if r != nil {
+		ev.ClientIP = a.clientIP(r)
+		ev.Path = r.URL.Path
+	}
+
+	a.cfg.OnEvent(ev)
+}
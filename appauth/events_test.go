@@ -0,0 +1,100 @@
+package appauth
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Luzifer/go_helpers/appauth/pkg/cache"
+	"github.com/Luzifer/go_helpers/appauth/pkg/cache/mem"
+)
+
+func TestEventsAuthorization(t *testing.T) {
+	vc := mem.NewVerificationCache(10)
+	data, err := json.Marshal(&User{Sub: "abc", Roles: []string{"user"}})
+	require.NoError(t, err)
+	require.NoError(t, vc.SetVerification(t.Context(), tokenHash("valid"), data, time.Now().Add(time.Hour)))
+
+	var events []Event
+	a := &Auth{
+		cfg: Config{
+			ErrorRenderer:     BearerErrorRenderer(""),
+			OnEvent:           func(ev Event) { events = append(events, ev) },
+			TokenVerification: TokenVerificationIntrospection,
+		},
+		discovery:         &discovery{},
+		sessionStore:      cache.FromCache(newTestCache()),
+		verificationCache: vc,
+	}
+
+	h := a.RequireAuth(http.NotFoundHandler(), Opts{AnyRole: []string{"admin"}})
+
+	for _, auth := range []string{"Bearer valid", "Session unknown"} {
+		req := httptest.NewRequest(http.MethodGet, "/admin", nil)
+		req.Header.Set("Authorization", auth)
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	require.Len(t, events, 2)
+
+	assert.Equal(t, EventAuthorizationDenied, events[0].Type)
+	assert.Equal(t, "abc", events[0].Subject)
+	assert.Equal(t, "/admin", events[0].Path)
+	assert.Equal(t, "192.0.2.1", events[0].ClientIP)
+	assert.NotEmpty(t, events[0].Reason)
+	assert.False(t, events[0].Time.IsZero())
+
+	assert.Equal(t, EventTokenRejected, events[1].Type)
+	assert.Equal(t, sessionKey("unknown"), events[1].SessionHash)
+	assert.Equal(t, "session expired or invalid", events[1].Reason)
+}
+
+func TestEventsSessionExpired(t *testing.T) {
+	tc := newTestCache()
+	tc.sess[sessionKey("a")] = cache.Session{
+		Subject:   "abc",
+		CreatedAt: time.Now().Add(-2 * time.Hour),
+		LastSeen:  time.Now().Add(-2 * time.Hour),
+	}
+
+	var events []Event
+	a := &Auth{
+		cfg: Config{
+			OnEvent:            func(ev Event) { events = append(events, ev) },
+			SessionIdleTimeout: time.Minute,
+		},
+		sessionStore: cache.FromCache(tc),
+	}
+
+	_, err := a.exchangeTokenThroughCache(httptest.NewRequest(http.MethodGet, "/", nil), "a")
+	require.Error(t, err)
+
+	require.Len(t, events, 1)
+	assert.Equal(t, EventSessionExpired, events[0].Type)
+	assert.Equal(t, "abc", events[0].Subject)
+	assert.Equal(t, sessionKey("a"), events[0].SessionHash)
+	assert.Equal(t, "idle timeout", events[0].Reason)
+}
+
+func TestSlogEventHandler(t *testing.T) {
+	buf := new(bytes.Buffer)
+	h := SlogEventHandler(slog.New(slog.NewJSONHandler(buf, nil)))
+
+	h(Event{Type: EventTokenRejected, Path: "/api", Reason: "expired"})
+
+	var entry map[string]any
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &entry))
+
+	assert.Equal(t, "WARN", entry["level"])
+	assert.Equal(t, "token_rejected", entry["event"])
+	assert.Equal(t, "/api", entry["path"])
+	assert.Equal(t, "expired", entry["reason"])
+	assert.NotContains(t, entry, "sub")
+}
@@ -0,0 +1,163 @@
+package appauth
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"golang.org/x/oauth2"
+
+	"github.com/Luzifer/go_helpers/appauth/pkg/cache"
+)
+
+// createSession stores the tokens as a new session of the given user
+// bound to the given DPoP key (empty for unbound sessions) and returns
+// the new session ID
+func (a *Auth) createSession(r *http.Request, tok *oauth2.Token, u *User, dpopKey string) (string, error) {
+	sessID, err := randB64(sessionIDLength)
+	if err != nil {
+		return "", fmt.Errorf("generating session ID: %w", err)
+	}
+
+	idt, _ := tok.Extra("id_token").(string)
+
+	now := time.Now()
+	sess := cache.Session{
+		AccessToken:  tok.AccessToken,
+		IDToken:      idt,
+		RefreshToken: tok.RefreshToken,
+		Expires:      tok.Expiry,
+		CreatedAt:    now,
+		LastSeen:     now,
+		Subject:      u.Sub,
+		UserAgent:    r.UserAgent(),
+		IP:           a.clientIP(r),
+		DPoPKey:      dpopKey,
+	}
+
+	if idt != "" {
+		sess.SID = a.providerSessionID(r.Context(), idt)
+	}
+
+	if err = a.sessionStore.StoreSession(r.Context(), sessionKey(sessID), sess, a.sessionTTL(sess)); err != nil {
+		return "", fmt.Errorf("writing session: %w", err)
+	}
+
+	a.emit(r, Event{Type: EventSessionCreated, Subject: sess.Subject, SessionHash: sessionKey(sessID)})
+
+	return sessID, nil
+}
+
+// exchangeCallback validates the callback of the authorization code
+// flow against the flow cookies and exchanges the code for a token.
+// On failure the code of the message to display to the user is
+// returned.
+func (a *Auth) exchangeCallback(r *http.Request, redirectURL, flow string) (*oauth2.Token, MessageCode) {
+	if e := r.URL.Query().Get("error"); e != "" {
+		a.log().Info("provider returned error", slog.String("flow", flow), slog.String("error", e), slog.String("description", r.URL.Query().Get("error_description")))
+		a.emit(r, Event{Type: EventLoginFailed, Reason: "provider error: " + e})
+		return nil, MessageLoginFailed
+	}
+
+	code := r.URL.Query().Get("code")
+	stateQ := r.URL.Query().Get("state")
+	if code == "" || stateQ == "" {
+		a.log().Info("callback without code or state", slog.String("flow", flow))
+		a.emit(r, Event{Type: EventLoginFailed, Reason: "missing code or state"})
+		return nil, MessageBadCallback
+	}
+
+	stateC, err := readCookie(r, "oidc_state")
+	if err != nil || stateC != stateQ {
+		a.log().Warn("callback state mismatch", slog.String("flow", flow), slog.Any("error", err))
+		a.emit(r, Event{Type: EventLoginFailed, Reason: "state mismatch"})
+		return nil, MessageBadState
+	}
+
+	verifier, err := readCookie(r, "oidc_verifier")
+	if err != nil || verifier == "" {
+		a.log().Warn("callback without verifier", slog.String("flow", flow), slog.Any("error", err))
+		a.emit(r, Event{Type: EventLoginFailed, Reason: "missing verifier"})
+		return nil, MessageBadVerifier
+	}
+
+	cfg, err := a.oauth2Config(r.Context())
+	if err != nil {
+		a.log().Error("exchanging code", slog.String("flow", flow), slog.Any("error", err))
+		a.emit(r, Event{Type: EventLoginFailed, Reason: "provider unavailable"})
+		return nil, MessageLoginFailed
+	}
+	cfg.RedirectURL = redirectURL
+
+	tok, err := cfg.Exchange(r.Context(), code,
+		oauth2.SetAuthURLParam("code_verifier", verifier),
+	)
+	if err != nil {
+		a.log().Error("exchanging code", slog.String("flow", flow), slog.Any("error", err))
+		a.emit(r, Event{Type: EventLoginFailed, Reason: "code exchange failed"})
+		return nil, MessageExchangeFailed
+	}
+
+	return tok, ""
+}
+
+// redirectToProvider starts the authorization code flow with PKCE by
+// storing state and verifier in flow cookies and redirecting the user
+// to the provider which will return to the given redirectURL
+func (a *Auth) redirectToProvider(w http.ResponseWriter, r *http.Request, redirectURL string) {
+	cfg, err := a.oauth2Config(r.Context())
+	if err != nil {
+		a.log().Error("starting login", slog.Any("error", err))
+		http.Error(w, "Identity provider unavailable.", http.StatusServiceUnavailable)
+		return
+	}
+	cfg.RedirectURL = redirectURL
+
+	authParams, err := stepUpParams(r.URL.Query())
+	if err != nil {
+		http.Error(w, "Invalid step-up parameters.", http.StatusBadRequest)
+		return
+	}
+
+	state, err := randB64(stateLength)
+	if err != nil {
+		http.Error(w, "state", http.StatusInternalServerError)
+		return
+	}
+
+	verifier, err := randB64(verifierLength)
+	if err != nil {
+		http.Error(w, "pkce", http.StatusInternalServerError)
+		return
+	}
+
+	// Store values for callback validation
+	setCookie(w, "oidc_state", state, flowCookieTimeout, a.cfg.InsecureCookie)
+	setCookie(w, "oidc_verifier", verifier, flowCookieTimeout, a.cfg.InsecureCookie)
+
+	challenge := pkceChallengeS256(verifier)
+
+	authURL := cfg.AuthCodeURL(
+		state,
+		append(authParams,
+			oauth2.SetAuthURLParam("code_challenge", challenge),
+			oauth2.SetAuthURLParam("code_challenge_method", "S256"),
+		)...,
+	)
+
+	a.emit(r, Event{Type: EventLoginStarted})
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// verifyCallbackToken verifies the access token received through the
+// login flows of the IssuerURL
+func (a *Auth) verifyCallbackToken(ctx context.Context, raw string) (*User, error) {
+	t, err := a.primaryTenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return a.verifyAccessToken(ctx, t, raw)
+}
@@ -2,13 +2,13 @@ package appauth
 
 import (
 	"context"
+	"errors"
+	"log/slog"
 	"net/http"
 	"slices"
 	"strings"
 	"time"
 
-	"golang.org/x/oauth2"
-
 	"github.com/Luzifer/go_helpers/appauth/pkg/cache"
 )
 
@@ -19,53 +19,79 @@ const (
 	sessionIDLength   = 64
 )
 
-// RequireAuth shields the given next Handler with the given auth
-// requirements. The identified user is available through UserFromContext
-// from the request context in the next Handler
-func (a *Auth) RequireAuth(next http.Handler, opts Opts) http.Handler {
+// OptionalAuth identifies the user from the given credentials if
+// present and makes it available through UserFromContext in the next
+// Handler. Requests without credentials are passed through anonymously,
+// as are requests with a stale session cookie (unknown or expired
+// session) whose cookies are cleared and session cookie requests whose
+// access token is rejected. Malformed or invalid credentials given in
+// the Authorization header, cookie requests failing the CSRF check and
+// temporary failures are rejected through the configured ErrorRenderer.
+func (a *Auth) OptionalAuth(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		tokenType, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
-		if !ok {
-			a.logf("auth: missing authorization path=%s", r.URL.Path)
-			http.NotFound(w, r)
+		_, hasCookie := a.sessionFromCookie(r)
+		if r.Header.Get("Authorization") == "" && !hasCookie {
+			next.ServeHTTP(w, r)
 			return
 		}
 
-		switch tokenType {
-		case "Bearer":
-			// That's expected from API-clients with direct OIDC-Provider
-			// access such as server-to-server or desktop applications, we
-			// use the token directly in this case.
-
-		case "Session":
-			// We got a session identifier and need to fetch a token from
-			// the cache and possibly renew it
-
-			var err error
-			if token, err = a.exchangeTokenThroughCache(r.Context(), token); err != nil {
-				a.logf("auth: exchanging session for token path=%s type=%s", r.URL.Path, tokenType)
-				http.NotFound(w, r)
-				return
-			}
+		u, authErr, ok := a.authenticate(r)
+		switch {
+		case ok:
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userKey, u)))
+
+		case r.Header.Get("Authorization") == "" && authErr.staleSession:
+			a.clearSessionCookies(w)
+			next.ServeHTTP(w, r)
+
+		case r.Header.Get("Authorization") == "" && authErr.Code == ErrorCodeInvalidToken:
+			// The token might be rejected by a temporary provider failure,
+			// so keep the session
+			next.ServeHTTP(w, r)
 
 		default:
-			a.logf("auth: invalid token type path=%s type=%s", r.URL.Path, tokenType)
-			http.NotFound(w, r)
+			a.renderError(w, r, authErr)
+		}
+	})
+}
+
+// RequireAuth shields the given next Handler with the given auth
+// requirements. The identified user is available through UserFromContext
+// from the request context in the next Handler. Rejected requests are
+// answered through the configured ErrorRenderer.
+func (a *Auth) RequireAuth(next http.Handler, opts Opts) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, authErr, ok := a.authenticate(r)
+		if !ok {
+			a.renderError(w, r, authErr)
 			return
 		}
 
-		u, err := a.verifyAccessToken(r.Context(), token)
-		if err != nil {
-			a.logf("auth: invalid token path=%s err=%v", r.URL.Path, err)
-			http.NotFound(w, r)
+		if !a.sufficientAuthentication(u, opts) {
+			a.log().Info("insufficient user authentication",
+				slog.String("path", r.URL.Path),
+				slog.String("sub", u.Sub),
+				slog.String("have_acr", u.ACR),
+				slog.Any("have_amr", u.AMR),
+				slog.Time("auth_time", u.AuthTime),
+			)
+			authErr = errInsufficientUserAuthentication(opts)
+			a.emit(r, Event{Type: EventAuthorizationDenied, Subject: u.Sub, Reason: authErr.Description})
+			a.renderError(w, r, authErr)
 			return
 		}
 
-		if !a.authorize(u, opts) {
-			a.logf("auth: forbidden path=%s sub=%s need_roles=%v need_groups=%v have_roles=%v have_groups=%v",
-				r.URL.Path, u.Sub, opts.AnyRole, opts.AnyGroup, u.Roles, u.Groups,
+		if !a.authorize(u, r, opts) {
+			a.log().Info("forbidden",
+				slog.String("path", r.URL.Path),
+				slog.String("sub", u.Sub),
+				slog.Any("have_roles", u.Roles),
+				slog.Any("have_groups", u.Groups),
+				slog.Any("have_scopes", u.Scopes),
 			)
-			http.NotFound(w, r)
+			authErr = errForbidden(opts)
+			a.emit(r, Event{Type: EventAuthorizationDenied, Subject: u.Sub, Reason: authErr.Description})
+			a.renderError(w, r, authErr)
 			return
 		}
 
@@ -78,6 +104,10 @@ func (a *Auth) RequireAuth(next http.Handler, opts Opts) http.Handler {
 // redirect to the OIDC server and on return to the same URL exchanges
 // the code for the token, then passes the token back to the requesting
 // Javascript through the window.opener.PostMessage function.
+//
+// The `acr_values`, `max_age` and `prompt` query parameters are passed
+// to the provider to request a step-up login after RequireAuth
+// reported insufficient_user_authentication.
 func (a *Auth) ServePopup(w http.ResponseWriter, r *http.Request) {
 	// Are we currently in the callback-state of the flow?
 	if r.URL.Query().Get("code") != "" || r.URL.Query().Get("error") != "" {
@@ -101,115 +131,175 @@ func (a *Auth) allowedOrigin(origin string) (string, bool) {
 	return "", false
 }
 
-func (a *Auth) popupStart(w http.ResponseWriter, r *http.Request) {
-	state, err := randB64(stateLength)
-	if err != nil {
-		http.Error(w, "state", http.StatusInternalServerError)
-		return
-	}
+// authenticate identifies the user from the Authorization header or
+// the session cookie of the redirect flow
+func (a *Auth) authenticate(r *http.Request) (*User, AuthError, bool) {
+	authHeader := r.Header.Get("Authorization")
+	tokenType, token, ok := strings.Cut(authHeader, " ")
+
+	switch {
+	case ok:
+		// Credentials given through Authorization header
+
+	case authHeader != "":
+		a.log().Info("malformed authorization", slog.String("path", r.URL.Path))
+		return nil, a.rejectToken(r, "", errInvalidRequest("malformed authorization header")), false
+
+	default:
+		sessID, hasCookie := a.sessionFromCookie(r)
+		if !hasCookie {
+			a.log().Debug("missing authorization", slog.String("path", r.URL.Path))
+			return nil, errMissingCredentials(), false
+		}
 
-	verifier, err := randB64(verifierLength)
-	if err != nil {
-		http.Error(w, "pkce", http.StatusInternalServerError)
-		return
+		// Cookies are sent by the browser automatically so we need to
+		// protect state-changing requests against CSRF
+		if !isSafeMethod(r.Method) && !validCSRF(r, r.Header.Get(csrfHeaderName)) {
+			a.log().Warn("invalid CSRF token", slog.String("path", r.URL.Path), slog.String("method", r.Method))
+			return nil, a.rejectToken(r, sessionKey(sessID), errCSRF()), false
+		}
+
+		tokenType, token = "Session", sessID
 	}
 
-	origin := r.URL.Query().Get("origin") // the opener's origin
+	var (
+		t       *tenant
+		dpopKey string
+		err     error
+	)
 
-	// Store values for callback validation
-	setCookie(w, "oidc_state", state, flowCookieTimeout, a.cfg.InsecureCookie)
-	setCookie(w, "oidc_verifier", verifier, flowCookieTimeout, a.cfg.InsecureCookie)
-	if origin != "" {
-		setCookie(w, "oidc_origin", origin, flowCookieTimeout, a.cfg.InsecureCookie)
-	}
+	switch tokenType {
+	case "Bearer", dpopHeader:
+		// That's expected from API-clients with direct OIDC-Provider
+		// access such as server-to-server or desktop applications, we
+		// use the token directly in this case. DPoP bound tokens come
+		// with a proof of possession of the key they are bound to.
 
-	challenge := pkceChallengeS256(verifier)
+		var authErr AuthError
+		if dpopKey, authErr, ok = a.requestDPoPKey(r, tokenType, token); !ok {
+			return nil, authErr, false
+		}
 
-	authURL := a.oauth2.AuthCodeURL(
-		state,
-		oauth2.SetAuthURLParam("code_challenge", challenge),
-		oauth2.SetAuthURLParam("code_challenge_method", "S256"),
-	)
+		if t, err = a.requestTenant(r, token); err != nil {
+			a.log().Warn("selecting issuer", slog.String("path", r.URL.Path), slog.Any("error", err))
+			if errors.Is(err, ErrProviderUnavailable) {
+				return nil, errProviderUnavailable(), false
+			}
+			return nil, a.rejectToken(r, "", errInvalidToken("issuer not accepted")), false
+		}
 
-	http.Redirect(w, r, authURL, http.StatusFound)
-}
+	case "Session":
+		// We got a session identifier and need to fetch a token from
+		// the cache and possibly renew it. Sessions are created through
+		// the login flows of the IssuerURL.
 
-func (a *Auth) popupCallback(w http.ResponseWriter, r *http.Request) {
-	if e := r.URL.Query().Get("error"); e != "" {
-		a.logf("popup: oidc error=%s desc=%s", e, r.URL.Query().Get("error_description"))
-		writeClosePage(w, "Login failed.")
-		return
-	}
+		if t, err = a.primaryTenant(r.Context()); err != nil {
+			a.log().Warn("selecting issuer", slog.String("path", r.URL.Path), slog.Any("error", err))
+			return nil, errProviderUnavailable(), false
+		}
 
-	code := r.URL.Query().Get("code")
-	stateQ := r.URL.Query().Get("state")
-	if code == "" || stateQ == "" {
-		a.logf("popup: missing code/state")
-		writeClosePage(w, "Bad callback.")
-		return
+		sessID := token
+
+		if token, err = a.exchangeTokenThroughCache(r, sessID); err != nil {
+			a.log().Info("exchanging session for token", slog.String("path", r.URL.Path), slog.String("type", tokenType), slog.Any("error", err))
+			return nil, a.rejectSession(r, sessID, err), false
+		}
+
+	default:
+		a.log().Info("invalid token type", slog.String("path", r.URL.Path), slog.String("type", tokenType))
+		return nil, a.rejectToken(r, "", errInvalidRequest("unsupported authorization scheme")), false
 	}
 
-	stateC, err := readCookie(r, "oidc_state")
-	if err != nil || stateC != stateQ {
-		a.logf("popup: bad state err=%v", err)
-		writeClosePage(w, "Bad state.")
-		return
+	u, err := a.verifyAccessToken(r.Context(), t, token)
+	if err != nil {
+		a.log().Info("invalid token", slog.String("path", r.URL.Path), slog.Any("error", err))
+		return nil, a.rejectToken(r, "", errInvalidToken("access token invalid or expired")), false
 	}
 
-	verifier, err := readCookie(r, "oidc_verifier")
-	if err != nil || verifier == "" {
-		a.logf("popup: missing verifier err=%v", err)
-		writeClosePage(w, "Bad verifier.")
-		return
+	if authErr, ok := a.checkDPoPBinding(r, tokenType, u, dpopKey); !ok {
+		return nil, authErr, false
 	}
 
-	tok, err := a.oauth2.Exchange(r.Context(), code,
-		oauth2.SetAuthURLParam("code_verifier", verifier),
-	)
-	if err != nil {
-		a.logf("popup: exchange failed err=%v", err)
-		writeClosePage(w, "Exchange failed.")
+	return u, AuthError{}, true
+}
+
+func (a *Auth) popupCallback(w http.ResponseWriter, r *http.Request) {
+	tok, failCode := a.exchangeCallback(r, a.cfg.PopupRedirectURL, "popup")
+	if failCode != "" {
+		a.writeClosePage(w, failCode)
 		return
 	}
 
-	access, _ := tok.Extra("access_token").(string)
-	idt, _ := tok.Extra("id_token").(string)
-	refresh, _ := tok.Extra("refresh_token").(string)
-
 	origin, _ := readCookie(r, "oidc_origin")
 	targetOrigin, ok := a.allowedOrigin(origin)
 	if !ok {
-		a.logf("popup: origin not allowed origin=%q", origin)
+		a.log().Warn("popup origin not allowed", slog.String("origin", origin))
+		a.emit(r, Event{Type: EventLoginFailed, Reason: "origin not allowed"})
 		// Refuse to deliver token
-		writeClosePage(w, "Origin not allowed.")
+		a.writeClosePage(w, MessageOriginNotAllowed)
 		return
 	}
 
-	sessID, err := randB64(sessionIDLength)
+	user, err := a.verifyCallbackToken(r.Context(), tok.AccessToken)
 	if err != nil {
-		a.logf("popup: creating session err=%v", err)
-		writeClosePage(w, "Creating session failed.")
+		a.log().Warn("verifying access token", slog.String("flow", "popup"), slog.Any("error", err))
+		a.emit(r, Event{Type: EventLoginFailed, Reason: "access token invalid"})
+		a.writeClosePage(w, MessageInvalidToken)
 		return
 	}
 
-	now := time.Now()
-	if err = a.sessionCache.SetSession(sessID, cache.Session{
-		AccessToken:  access,
-		IDToken:      idt,
-		RefreshToken: refresh,
-		Expires:      tok.Expiry,
-		CreatedAt:    now,
-		LastSeen:     now,
-	}); err != nil {
-		a.logf("popup: writing session err=%v", err)
-		writeClosePage(w, "Writing session failed.")
+	dpopKey, _ := readCookie(r, "oidc_dpop_jkt")
+
+	sessID, err := a.createSession(r, tok, user, dpopKey)
+	if err != nil {
+		a.log().Error("creating session", slog.String("flow", "popup"), slog.Any("error", err))
+		a.emit(r, Event{Type: EventLoginFailed, Subject: user.Sub, Reason: "creating session failed"})
+		a.writeClosePage(w, MessageSessionFailed)
 		return
 	}
 
-	var user *User
-	if user, err = a.verifyAccessToken(r.Context(), access); err != nil {
-		a.logf("popup: retrieving user for postMessage failed err=%v", err)
+	a.emit(r, Event{Type: EventLoginSucceeded, Subject: user.Sub, SessionHash: sessionKey(sessID)})
+	a.writePostMessageAndClose(w, r, targetOrigin, sessID, user)
+}
+
+func (a *Auth) popupStart(w http.ResponseWriter, r *http.Request) {
+	if origin := r.URL.Query().Get("origin"); origin != "" { // the opener's origin
+		setCookie(w, "oidc_origin", origin, flowCookieTimeout, a.cfg.InsecureCookie)
+	}
+
+	// The opener may bind the session to its DPoP key, the cookie is
+	// always set to not carry over the key of a previous flow
+	dpopKey := r.URL.Query().Get("dpop_jkt")
+	if dpopKey != "" && !validDPoPKey(dpopKey) {
+		http.Error(w, "Invalid dpop_jkt.", http.StatusBadRequest)
+		return
 	}
+	setCookie(w, "oidc_dpop_jkt", dpopKey, flowCookieTimeout, a.cfg.InsecureCookie)
+
+	a.redirectToProvider(w, r, a.cfg.PopupRedirectURL)
+}
+
+// rejectSession maps the error of using the session to the AuthError
+// and emits the EventTokenRejected unless the failure is temporary
+func (a *Auth) rejectSession(r *http.Request, sessID string, err error) AuthError {
+	switch {
+	case errors.Is(err, errDPoPProof):
+		return a.rejectToken(r, sessionKey(sessID), errInvalidDPoPProof())
+
+	case errors.Is(err, cache.ErrSessionNotFound), errors.Is(err, errSessionExpired):
+		return a.rejectToken(r, sessionKey(sessID), errStaleSession())
+
+	case errors.Is(err, ErrProviderUnavailable):
+		return errProviderUnavailable()
+
+	default:
+		return errSessionUnavailable()
+	}
+}
 
-	writePostMessageAndClose(w, targetOrigin, sessID, user)
+// rejectToken emits the EventTokenRejected for the given error and
+// returns it for convenience
+func (a *Auth) rejectToken(r *http.Request, sessionHash string, authErr AuthError) AuthError {
+	a.emit(r, Event{Type: EventTokenRejected, SessionHash: sessionHash, Reason: authErr.Description})
+	return authErr
 }
@@ -0,0 +1,135 @@
+package appauth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Luzifer/go_helpers/appauth/pkg/cache"
+	"github.com/Luzifer/go_helpers/appauth/pkg/cache/mem"
+)
+
+func TestOptionalAuth(t *testing.T) {
+	introspectionSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]any{"active": false})
+	}))
+	t.Cleanup(introspectionSrv.Close)
+
+	vc := mem.NewVerificationCache(10)
+	data, err := json.Marshal(&User{Sub: "abc"})
+	require.NoError(t, err)
+	require.NoError(t, vc.SetVerification(t.Context(), tokenHash("valid"), data, time.Now().Add(time.Hour)))
+
+	a := &Auth{
+		cfg: Config{
+			ErrorRenderer:     BearerErrorRenderer(""),
+			IntrospectionURL:  introspectionSrv.URL,
+			TokenVerification: TokenVerificationIntrospection,
+		},
+		discovery:         &discovery{},
+		sessionStore:      cache.FromCache(newTestCache()),
+		verificationCache: vc,
+	}
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if u, ok := UserFromContext(r.Context()); ok {
+			_, _ = w.Write([]byte(u.Sub))
+			return
+		}
+		_, _ = w.Write([]byte("anonymous"))
+	})
+
+	for name, tc := range map[string]struct {
+		authHeader    string
+		sessionCookie string
+		wantStatus    int
+		wantBody      string
+	}{
+		"anonymous":       {"", "", http.StatusOK, "anonymous"},
+		"valid bearer":    {"Bearer valid", "", http.StatusOK, "abc"},
+		"invalid bearer":  {"Bearer forged", "", http.StatusUnauthorized, ""},
+		"malformed":       {"garbage", "", http.StatusBadRequest, ""},
+		"unknown scheme":  {"Basic foo", "", http.StatusBadRequest, ""},
+		"stale cookie":    {"", "unknown", http.StatusOK, "anonymous"},
+		"unknown session": {"Session unknown", "", http.StatusUnauthorized, ""},
+	} {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tc.authHeader != "" {
+				req.Header.Set("Authorization", tc.authHeader)
+			}
+			if tc.sessionCookie != "" {
+				req.AddCookie(&http.Cookie{Name: defaultSessionCookieName, Value: tc.sessionCookie})
+			}
+
+			rec := httptest.NewRecorder()
+			a.OptionalAuth(next).ServeHTTP(rec, req)
+
+			assert.Equal(t, tc.wantStatus, rec.Code)
+			assert.Equal(t, tc.wantBody, rec.Body.String())
+		})
+	}
+}
+
+type failingSessionStore struct{}
+
+func (failingSessionStore) DeleteSession(context.Context, string) error { return errors.New("down") }
+
+func (failingSessionStore) LoadSession(context.Context, string) (cache.Session, error) {
+	return cache.Session{}, errors.New("down")
+}
+
+func (failingSessionStore) StoreSession(context.Context, string, cache.Session, time.Duration) error {
+	return errors.New("down")
+}
+
+func TestOptionalAuthSessionCookie(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) { _, _ = w.Write([]byte("anonymous")) })
+
+	serve := func(store cache.SessionStore) *httptest.ResponseRecorder {
+		a := &Auth{
+			cfg:          Config{ErrorRenderer: BearerErrorRenderer("")},
+			discovery:    &discovery{},
+			sessionStore: store,
+		}
+
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.AddCookie(&http.Cookie{Name: defaultSessionCookieName, Value: "sess"})
+
+		rec := httptest.NewRecorder()
+		a.OptionalAuth(next).ServeHTTP(rec, req)
+		return rec
+	}
+
+	// Temporary store failures must not log out the user
+	rec := serve(failingSessionStore{})
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Empty(t, rec.Header().Values("Set-Cookie"))
+
+	tc := newTestCache()
+	tc.sess[sessionKey("sess")] = cache.Session{
+		AccessToken: "token",
+		Expires:     time.Now().Add(time.Hour),
+		CreatedAt:   time.Now().Add(-2 * time.Hour),
+	}
+	a := &Auth{
+		cfg:          Config{SessionAbsoluteTimeout: time.Hour},
+		discovery:    &discovery{},
+		sessionStore: cache.FromCache(tc),
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(&http.Cookie{Name: defaultSessionCookieName, Value: "sess"})
+	rec = httptest.NewRecorder()
+	a.OptionalAuth(next).ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "anonymous", rec.Body.String())
+	assert.NotEmpty(t, rec.Header().Values("Set-Cookie"), "cookies of expired session are cleared")
+}
@@ -1,27 +1,26 @@
 package appauth
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"slices"
 	"strings"
+	"time"
 )
 
-func extractRoles(claims map[string]any, clientID string) []string {
+// extractScopes reads the granted scopes from the `scope` claim
+// (space separated string, RFC 8693 / RFC 7662) or the `scp` claim
+// (string or array, used by Azure AD / Okta)
+func extractScopes(claims map[string]any) []string {
 	var out []string
 
-	// realm_access.roles
-	if ra, ok := claims["realm_access"].(map[string]any); ok {
-		out = append(out, extractStringSlice(ra["roles"])...)
-	}
-
-	// resource_access[clientID].roles as explicit `clientID/role`
-	if clientID != "" {
-		if res, ok := claims["resource_access"].(map[string]any); ok {
-			if c, ok := res[clientID].(map[string]any); ok {
-				for _, roleName := range extractStringSlice(c["roles"]) {
-					out = append(out, strings.Join([]string{clientID, roleName}, "/"))
-				}
-			}
+	for _, key := range []string{"scope", "scp"} {
+		switch v := claims[key].(type) {
+		case string:
+			out = append(out, strings.Fields(v)...)
+		default:
+			out = append(out, extractStringSlice(v)...)
 		}
 	}
 
@@ -48,11 +47,39 @@ func extractStringSlice(v any) []string {
 	}
 }
 
+// numericDate converts a JSON NumericDate claim into a time or
+// returns the zero time if the claim is not set
+func numericDate(v any) time.Time {
+	switch x := v.(type) {
+	case float64:
+		return time.Unix(int64(x), 0)
+	case int64:
+		return time.Unix(x, 0)
+	default:
+		return time.Time{}
+	}
+}
+
 func str(v any) string {
 	s, _ := v.(string)
 	return s
 }
 
+// sessionKey derives the key to store the session under in the cache
+// from the session ID. Hashing the ID prevents anyone with read access
+// to the cache from hijacking sessions by their stored ID. Sessions
+// stored under the plain ID by previous versions are migrated on first
+// use (see loadSession).
+func sessionKey(sessID string) string {
+	return tokenHash(sessID)
+}
+
+// tokenHash creates a non-reversible cache key for the given token
+func tokenHash(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
 func verifySubjectConsistency(tokenClaims, userInfoClaims map[string]any) error {
 	tokenSub := str(tokenClaims["sub"])
 	userInfoSub := str(userInfoClaims["sub"])
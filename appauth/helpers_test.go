@@ -7,44 +7,6 @@ import (
 	"github.com/stretchr/testify/require"
 )
 
-func TestExtractRoles(t *testing.T) {
-	claims := map[string]any{
-		"realm_access": map[string]any{
-			"roles": []any{"admin", "offline_access", "admin"},
-		},
-		"resource_access": map[string]any{
-			"myclient": map[string]any{
-				"roles": []any{"api-read", "api-write", "api-read"},
-			},
-			"other-client": map[string]any{
-				"roles": []any{"ignored"},
-			},
-		},
-	}
-
-	assert.Equal(t, []string{
-		"admin",
-		"myclient/api-read",
-		"myclient/api-write",
-		"offline_access",
-	}, extractRoles(claims, "myclient"))
-}
-
-func TestExtractRolesWithoutClientID(t *testing.T) {
-	claims := map[string]any{
-		"realm_access": map[string]any{
-			"roles": []any{"admin"},
-		},
-		"resource_access": map[string]any{
-			"myclient": map[string]any{
-				"roles": []any{"api-read"},
-			},
-		},
-	}
-
-	assert.Equal(t, []string{"admin"}, extractRoles(claims, ""))
-}
-
 func TestVerifySubjectConsistency(t *testing.T) {
 	err := verifySubjectConsistency(
 		map[string]any{"sub": "abc"},
@@ -81,3 +43,10 @@ func TestVerifySubjectConsistencyMismatch(t *testing.T) {
 	require.Error(t, err)
 	assert.Contains(t, err.Error(), "subject mismatch")
 }
+
+func TestExtractScopes(t *testing.T) {
+	assert.Equal(t, []string{"api:read", "openid"}, extractScopes(map[string]any{"scope": "openid api:read"}))
+	assert.Equal(t, []string{"api:read", "openid"}, extractScopes(map[string]any{"scp": []any{"openid", "api:read"}}))
+	assert.Equal(t, []string{"api:read"}, extractScopes(map[string]any{"scp": "api:read"}))
+	assert.Nil(t, extractScopes(make(map[string]any)))
+}
@@ -0,0 +1,47 @@
+package appauth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+)
+
+// verifyByIntrospection validates the token through the RFC 7662
+// introspection endpoint using the client credentials
+func (a *Auth) verifyByIntrospection(ctx context.Context, t *tenant, raw string) (*User, time.Time, error) {
+	body, err := postClientForm(ctx, t.introspectionEndpoint(), t.clientID, t.clientSecret, url.Values{
+		"token":           []string{raw},
+		"token_type_hint": []string{"access_token"},
+	})
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("introspecting token: %w", err)
+	}
+
+	var claims map[string]any
+	if err = json.Unmarshal(body, &claims); err != nil {
+		return nil, time.Time{}, fmt.Errorf("parsing introspection response: %w", err)
+	}
+
+	if active, _ := claims["active"].(bool); !active {
+		return nil, time.Time{}, errors.New("token is not active")
+	}
+
+	exp := numericDate(claims["exp"])
+	if !exp.IsZero() && !exp.After(time.Now()) {
+		return nil, time.Time{}, errors.New("token is expired")
+	}
+
+	u := t.userFromClaims(claims)
+	u.Scopes = extractScopes(claims)
+	u.DPoPKey = confirmationKey(claims)
+	a.detectServiceAccount(u, claims)
+
+	if u.Sub == "" {
+		return nil, time.Time{}, errors.New("introspection response has no subject")
+	}
+
+	return u, exp, nil
+}
@@ -0,0 +1,67 @@
+package appauth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Luzifer/go_helpers/appauth/pkg/cache/mem"
+)
+
+func TestVerifyByIntrospection(t *testing.T) {
+	var calls int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+
+		assert.NoError(t, r.ParseForm())
+		if r.PostForm.Get("token") != "opaque" {
+			_ = json.NewEncoder(w).Encode(map[string]any{"active": false})
+			return
+		}
+
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"active": true,
+			"sub":    "abc",
+			"email":  "jane.doe@example.com",
+			"scope":  "openid api:read",
+			"exp":    time.Now().Add(time.Hour).Unix(),
+			"groups": []string{"engineering"},
+		})
+	}))
+	t.Cleanup(srv.Close)
+
+	a := &Auth{
+		cfg: Config{
+			ClientID:          "client",
+			ClientSecret:      "secret",
+			IntrospectionURL:  srv.URL,
+			TokenVerification: TokenVerificationIntrospection,
+		},
+		discovery:         &discovery{},
+		verificationCache: mem.NewVerificationCache(10),
+	}
+
+	tn, err := a.primaryTenant(t.Context())
+	require.NoError(t, err)
+
+	u, err := a.verifyAccessToken(t.Context(), tn, "opaque")
+	require.NoError(t, err)
+	assert.Equal(t, "abc", u.Sub)
+	assert.Equal(t, "jane.doe@example.com", u.Email)
+	assert.Equal(t, []string{"api:read", "openid"}, u.Scopes)
+	assert.Equal(t, []string{"engineering"}, u.Groups)
+
+	// Second call must be served from cache
+	_, err = a.verifyAccessToken(t.Context(), tn, "opaque")
+	require.NoError(t, err)
+	assert.Equal(t, 1, calls)
+
+	_, err = a.verifyAccessToken(t.Context(), tn, "revoked")
+	require.Error(t, err)
+	assert.Equal(t, 2, calls)
+}
@@ -0,0 +1,96 @@
+package appauth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/go-jose/go-jose/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyByJWT(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: key}, nil)
+	require.NoError(t, err)
+
+	token := func(mod func(map[string]any)) string {
+		claims := map[string]any{
+			"iss":   testIssuer,
+			"aud":   []string{"account", "api"},
+			"exp":   time.Now().Add(time.Minute).Unix(),
+			"sub":   "alice",
+			"email": "alice@example.com",
+			"scope": "openid api:read",
+		}
+		if mod != nil {
+			mod(claims)
+		}
+
+		payload, err := json.Marshal(claims)
+		require.NoError(t, err)
+
+		jws, err := signer.Sign(payload)
+		require.NoError(t, err)
+
+		raw, err := jws.CompactSerialize()
+		require.NoError(t, err)
+		return raw
+	}
+
+	a := &Auth{cfg: Config{
+		TokenVerification: TokenVerificationJWT,
+		ClockSkew:         30 * time.Second,
+	}}
+	tn := &tenant{
+		issuerURL: testIssuer,
+		audiences: []string{"api"},
+		verifier: oidc.NewVerifier(testIssuer, &oidc.StaticKeySet{
+			PublicKeys: []crypto.PublicKey{key.Public()},
+		}, &oidc.Config{SkipClientIDCheck: true, SkipExpiryCheck: true, SupportedSigningAlgs: []string{oidc.ES256}}),
+	}
+
+	u, err := a.verifyAccessToken(t.Context(), tn, token(nil))
+	require.NoError(t, err)
+	assert.Equal(t, "alice", u.Sub)
+	assert.Equal(t, "alice@example.com", u.Email)
+	assert.Equal(t, []string{"api:read", "openid"}, u.Scopes)
+	assert.Equal(t, testIssuer, u.Issuer)
+
+	// Within the clock skew
+	_, err = a.verifyAccessToken(t.Context(), tn, token(func(c map[string]any) {
+		c["exp"] = time.Now().Add(-10 * time.Second).Unix()
+		c["nbf"] = time.Now().Add(10 * time.Second).Unix()
+	}))
+	require.NoError(t, err)
+
+	for name, mod := range map[string]func(map[string]any){
+		"expired":       func(c map[string]any) { c["exp"] = time.Now().Add(-time.Minute).Unix() },
+		"no expiry":     func(c map[string]any) { delete(c, "exp") },
+		"not yet valid": func(c map[string]any) { c["nbf"] = time.Now().Add(time.Minute).Unix() },
+		"audience":      func(c map[string]any) { c["aud"] = "account" },
+		"issuer":        func(c map[string]any) { c["iss"] = "https://evil.example.com" },
+	} {
+		_, err = a.verifyAccessToken(t.Context(), tn, token(mod))
+		assert.Error(t, err, name)
+	}
+
+	// Only the configured token types are accepted (the verification
+	// cache is not used here)
+	a.cfg.AccessTokenTypes = []string{"application/at+jwt"}
+	_, err = a.verifyAccessToken(t.Context(), tn, token(nil))
+	require.Error(t, err)
+
+	signer, err = jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: key}, (&jose.SignerOptions{}).WithType("at+JWT"))
+	require.NoError(t, err)
+	_, err = a.verifyAccessToken(t.Context(), tn, token(nil))
+	require.NoError(t, err)
+}
@@ -1,7 +1,52 @@
 package appauth
 
-func (a *Auth) logf(format string, v ...any) {
-	if a.cfg.Logger != nil {
-		a.cfg.Logger.Printf(format, v...)
+import (
+	"bytes"
+	"log/slog"
+)
+
+// printfWriter passes the lines written by a slog.TextHandler to a
+// Printf Logger
+type printfWriter struct {
+	l Logger
+}
+
+// newLogger creates the logger to write diagnostics to from the
+// configuration: the SlogLogger is used as is, the Printf Logger is
+// adapted and without any logger the diagnostics are discarded
+func newLogger(cfg Config) *slog.Logger {
+	switch {
+	case cfg.SlogLogger != nil:
+		return cfg.SlogLogger
+
+	case cfg.Logger != nil:
+		return slog.New(slog.NewTextHandler(printfWriter{cfg.Logger}, &slog.HandlerOptions{
+			Level: slog.LevelDebug,
+			ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+				// Printf loggers add their own timestamp
+				if len(groups) == 0 && a.Key == slog.TimeKey {
+					return slog.Attr{}
+				}
+				return a
+			},
+		}))
+
+	default:
+		return slog.New(slog.DiscardHandler)
 	}
 }
+
+func (p printfWriter) Write(b []byte) (int, error) {
+	p.l.Printf("%s", bytes.TrimSuffix(b, []byte("\n")))
+	return len(b), nil
+}
+
+// log returns the logger to write diagnostics to
+func (a *Auth) log() *slog.Logger {
+	if a.logger == nil {
+		// Auth was not created through New
+		return newLogger(a.cfg)
+	}
+
+	return a.logger
+}
@@ -0,0 +1,44 @@
+package appauth
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type printfRecorder []string
+
+func (p *printfRecorder) Printf(format string, v ...any) {
+	*p = append(*p, fmt.Sprintf(format, v...))
+}
+
+func TestLoggerPrintfAdapter(t *testing.T) {
+	rec := new(printfRecorder)
+	a := &Auth{cfg: Config{Logger: rec}}
+
+	a.log().Warn("invalid token", slog.String("path", "/api"), slog.Any("error", fmt.Errorf("expired")))
+
+	assert.Equal(t, []string{`level=WARN msg="invalid token" path=/api error=expired`}, []string(*rec))
+}
+
+func TestLoggerPrefersSlog(t *testing.T) {
+	rec := new(printfRecorder)
+	buf := new(bytes.Buffer)
+
+	a := &Auth{cfg: Config{
+		Logger:     rec,
+		SlogLogger: slog.New(slog.NewTextHandler(buf, nil)),
+	}}
+
+	a.log().Info("forbidden")
+
+	assert.Empty(t, *rec)
+	assert.Contains(t, buf.String(), "msg=forbidden")
+}
+
+func TestLoggerDiscard(t *testing.T) {
+	assert.NotPanics(t, func() { (&Auth{}).log().Error("dropped") })
+}
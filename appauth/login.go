@@ -0,0 +1,82 @@
+package appauth
+
+import (
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+const defaultReturnTo = "/"
+
+// ServeCallback is a mountable HTTP HandleFunc which finishes the
+// redirect login flow started by ServeLogin: it exchanges the code for
+// the token, stores the session ID in an HttpOnly session cookie and
+// redirects back to the `return_to` path given to ServeLogin. It MUST
+// be mounted on the LoginRedirectURL.
+func (a *Auth) ServeCallback(w http.ResponseWriter, r *http.Request) {
+	tok, failCode := a.exchangeCallback(r, a.cfg.LoginRedirectURL, "login")
+	if failCode != "" {
+		http.Error(w, failCode.Message(), http.StatusUnauthorized)
+		return
+	}
+
+	user, err := a.verifyCallbackToken(r.Context(), tok.AccessToken)
+	if err != nil {
+		a.log().Warn("verifying access token", slog.String("flow", "login"), slog.Any("error", err))
+		a.emit(r, Event{Type: EventLoginFailed, Reason: "access token invalid"})
+		http.Error(w, MessageInvalidToken.Message(), http.StatusUnauthorized)
+		return
+	}
+
+	sessID, err := a.createSession(r, tok, user, "")
+	if err != nil {
+		a.log().Error("creating session", slog.String("flow", "login"), slog.Any("error", err))
+		a.emit(r, Event{Type: EventLoginFailed, Subject: user.Sub, Reason: "creating session failed"})
+		http.Error(w, MessageSessionFailed.Message(), http.StatusInternalServerError)
+		return
+	}
+
+	if err = a.setSessionCookies(w, sessID); err != nil {
+		a.log().Error("setting session cookies", slog.Any("error", err))
+		a.emit(r, Event{Type: EventLoginFailed, Subject: user.Sub, Reason: "setting session cookies failed"})
+		http.Error(w, MessageSessionFailed.Message(), http.StatusInternalServerError)
+		return
+	}
+
+	a.emit(r, Event{Type: EventLoginSucceeded, Subject: user.Sub, SessionHash: sessionKey(sessID)})
+
+	returnTo, _ := readCookie(r, "oidc_return_to")
+	if !isLocalPath(returnTo) {
+		returnTo = defaultReturnTo
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, returnTo, http.StatusSeeOther)
+}
+
+// ServeLogin is a mountable HTTP HandleFunc which initiates the
+// full-page redirect to the OIDC server. After login the user returns
+// to ServeCallback and is then redirected to the local path given in
+// the `return_to` query parameter (defaults to `/`). The step-up
+// parameters of ServePopup are supported as well.
+func (a *Auth) ServeLogin(w http.ResponseWriter, r *http.Request) {
+	if a.cfg.LoginRedirectURL == "" {
+		a.log().Error("login requested without LoginRedirectURL configured")
+		http.NotFound(w, r)
+		return
+	}
+
+	if returnTo := r.URL.Query().Get("return_to"); isLocalPath(returnTo) {
+		setCookie(w, "oidc_return_to", returnTo, flowCookieTimeout, a.cfg.InsecureCookie)
+	}
+
+	a.redirectToProvider(w, r, a.cfg.LoginRedirectURL)
+}
+
+// isLocalPath checks the redirect target to be a path on the same host
+// to prevent open redirects
+func isLocalPath(p string) bool {
+	return strings.HasPrefix(p, "/") &&
+		!strings.HasPrefix(p, "//") &&
+		!strings.HasPrefix(p, `/\`)
+}
@@ -0,0 +1,97 @@
+package appauth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+
+	"github.com/Luzifer/go_helpers/appauth/pkg/cache"
+	"github.com/Luzifer/go_helpers/appauth/pkg/cache/mem"
+)
+
+func TestServeLogin(t *testing.T) {
+	a := &Auth{
+		cfg:       Config{LoginRedirectURL: "https://app.example.com/callback"},
+		discovery: &discovery{endpoint: oauth2.Endpoint{AuthURL: "https://idp.example.com/auth"}},
+		oauth2:    oauth2.Config{ClientID: "client"},
+	}
+
+	rec := httptest.NewRecorder()
+	a.ServeLogin(rec, httptest.NewRequest(http.MethodGet, "/login?return_to=/dashboard", nil))
+
+	require.Equal(t, http.StatusFound, rec.Code)
+
+	loc, err := url.Parse(rec.Header().Get("Location"))
+	require.NoError(t, err)
+	assert.Equal(t, "https://app.example.com/callback", loc.Query().Get("redirect_uri"))
+	assert.Equal(t, "S256", loc.Query().Get("code_challenge_method"))
+
+	cookies := make(map[string]string)
+	for _, line := range rec.Header().Values("Set-Cookie") {
+		c, err := http.ParseSetCookie(line)
+		require.NoError(t, err)
+		cookies[c.Name] = c.Value
+	}
+	assert.Equal(t, loc.Query().Get("state"), cookies["oidc_state"])
+	assert.Equal(t, url.QueryEscape("/dashboard"), cookies["oidc_return_to"])
+}
+
+func TestIsLocalPath(t *testing.T) {
+	assert.True(t, isLocalPath("/"))
+	assert.True(t, isLocalPath("/dashboard?tab=1"))
+	assert.False(t, isLocalPath(""))
+	assert.False(t, isLocalPath("https://evil.example.com/"))
+	assert.False(t, isLocalPath("//evil.example.com/"))
+	assert.False(t, isLocalPath(`/\evil.example.com/`))
+}
+
+func TestRequireAuthSessionCookie(t *testing.T) {
+	tc := newTestCache()
+	tc.sess[sessionKey("sess")] = cache.Session{AccessToken: "valid", Expires: time.Now().Add(time.Hour)}
+
+	vc := mem.NewVerificationCache(10)
+	data, err := json.Marshal(&User{Sub: "abc"})
+	require.NoError(t, err)
+	require.NoError(t, vc.SetVerification(t.Context(), tokenHash("valid"), data, time.Now().Add(time.Hour)))
+
+	a := &Auth{
+		cfg:               Config{ErrorRenderer: BearerErrorRenderer("")},
+		discovery:         &discovery{},
+		sessionStore:      cache.FromCache(tc),
+		verificationCache: vc,
+	}
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusNoContent) })
+
+	for name, tc := range map[string]struct {
+		method     string
+		csrfHeader string
+		wantStatus int
+	}{
+		"safe method":         {http.MethodGet, "", http.StatusNoContent},
+		"unsafe without csrf": {http.MethodPost, "", http.StatusForbidden},
+		"unsafe wrong csrf":   {http.MethodPost, "wrong", http.StatusForbidden},
+		"unsafe with csrf":    {http.MethodPost, "csrf", http.StatusNoContent},
+	} {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, "/", nil)
+			req.AddCookie(&http.Cookie{Name: defaultSessionCookieName, Value: "sess"})
+			req.AddCookie(&http.Cookie{Name: csrfCookieName, Value: "csrf"})
+			if tc.csrfHeader != "" {
+				req.Header.Set(csrfHeaderName, tc.csrfHeader)
+			}
+
+			rec := httptest.NewRecorder()
+			a.RequireAuth(next, Opts{}).ServeHTTP(rec, req)
+
+			assert.Equal(t, tc.wantStatus, rec.Code)
+		})
+	}
+}
@@ -0,0 +1,198 @@
+package appauth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/Luzifer/go_helpers/appauth/pkg/cache"
+)
+
+// ServeLogout is a mountable HTTP HandleFunc which ends a session.
+//
+// The session is taken from the `Authorization: Session ...` header
+// (XHR from the SPA), from the `session` form field (top-level form
+// POST) or from the session cookie of the redirect flow. Cookie based
+// requests must carry the CSRF token in the X-CSRF-Token header or the
+// `csrf_token` form field. The session is removed from the cache, the
+// session cookies are cleared and the refresh token is revoked at the
+// provider (RFC 7009) if the provider announces a revocation_endpoint.
+// Sessions bound to a DPoP key are only ended with a DPoP proof of
+// that key.
+//
+// If PostLogoutRedirectURL is configured and the provider supports
+// RP-initiated logout, form requests are redirected to the providers
+// end_session_endpoint while XHR requests receive the URL as JSON
+// (`{"end_session_url": "..."}`) to navigate to. Without such URL the
+// handler responds with 204 No Content.
+func (a *Auth) ServeLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sessID, isForm, fromCookie := a.logoutSessionID(r)
+	if sessID == "" {
+		a.log().Info("logout without session", slog.String("path", r.URL.Path))
+		http.Error(w, "missing session", http.StatusBadRequest)
+		return
+	}
+
+	if fromCookie {
+		if !validCSRF(r, r.Header.Get(csrfHeaderName)) && !validCSRF(r, r.PostFormValue("csrf_token")) {
+			a.log().Warn("invalid CSRF token", slog.String("path", r.URL.Path), slog.String("method", r.Method))
+			http.Error(w, "invalid CSRF token", http.StatusForbidden)
+			return
+		}
+		a.clearSessionCookies(w)
+	}
+
+	sess, err := a.endSession(r, sessID)
+	switch {
+	case errors.Is(err, errDPoPProof):
+		a.log().Info("invalid DPoP proof for logout", slog.String("path", r.URL.Path), slog.Any("error", err))
+		a.renderError(w, r, a.rejectSession(r, sessID, err))
+		return
+
+	case err != nil:
+		a.log().Error("ending session for logout", slog.Any("error", err))
+		http.Error(w, "ending session", http.StatusInternalServerError)
+		return
+	}
+
+	if sess.RefreshToken != "" {
+		if err = a.revokeToken(r.Context(), sess.RefreshToken, "refresh_token"); err != nil {
+			// The local session is gone, so the logout itself succeeded
+			a.log().Warn("revoking refresh token", slog.String("sub", sess.Subject), slog.Any("error", err))
+		}
+	}
+
+	endSessionURL := a.endSessionURL(r.Context(), sess.IDToken)
+
+	switch {
+	case endSessionURL == "":
+		w.WriteHeader(http.StatusNoContent)
+
+	case isForm:
+		http.Redirect(w, r, endSessionURL, http.StatusSeeOther)
+
+	default:
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]string{"end_session_url": endSessionURL})
+	}
+}
+
+// endSession removes the session for the logout and returns it (empty
+// if it did not exist). Sessions bound to a DPoP key are only removed
+// with a proof of that key.
+func (a *Auth) endSession(r *http.Request, sessID string) (cache.Session, error) {
+	sess, err := a.loadSession(r.Context(), sessID)
+	switch {
+	case errors.Is(err, cache.ErrSessionNotFound):
+		return cache.Session{}, nil
+
+	case err != nil:
+		return sess, err
+	}
+
+	if sess.DPoPKey != "" {
+		if err = a.verifyDPoPBinding(r, sessID, sess.DPoPKey); err != nil {
+			return cache.Session{}, err
+		}
+	}
+
+	if err = a.sessionStore.DeleteSession(r.Context(), sessionKey(sessID)); err != nil {
+		return cache.Session{}, fmt.Errorf("removing session: %w", err)
+	}
+
+	a.emit(r, Event{Type: EventSessionRevoked, Subject: sess.Subject, SessionHash: sessionKey(sessID), Reason: "logout"})
+
+	return sess, nil
+}
+
+// endSessionURL builds the OIDC RP-initiated logout URL or returns an
+// empty string in case the logout redirect is not configured or not
+// supported by the provider
+func (a *Auth) endSessionURL(ctx context.Context, idToken string) string {
+	if a.cfg.PostLogoutRedirectURL == "" {
+		return ""
+	}
+
+	d, err := a.discovered(ctx)
+	if err != nil {
+		a.log().Warn("getting end_session_endpoint", slog.Any("error", err))
+		return ""
+	}
+
+	if d.meta.EndSessionEndpoint == "" {
+		return ""
+	}
+
+	u, err := url.Parse(d.meta.EndSessionEndpoint)
+	if err != nil {
+		a.log().Error("parsing end_session_endpoint", slog.Any("error", err))
+		return ""
+	}
+
+	q := u.Query()
+	q.Set("client_id", a.cfg.ClientID)
+	q.Set("post_logout_redirect_uri", a.cfg.PostLogoutRedirectURL)
+	if idToken != "" {
+		q.Set("id_token_hint", idToken)
+	}
+	u.RawQuery = q.Encode()
+
+	return u.String()
+}
+
+// logoutSessionID extracts the session ID from the Authorization
+// header, the form body or the session cookie and reports whether the
+// response should redirect (form requests) and whether the session
+// was taken from the cookie
+func (a *Auth) logoutSessionID(r *http.Request) (sessID string, isForm, fromCookie bool) {
+	if tokenType, token, ok := strings.Cut(r.Header.Get("Authorization"), " "); ok && tokenType == "Session" {
+		return token, false, false
+	}
+
+	isForm = strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded")
+
+	if sessID = r.PostFormValue("session"); sessID != "" {
+		return sessID, true, false
+	}
+
+	if cookieSessID, ok := a.sessionFromCookie(r); ok {
+		return cookieSessID, isForm, true
+	}
+
+	return "", false, false
+}
+
+// revokeToken revokes the given token at the provider using the
+// RFC 7009 revocation endpoint. Providers without revocation endpoint
+// are silently skipped.
+func (a *Auth) revokeToken(ctx context.Context, token, tokenTypeHint string) error {
+	d, err := a.discovered(ctx)
+	if err != nil {
+		return err
+	}
+
+	if d.meta.RevocationEndpoint == "" {
+		return nil
+	}
+
+	if _, err = postClientForm(ctx, d.meta.RevocationEndpoint, a.cfg.ClientID, a.cfg.ClientSecret, url.Values{
+		"token":           []string{token},
+		"token_type_hint": []string{tokenTypeHint},
+	}); err != nil {
+		return fmt.Errorf("revoking token: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,124 @@
+package appauth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Luzifer/go_helpers/appauth/pkg/cache"
+	"github.com/Luzifer/go_helpers/appauth/pkg/cache/mem"
+)
+
+func TestServeLogoutRevokesAndRedirects(t *testing.T) {
+	var revoked url.Values
+	revocationSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		if !ok || user != "client" || pass != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		assert.NoError(t, r.ParseForm())
+		revoked = r.PostForm
+	}))
+	t.Cleanup(revocationSrv.Close)
+
+	tc := newTestCache()
+	tc.sess[sessionKey("a")] = cache.Session{
+		IDToken:      "idtoken",
+		RefreshToken: "refresh",
+		Expires:      time.Now().Add(time.Hour),
+	}
+
+	a := &Auth{
+		cfg: Config{
+			ClientID:              "client",
+			ClientSecret:          "secret",
+			PostLogoutRedirectURL: "https://app.example.com/",
+		},
+		discovery: &discovery{meta: providerMetadata{
+			EndSessionEndpoint: "https://idp.example.com/logout",
+			RevocationEndpoint: revocationSrv.URL,
+		}},
+		sessionStore: cache.FromCache(tc),
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/logout", strings.NewReader(url.Values{"session": []string{"a"}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+
+	a.ServeLogout(rec, req)
+
+	require.Equal(t, http.StatusSeeOther, rec.Code)
+	assert.Equal(t, []string{sessionKey("a")}, tc.removeIDs)
+
+	require.NotNil(t, revoked)
+	assert.Equal(t, "refresh", revoked.Get("token"))
+	assert.Equal(t, "refresh_token", revoked.Get("token_type_hint"))
+
+	loc, err := url.Parse(rec.Header().Get("Location"))
+	require.NoError(t, err)
+	assert.Equal(t, "idp.example.com", loc.Host)
+	assert.Equal(t, "idtoken", loc.Query().Get("id_token_hint"))
+	assert.Equal(t, "https://app.example.com/", loc.Query().Get("post_logout_redirect_uri"))
+	assert.Equal(t, "client", loc.Query().Get("client_id"))
+}
+
+func TestServeLogoutWithoutRedirect(t *testing.T) {
+	tc := newTestCache()
+	tc.sess[sessionKey("a")] = cache.Session{RefreshToken: "refresh"}
+
+	a := &Auth{sessionStore: cache.FromCache(tc)}
+
+	req := httptest.NewRequest(http.MethodPost, "/logout", nil)
+	req.Header.Set("Authorization", "Session a")
+	rec := httptest.NewRecorder()
+
+	a.ServeLogout(rec, req)
+
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	assert.Equal(t, []string{sessionKey("a")}, tc.removeIDs)
+}
+
+func TestServeLogoutMissingSession(t *testing.T) {
+	a := &Auth{sessionStore: cache.FromCache(newTestCache())}
+
+	rec := httptest.NewRecorder()
+	a.ServeLogout(rec, httptest.NewRequest(http.MethodPost, "/logout", nil))
+
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestServeLogoutDPoPBound(t *testing.T) {
+	jkt, proof := dpopTestKey(t)
+
+	tc := newTestCache()
+	tc.sess[sessionKey("a")] = cache.Session{IDToken: "id-token", DPoPKey: jkt}
+
+	a := &Auth{
+		cfg:             Config{ErrorRenderer: BearerErrorRenderer("")},
+		dpopReplayCache: mem.NewReplayCache(),
+		sessionStore:    cache.FromCache(tc),
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/logout", nil)
+	req.Header.Set("Authorization", "Session a")
+	rec := httptest.NewRecorder()
+	a.ServeLogout(rec, req)
+
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Contains(t, tc.sess, sessionKey("a"))
+
+	req.Header.Set("DPoP", proof(http.MethodPost, "https://example.com/logout", "a", nil))
+	rec = httptest.NewRecorder()
+	a.ServeLogout(rec, req)
+
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	assert.NotContains(t, tc.sess, sessionKey("a"))
+}
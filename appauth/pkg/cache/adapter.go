@@ -0,0 +1,110 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+type (
+	// cacheAdapter provides the SessionStore interface for a Cache
+	// ignoring the context and ttl hint
+	cacheAdapter struct {
+		c Cache
+	}
+)
+
+var (
+	_ ProviderSessionIndex = cacheAdapter{}
+	_ SessionLocker        = cacheAdapter{}
+	_ SessionStore         = cacheAdapter{}
+	_ SubjectIndex         = cacheAdapter{}
+)
+
+// FromCache returns a SessionStore for the given Cache. If the Cache
+// already implements the SessionStore it is returned as is. Optional
+// interfaces implemented by the Cache are passed through and return
+// ErrUnsupported if they are not implemented.
+func FromCache(c Cache) SessionStore {
+	if s, ok := c.(SessionStore); ok {
+		return s
+	}
+
+	return cacheAdapter{c: c}
+}
+
+// DeleteSession removes the session for the given ID.
+func (a cacheAdapter) DeleteSession(_ context.Context, id string) error {
+	if err := a.c.RemoveSession(id); err != nil {
+		return fmt.Errorf("removing session: %w", err)
+	}
+
+	return nil
+}
+
+// ListProviderSessions returns all sessions of the given provider
+// session ID if supported by the Cache.
+func (a cacheAdapter) ListProviderSessions(ctx context.Context, sid string) (map[string]Session, error) {
+	idx, ok := a.c.(ProviderSessionIndex)
+	if !ok {
+		return nil, ErrUnsupported
+	}
+
+	sessions, err := idx.ListProviderSessions(ctx, sid)
+	if err != nil {
+		return nil, fmt.Errorf("listing provider sessions: %w", err)
+	}
+
+	return sessions, nil
+}
+
+// ListSessions returns all sessions of the given subject if supported
+// by the Cache.
+func (a cacheAdapter) ListSessions(ctx context.Context, sub string) (map[string]Session, error) {
+	idx, ok := a.c.(SubjectIndex)
+	if !ok {
+		return nil, ErrUnsupported
+	}
+
+	sessions, err := idx.ListSessions(ctx, sub)
+	if err != nil {
+		return nil, fmt.Errorf("listing sessions: %w", err)
+	}
+
+	return sessions, nil
+}
+
+// LoadSession returns the session for the given ID.
+func (a cacheAdapter) LoadSession(_ context.Context, id string) (Session, error) {
+	s, err := a.c.GetSession(id)
+	if err != nil {
+		return s, fmt.Errorf("getting session: %w", err)
+	}
+
+	return s, nil
+}
+
+// LockSession acquires the lock for the given session ID if supported
+// by the Cache.
+func (a cacheAdapter) LockSession(ctx context.Context, id string, ttl time.Duration) (func() error, error) {
+	l, ok := a.c.(SessionLocker)
+	if !ok {
+		return nil, ErrUnsupported
+	}
+
+	unlock, err := l.LockSession(ctx, id, ttl)
+	if err != nil {
+		return nil, fmt.Errorf("locking session: %w", err)
+	}
+
+	return unlock, nil
+}
+
+// StoreSession stores the session for the given ID.
+func (a cacheAdapter) StoreSession(_ context.Context, id string, sess Session, _ time.Duration) error {
+	if err := a.c.SetSession(id, sess); err != nil {
+		return fmt.Errorf("storing session: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,77 @@
+package cache
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type (
+	mapCache map[string]Session
+
+	nativeStore struct {
+		mapCache
+	}
+)
+
+func (m mapCache) GetSession(id string) (Session, error) {
+	s, ok := m[id]
+	if !ok {
+		return Session{}, ErrSessionNotFound
+	}
+	return s, nil
+}
+
+func (m mapCache) RemoveSession(id string) error {
+	delete(m, id)
+	return nil
+}
+
+func (m mapCache) SetSession(id string, sess Session) error {
+	m[id] = sess
+	return nil
+}
+
+func (nativeStore) DeleteSession(context.Context, string) error { return nil }
+
+func (nativeStore) LoadSession(context.Context, string) (Session, error) { return Session{}, nil }
+
+func (nativeStore) StoreSession(context.Context, string, Session, time.Duration) error {
+	return nil
+}
+
+func TestFromCache(t *testing.T) {
+	c := mapCache{}
+	s := FromCache(c)
+
+	_, err := s.LoadSession(t.Context(), "a")
+	require.ErrorIs(t, err, ErrSessionNotFound)
+
+	require.NoError(t, s.StoreSession(t.Context(), "a", Session{Subject: "alice"}, time.Minute))
+	assert.Equal(t, "alice", c["a"].Subject)
+
+	got, err := s.LoadSession(t.Context(), "a")
+	require.NoError(t, err)
+	assert.Equal(t, "alice", got.Subject)
+
+	require.NoError(t, s.DeleteSession(t.Context(), "a"))
+	assert.Empty(t, c)
+
+	// Optional interfaces not implemented by the cache
+	_, err = s.(SubjectIndex).ListSessions(t.Context(), "alice")
+	require.ErrorIs(t, err, ErrUnsupported)
+
+	_, err = s.(ProviderSessionIndex).ListProviderSessions(t.Context(), "sid")
+	require.ErrorIs(t, err, ErrUnsupported)
+
+	_, err = s.(SessionLocker).LockSession(t.Context(), "a", time.Second)
+	require.ErrorIs(t, err, ErrUnsupported)
+}
+
+func TestFromCacheNative(t *testing.T) {
+	n := nativeStore{mapCache{}}
+	assert.Equal(t, n, FromCache(n))
+}
@@ -2,12 +2,15 @@
 package cache
 
 import (
+	"context"
 	"fmt"
 	"time"
 )
 
 type (
-	// Cache describes what to implement when building a cache provider
+	// Cache describes what to implement when building a cache provider.
+	// New implementations should implement the SessionStore, existing
+	// ones can be used as SessionStore through FromCache.
 	Cache interface {
 		// GetSession returns the session for the given ID.
 		GetSession(id string) (Session, error)
@@ -19,6 +22,71 @@ type (
 		SetSession(id string, sess Session) error
 	}
 
+	// ProviderSessionIndex is implemented by caches maintaining a
+	// secondary index of the sessions by the session ID of the provider
+	// (`sid` claim) used for back-channel logout
+	ProviderSessionIndex interface {
+		// ListProviderSessions returns all sessions of the given
+		// provider session ID keyed by their session ID.
+		ListProviderSessions(ctx context.Context, sid string) (map[string]Session, error)
+	}
+
+	// ReplayCache describes what to implement when building a cache
+	// detecting the reuse of one-time identifiers such as the `jti` of
+	// DPoP proofs
+	ReplayCache interface {
+		// UseOnce stores the given key until the given expiry and
+		// returns ErrReplayed if it is already stored. Storing and
+		// checking the key MUST be atomic.
+		UseOnce(ctx context.Context, key string, expires time.Time) error
+	}
+
+	// SessionLocker is implemented by caches shared between multiple
+	// instances to prevent them refreshing the same session in parallel
+	SessionLocker interface {
+		// LockSession blocks until the exclusive lock for the given
+		// session ID is acquired or the context is done. The lock is
+		// held until unlock is called or the ttl passed.
+		LockSession(ctx context.Context, id string, ttl time.Duration) (unlock func() error, err error)
+	}
+
+	// SessionStore describes what to implement when building a
+	// session store. It supersedes the Cache interface.
+	SessionStore interface {
+		// DeleteSession removes the session for the given ID. Removing
+		// an unknown session is not an error.
+		DeleteSession(ctx context.Context, id string) error
+
+		// LoadSession returns the session for the given ID or
+		// ErrSessionNotFound if it does not exist or is expired.
+		LoadSession(ctx context.Context, id string) (Session, error)
+
+		// StoreSession stores the session for the given ID. The ttl is
+		// a hint how long the session may live without being stored
+		// again (0 if unknown), the store may evict it afterwards.
+		StoreSession(ctx context.Context, id string, sess Session, ttl time.Duration) error
+	}
+
+	// SubjectIndex is implemented by caches maintaining a secondary
+	// index of the sessions by their subject
+	SubjectIndex interface {
+		// ListSessions returns all sessions of the given subject keyed
+		// by their session ID.
+		ListSessions(ctx context.Context, sub string) (map[string]Session, error)
+	}
+
+	// VerificationCache describes what to implement when building a
+	// cache for access token verification results
+	VerificationCache interface {
+		// GetVerification returns the stored verification result for
+		// the given key or ErrVerificationNotFound.
+		GetVerification(ctx context.Context, key string) ([]byte, error)
+
+		// SetVerification stores the verification result for the given
+		// key until the given expiry.
+		SetVerification(ctx context.Context, key string, data []byte, expires time.Time) error
+	}
+
 	// Session holds the data for the stored session
 	Session struct {
 		AccessToken  string
@@ -28,9 +96,31 @@ type (
 		Expires   time.Time // AT expiry
 		CreatedAt time.Time // first creation of this session
 		LastSeen  time.Time // updated on successful usage
+
+		Subject   string // `sub` of the user owning the session
+		UserAgent string // user agent creating the session
+		IP        string // client IP creating the session
+		SID       string // `sid` of the provider session from the ID token
+
+		// DPoPKey is the JWK SHA-256 thumbprint of the DPoP key the
+		// session is bound to (empty for unbound sessions)
+		DPoPKey string
 	}
 )
 
-// ErrSessionNotFound is an error returned when the cache cannot find
-// the given session ID
-var ErrSessionNotFound = fmt.Errorf("session not found")
+var (
+	// ErrReplayed is returned by the ReplayCache for keys used before
+	ErrReplayed = fmt.Errorf("key was used before")
+
+	// ErrSessionNotFound is an error returned when the cache cannot find
+	// the given session ID
+	ErrSessionNotFound = fmt.Errorf("session not found")
+
+	// ErrUnsupported is returned by cache wrappers for optional
+	// interfaces the wrapped cache does not implement
+	ErrUnsupported = fmt.Errorf("operation not supported by cache")
+
+	// ErrVerificationNotFound is an error returned when the cache has no
+	// (unexpired) verification result for the given key
+	ErrVerificationNotFound = fmt.Errorf("verification not found")
+)
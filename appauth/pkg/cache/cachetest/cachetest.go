@@ -0,0 +1,140 @@
+// Package cachetest contains a conformance test suite every appauth
+// session cache implementation must pass.
+package cachetest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Luzifer/go_helpers/appauth/pkg/cache"
+)
+
+// sessionTime is the reference time of all test sessions. Stored
+// times might lose precision or monotonic clock readings, so it is
+// truncated to seconds.
+var sessionTime = time.Now().Truncate(time.Second).UTC()
+
+// Run executes the conformance suite against caches created through
+// newCache which must return an empty cache on every call. Tests for
+// optional interfaces are skipped if the cache does not implement
+// them.
+func Run(t *testing.T, newCache func(t *testing.T) cache.Cache) {
+	t.Helper()
+
+	t.Run("SessionLifecycle", func(t *testing.T) { testSessionLifecycle(t, newCache(t)) })
+	t.Run("SubjectIndex", func(t *testing.T) { testSubjectIndex(t, newCache(t)) })
+	t.Run("ProviderSessionIndex", func(t *testing.T) { testProviderSessionIndex(t, newCache(t)) })
+}
+
+func assertSessionEqual(t *testing.T, expected, actual cache.Session) {
+	t.Helper()
+
+	assert.Equal(t, expected.AccessToken, actual.AccessToken)
+	assert.Equal(t, expected.IDToken, actual.IDToken)
+	assert.Equal(t, expected.RefreshToken, actual.RefreshToken)
+	assert.True(t, expected.Expires.Equal(actual.Expires), "Expires")
+	assert.True(t, expected.CreatedAt.Equal(actual.CreatedAt), "CreatedAt")
+	assert.True(t, expected.LastSeen.Equal(actual.LastSeen), "LastSeen")
+	assert.Equal(t, expected.Subject, actual.Subject)
+	assert.Equal(t, expected.UserAgent, actual.UserAgent)
+	assert.Equal(t, expected.IP, actual.IP)
+	assert.Equal(t, expected.SID, actual.SID)
+}
+
+func testProviderSessionIndex(t *testing.T, c cache.Cache) {
+	idx, ok := c.(cache.ProviderSessionIndex)
+	if !ok {
+		t.Skip("cache does not implement ProviderSessionIndex")
+	}
+
+	require.NoError(t, c.SetSession("a", testSession("alice", "sid-1")))
+	require.NoError(t, c.SetSession("b", testSession("alice", "sid-2")))
+
+	sessions, err := idx.ListProviderSessions(t.Context(), "sid-1")
+	require.NoError(t, err)
+	require.Len(t, sessions, 1)
+	assertSessionEqual(t, testSession("alice", "sid-1"), sessions["a"])
+
+	require.NoError(t, c.RemoveSession("a"))
+
+	sessions, err = idx.ListProviderSessions(t.Context(), "sid-1")
+	require.NoError(t, err)
+	assert.Empty(t, sessions)
+}
+
+// testSession creates a fully populated session which is not expired
+// by any reasonable idle timeout
+func testSession(sub, sid string) cache.Session {
+	return cache.Session{
+		AccessToken:  "access-" + sub,
+		IDToken:      "id-" + sub,
+		RefreshToken: "refresh-" + sub,
+		Expires:      sessionTime.Add(5 * time.Minute),
+		CreatedAt:    sessionTime.Add(-time.Minute),
+		LastSeen:     sessionTime,
+		Subject:      sub,
+		UserAgent:    "cachetest",
+		IP:           "192.0.2.1",
+		SID:          sid,
+	}
+}
+
+func testSessionLifecycle(t *testing.T, c cache.Cache) {
+	_, err := c.GetSession("a")
+	require.ErrorIs(t, err, cache.ErrSessionNotFound)
+
+	sess := testSession("alice", "sid")
+	require.NoError(t, c.SetSession("a", sess))
+
+	got, err := c.GetSession("a")
+	require.NoError(t, err)
+	assertSessionEqual(t, sess, got)
+
+	// Overwriting replaces the session
+	sess.AccessToken = "renewed"
+	require.NoError(t, c.SetSession("a", sess))
+
+	got, err = c.GetSession("a")
+	require.NoError(t, err)
+	assertSessionEqual(t, sess, got)
+
+	require.NoError(t, c.RemoveSession("a"))
+
+	_, err = c.GetSession("a")
+	require.ErrorIs(t, err, cache.ErrSessionNotFound)
+
+	// Removing unknown sessions is not an error
+	require.NoError(t, c.RemoveSession("a"))
+}
+
+func testSubjectIndex(t *testing.T, c cache.Cache) {
+	idx, ok := c.(cache.SubjectIndex)
+	if !ok {
+		t.Skip("cache does not implement SubjectIndex")
+	}
+
+	require.NoError(t, c.SetSession("a", testSession("alice", "")))
+	require.NoError(t, c.SetSession("b", testSession("alice", "")))
+	require.NoError(t, c.SetSession("c", testSession("bob", "")))
+
+	sessions, err := idx.ListSessions(t.Context(), "alice")
+	require.NoError(t, err)
+	require.Len(t, sessions, 2)
+	assertSessionEqual(t, testSession("alice", ""), sessions["a"])
+	assert.Contains(t, sessions, "b")
+
+	// Moving a session to another subject updates the index
+	require.NoError(t, c.SetSession("b", testSession("bob", "")))
+	require.NoError(t, c.RemoveSession("a"))
+
+	sessions, err = idx.ListSessions(t.Context(), "alice")
+	require.NoError(t, err)
+	assert.Empty(t, sessions)
+
+	sessions, err = idx.ListSessions(t.Context(), "bob")
+	require.NoError(t, err)
+	assert.Len(t, sessions, 2)
+}
@@ -0,0 +1,290 @@
+// Package encrypted provides an appauth session cache wrapper
+// encrypting the tokens of the sessions before passing them to the
+// wrapped cache.
+package encrypted
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Luzifer/go_helpers/appauth/pkg/cache"
+)
+
+const keyIDSeparator = ":"
+
+type (
+	// Cache encrypts the AccessToken, IDToken and RefreshToken of the
+	// sessions using AES-GCM bound to the key the session is stored
+	// under. The remaining fields are passed through unencrypted as
+	// they are required by the wrapped cache for indexing and expiry.
+	//
+	// Each value is prefixed with the ID of the key used to encrypt it
+	// so keys can be rotated: new values are encrypted using the
+	// primary key while all keys in the keyring are used to decrypt.
+	// As sessions are written back on every use, keys no longer used
+	// can be removed after the session idle timeout.
+	Cache struct {
+		backend cache.Cache
+		store   cache.SessionStore
+
+		keys    map[string]cipher.AEAD
+		primary string
+	}
+
+	// Opt applies configuration to a Cache.
+	Opt func(*Cache) error
+)
+
+var (
+	_ cache.Cache                = (*Cache)(nil)
+	_ cache.ProviderSessionIndex = (*Cache)(nil)
+	_ cache.SessionLocker        = (*Cache)(nil)
+	_ cache.SessionStore         = (*Cache)(nil)
+	_ cache.SubjectIndex         = (*Cache)(nil)
+)
+
+// ErrUnknownKey is returned when a stored value was encrypted with a
+// key not present in the keyring
+var ErrUnknownKey = errors.New("value encrypted with unknown key")
+
+// New creates an encrypting wrapper around the given backend.
+func New(backend cache.Cache, opts ...Opt) (c *Cache, err error) {
+	c = &Cache{
+		backend: backend,
+		keys:    make(map[string]cipher.AEAD),
+	}
+
+	for _, opt := range opts {
+		if err = opt(c); err != nil {
+			return nil, fmt.Errorf("applying option: %w", err)
+		}
+	}
+
+	if c.backend == nil {
+		return nil, fmt.Errorf("cache initialized without backend")
+	}
+
+	if c.primary == "" {
+		return nil, fmt.Errorf("cache initialized without primary key")
+	}
+
+	c.store = cache.FromCache(c.backend)
+
+	return c, nil
+}
+
+// WithKey adds a key to the keyring used to decrypt values. The key
+// must be 16, 24 or 32 bytes long to select AES-128, AES-192 or
+// AES-256.
+func WithKey(id string, key []byte) Opt {
+	return func(c *Cache) error {
+		if id == "" || strings.Contains(id, keyIDSeparator) {
+			return fmt.Errorf("key ID must be non-empty and must not contain %q", keyIDSeparator)
+		}
+
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return fmt.Errorf("creating cipher for key %q: %w", id, err)
+		}
+
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return fmt.Errorf("creating GCM for key %q: %w", id, err)
+		}
+
+		c.keys[id] = aead
+		return nil
+	}
+}
+
+// WithPrimaryKey adds a key to the keyring and uses it to encrypt new
+// values (see WithKey).
+func WithPrimaryKey(id string, key []byte) Opt {
+	return func(c *Cache) error {
+		if err := WithKey(id, key)(c); err != nil {
+			return err
+		}
+
+		c.primary = id
+		return nil
+	}
+}
+
+// DeleteSession removes the session for the given ID.
+func (c *Cache) DeleteSession(ctx context.Context, id string) error {
+	if err := c.store.DeleteSession(ctx, id); err != nil {
+		return fmt.Errorf("removing session: %w", err)
+	}
+
+	return nil
+}
+
+// GetSession returns the session for the given ID.
+func (c *Cache) GetSession(id string) (cache.Session, error) {
+	return c.LoadSession(context.Background(), id)
+}
+
+// ListProviderSessions returns all sessions of the given provider
+// session ID if supported by the backend.
+func (c *Cache) ListProviderSessions(ctx context.Context, sid string) (map[string]cache.Session, error) {
+	idx, ok := c.backend.(cache.ProviderSessionIndex)
+	if !ok {
+		return nil, cache.ErrUnsupported
+	}
+
+	sessions, err := idx.ListProviderSessions(ctx, sid)
+	if err != nil {
+		return nil, fmt.Errorf("listing provider sessions: %w", err)
+	}
+
+	return c.decryptSessions(sessions)
+}
+
+// ListSessions returns all sessions of the given subject if supported
+// by the backend.
+func (c *Cache) ListSessions(ctx context.Context, sub string) (map[string]cache.Session, error) {
+	idx, ok := c.backend.(cache.SubjectIndex)
+	if !ok {
+		return nil, cache.ErrUnsupported
+	}
+
+	sessions, err := idx.ListSessions(ctx, sub)
+	if err != nil {
+		return nil, fmt.Errorf("listing sessions: %w", err)
+	}
+
+	return c.decryptSessions(sessions)
+}
+
+// LoadSession returns the decrypted session for the given ID.
+func (c *Cache) LoadSession(ctx context.Context, id string) (cache.Session, error) {
+	s, err := c.store.LoadSession(ctx, id)
+	if err != nil {
+		return s, fmt.Errorf("getting session: %w", err)
+	}
+
+	return c.decryptSession(id, s)
+}
+
+// LockSession acquires the lock for the given session ID if supported
+// by the backend.
+func (c *Cache) LockSession(ctx context.Context, id string, ttl time.Duration) (func() error, error) {
+	l, ok := c.backend.(cache.SessionLocker)
+	if !ok {
+		return nil, cache.ErrUnsupported
+	}
+
+	unlock, err := l.LockSession(ctx, id, ttl)
+	if err != nil {
+		return nil, fmt.Errorf("locking session: %w", err)
+	}
+
+	return unlock, nil
+}
+
+// RemoveSession removes the session for the given ID.
+func (c *Cache) RemoveSession(id string) error {
+	return c.DeleteSession(context.Background(), id)
+}
+
+// SetSession encrypts and stores the session for the given ID.
+func (c *Cache) SetSession(id string, sess cache.Session) error {
+	return c.StoreSession(context.Background(), id, sess, 0)
+}
+
+// StoreSession encrypts and stores the session for the given ID passing
+// the ttl hint to the backend.
+func (c *Cache) StoreSession(ctx context.Context, id string, sess cache.Session, ttl time.Duration) (err error) {
+	for _, field := range []*string{&sess.AccessToken, &sess.IDToken, &sess.RefreshToken} {
+		if *field, err = c.encrypt(id, *field); err != nil {
+			return fmt.Errorf("encrypting session: %w", err)
+		}
+	}
+
+	if err = c.store.StoreSession(ctx, id, sess, ttl); err != nil {
+		return fmt.Errorf("storing session: %w", err)
+	}
+
+	return nil
+}
+
+func (c *Cache) decrypt(id, value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+
+	keyID, encoded, ok := strings.Cut(value, keyIDSeparator)
+	if !ok {
+		return "", errors.New("value is not encrypted")
+	}
+
+	aead, ok := c.keys[keyID]
+	if !ok {
+		return "", fmt.Errorf("%w: %q", ErrUnknownKey, keyID)
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", fmt.Errorf("decoding value: %w", err)
+	}
+
+	if len(raw) < aead.NonceSize() {
+		return "", errors.New("value too short")
+	}
+
+	plain, err := aead.Open(nil, raw[:aead.NonceSize()], raw[aead.NonceSize():], []byte(id))
+	if err != nil {
+		return "", fmt.Errorf("decrypting value: %w", err)
+	}
+
+	return string(plain), nil
+}
+
+func (c *Cache) decryptSession(id string, s cache.Session) (_ cache.Session, err error) {
+	for _, field := range []*string{&s.AccessToken, &s.IDToken, &s.RefreshToken} {
+		if *field, err = c.decrypt(id, *field); err != nil {
+			return cache.Session{}, fmt.Errorf("decrypting session: %w", err)
+		}
+	}
+
+	return s, nil
+}
+
+func (c *Cache) decryptSessions(sessions map[string]cache.Session) (map[string]cache.Session, error) {
+	out := make(map[string]cache.Session, len(sessions))
+	for id, s := range sessions {
+		dec, err := c.decryptSession(id, s)
+		if err != nil {
+			return nil, err
+		}
+		out[id] = dec
+	}
+
+	return out, nil
+}
+
+// encrypt seals the value with the primary key using the ID as
+// additional data to prevent moving values between sessions
+func (c *Cache) encrypt(id, value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+
+	aead := c.keys[c.primary]
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("generating nonce: %w", err)
+	}
+
+	sealed := aead.Seal(nonce, nonce, []byte(value), []byte(id))
+
+	return c.primary + keyIDSeparator + base64.RawURLEncoding.EncodeToString(sealed), nil
+}
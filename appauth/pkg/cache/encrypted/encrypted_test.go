@@ -0,0 +1,112 @@
+package encrypted
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Luzifer/go_helpers/appauth/pkg/cache"
+	"github.com/Luzifer/go_helpers/appauth/pkg/cache/cachetest"
+	"github.com/Luzifer/go_helpers/appauth/pkg/cache/mem"
+)
+
+var (
+	testKeyA = bytes.Repeat([]byte{'a'}, 32)
+	testKeyB = bytes.Repeat([]byte{'b'}, 32)
+)
+
+func TestConformance(t *testing.T) {
+	cachetest.Run(t, func(t *testing.T) cache.Cache {
+		c, err := New(mem.New(), WithPrimaryKey("a", testKeyA))
+		require.NoError(t, err)
+		return c
+	})
+}
+
+func TestEncryptedRoundtrip(t *testing.T) {
+	backend := mem.New()
+	c, err := New(backend, WithPrimaryKey("a", testKeyA))
+	require.NoError(t, err)
+
+	sess := cache.Session{
+		AccessToken:  "access",
+		IDToken:      "id",
+		RefreshToken: "refresh",
+		Subject:      "alice",
+	}
+	require.NoError(t, c.SetSession("k", sess))
+
+	stored, err := backend.GetSession("k")
+	require.NoError(t, err)
+	assert.NotContains(t, stored.AccessToken, "access")
+	assert.NotContains(t, stored.RefreshToken, "refresh")
+	assert.Equal(t, "alice", stored.Subject, "metadata must stay readable for the index")
+
+	got, err := c.GetSession("k")
+	require.NoError(t, err)
+	assert.Equal(t, sess, got)
+
+	listed, err := c.ListSessions(t.Context(), "alice")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]cache.Session{"k": sess}, listed)
+
+	_, err = c.GetSession("unknown")
+	require.ErrorIs(t, err, cache.ErrSessionNotFound)
+}
+
+func TestEncryptedKeyRotation(t *testing.T) {
+	backend := mem.New()
+
+	oldCache, err := New(backend, WithPrimaryKey("a", testKeyA))
+	require.NoError(t, err)
+	require.NoError(t, oldCache.SetSession("k", cache.Session{RefreshToken: "refresh"}))
+
+	rotated, err := New(backend, WithKey("a", testKeyA), WithPrimaryKey("b", testKeyB))
+	require.NoError(t, err)
+
+	got, err := rotated.GetSession("k")
+	require.NoError(t, err)
+	assert.Equal(t, "refresh", got.RefreshToken)
+
+	// Writing back re-encrypts with the new primary key
+	require.NoError(t, rotated.SetSession("k", got))
+
+	newOnly, err := New(backend, WithPrimaryKey("b", testKeyB))
+	require.NoError(t, err)
+
+	got, err = newOnly.GetSession("k")
+	require.NoError(t, err)
+	assert.Equal(t, "refresh", got.RefreshToken)
+
+	_, err = oldCache.GetSession("k")
+	require.ErrorIs(t, err, ErrUnknownKey)
+}
+
+func TestEncryptedBoundToKey(t *testing.T) {
+	backend := mem.New()
+	c, err := New(backend, WithPrimaryKey("a", testKeyA))
+	require.NoError(t, err)
+
+	require.NoError(t, c.SetSession("k", cache.Session{RefreshToken: "refresh"}))
+
+	// Copying the encrypted values to another session must not work
+	stored, err := backend.GetSession("k")
+	require.NoError(t, err)
+	require.NoError(t, backend.SetSession("other", stored))
+
+	_, err = c.GetSession("other")
+	require.Error(t, err)
+}
+
+func TestEncryptedConfig(t *testing.T) {
+	_, err := New(mem.New())
+	require.Error(t, err, "primary key is required")
+
+	_, err = New(mem.New(), WithPrimaryKey("a", []byte("short")))
+	require.Error(t, err)
+
+	_, err = New(mem.New(), WithPrimaryKey("a:b", testKeyA))
+	require.Error(t, err)
+}
@@ -0,0 +1,379 @@
+// Package file provides an appauth session cache storing one file per
+// session in a local directory.
+package file
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Luzifer/go_helpers/appauth/pkg/cache"
+)
+
+const (
+	defaultCleanupInterval = 5 * time.Minute
+	defaultIdleTimeout     = time.Hour
+
+	dirPerms  = 0o700
+	filePerms = 0o600
+
+	sessionFileExt = ".json"
+)
+
+type (
+	// Cache stores each session as JSON file named by the hash of its
+	// ID in a directory readable only by the current user. It is meant
+	// for single-instance deployments: listing sessions scans the whole
+	// directory. Sessions unused for the idle timeout are treated as
+	// missing and periodically removed.
+	Cache struct {
+		dir             string
+		idleTimeout     time.Duration
+		cleanupInterval time.Duration
+		logger          *slog.Logger
+
+		lock      sync.RWMutex
+		stop      chan struct{}
+		done      chan struct{}
+		closeOnce sync.Once
+	}
+
+	// Opt applies configuration to a Cache.
+	Opt func(*Cache) error
+
+	// sessionFile is the content of a session file
+	sessionFile struct {
+		ID      string        `json:"id"`
+		Expires time.Time     `json:"expires"`
+		Session cache.Session `json:"session"`
+	}
+)
+
+var (
+	_ cache.Cache                = (*Cache)(nil)
+	_ cache.ProviderSessionIndex = (*Cache)(nil)
+	_ cache.SessionStore         = (*Cache)(nil)
+	_ cache.SubjectIndex         = (*Cache)(nil)
+)
+
+// New creates a file based appauth session cache and starts the
+// periodic cleanup of expired sessions. Call Close to stop it.
+func New(opts ...Opt) (c *Cache, err error) {
+	c = &Cache{
+		cleanupInterval: defaultCleanupInterval,
+		idleTimeout:     defaultIdleTimeout,
+		logger:          slog.New(slog.DiscardHandler),
+		stop:            make(chan struct{}),
+		done:            make(chan struct{}),
+	}
+
+	for _, opt := range opts {
+		if err = opt(c); err != nil {
+			return nil, fmt.Errorf("applying option: %w", err)
+		}
+	}
+
+	if c.dir == "" {
+		return nil, fmt.Errorf("cache initialized without directory")
+	}
+
+	if c.idleTimeout <= 0 {
+		return nil, fmt.Errorf("idle-timeout must be positive duration")
+	}
+
+	if c.cleanupInterval <= 0 {
+		return nil, fmt.Errorf("cleanup-interval must be positive duration")
+	}
+
+	if c.logger == nil {
+		return nil, fmt.Errorf("cache initialized without logger")
+	}
+
+	if err = os.MkdirAll(c.dir, dirPerms); err != nil {
+		return nil, fmt.Errorf("creating session directory: %w", err)
+	}
+
+	go c.cleanupLoop()
+
+	return c, nil
+}
+
+// WithCleanupInterval configures how often expired sessions are
+// removed from the directory.
+func WithCleanupInterval(d time.Duration) Opt {
+	return func(c *Cache) error {
+		c.cleanupInterval = d
+		return nil
+	}
+}
+
+// WithDirectory configures the directory to store the sessions in.
+func WithDirectory(dir string) Opt {
+	return func(c *Cache) error {
+		c.dir = dir
+		return nil
+	}
+}
+
+// WithIdleTimeout configures how long an unused session is retained.
+func WithIdleTimeout(d time.Duration) Opt {
+	return func(c *Cache) error {
+		c.idleTimeout = d
+		return nil
+	}
+}
+
+// WithLogger configures the logger to report background errors to.
+// Defaults to discarding them.
+func WithLogger(logger *slog.Logger) Opt {
+	return func(c *Cache) error {
+		c.logger = logger
+		return nil
+	}
+}
+
+// Cleanup removes all expired sessions from the directory.
+func (c *Cache) Cleanup(ctx context.Context) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.walk(ctx, func(path string, sf sessionFile, expired bool) error {
+		if !expired {
+			return nil
+		}
+
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("removing expired session: %w", err)
+		}
+		return nil
+	})
+}
+
+// Close stops the periodic cleanup.
+func (c *Cache) Close() error {
+	c.closeOnce.Do(func() { close(c.stop) })
+	<-c.done
+	return nil
+}
+
+// DeleteSession removes the session for the given ID.
+func (c *Cache) DeleteSession(ctx context.Context, id string) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("deleting session: %w", err)
+	}
+
+	return c.RemoveSession(id)
+}
+
+// GetSession returns the session for the given ID.
+func (c *Cache) GetSession(id string) (cache.Session, error) {
+	return c.LoadSession(context.Background(), id)
+}
+
+// ListProviderSessions returns all sessions of the given provider
+// session ID.
+func (c *Cache) ListProviderSessions(ctx context.Context, sid string) (map[string]cache.Session, error) {
+	return c.list(ctx, func(s cache.Session) bool { return s.SID == sid })
+}
+
+// ListSessions returns all sessions of the given subject.
+func (c *Cache) ListSessions(ctx context.Context, sub string) (map[string]cache.Session, error) {
+	return c.list(ctx, func(s cache.Session) bool { return s.Subject == sub })
+}
+
+// LoadSession returns the session for the given ID.
+func (c *Cache) LoadSession(ctx context.Context, id string) (cache.Session, error) {
+	if err := ctx.Err(); err != nil {
+		return cache.Session{}, fmt.Errorf("loading session: %w", err)
+	}
+
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	sf, err := c.read(c.path(id))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return cache.Session{}, cache.ErrSessionNotFound
+		}
+		return cache.Session{}, err
+	}
+
+	if sf.Expires.Before(time.Now()) {
+		return cache.Session{}, cache.ErrSessionNotFound
+	}
+
+	return sf.Session, nil
+}
+
+// RemoveSession removes the session for the given ID.
+func (c *Cache) RemoveSession(id string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if err := os.Remove(c.path(id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("removing session file: %w", err)
+	}
+
+	return nil
+}
+
+// SetSession stores the session for the given ID.
+func (c *Cache) SetSession(id string, sess cache.Session) error {
+	return c.StoreSession(context.Background(), id, sess, 0)
+}
+
+// StoreSession stores the session for the given ID. Without ttl hint
+// the session expires after the configured idle timeout.
+func (c *Cache) StoreSession(ctx context.Context, id string, sess cache.Session, ttl time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("storing session: %w", err)
+	}
+
+	expires := sess.LastSeen.Add(c.idleTimeout)
+	if ttl > 0 {
+		expires = time.Now().Add(ttl)
+	}
+
+	//#nosec:G117 // OAuth tokens are the session payload and must be serialized into the user-only readable file.
+	raw, err := json.Marshal(sessionFile{
+		ID:      id,
+		Expires: expires,
+		Session: sess,
+	})
+	if err != nil {
+		return fmt.Errorf("encoding session: %w", err)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	// Write to a temporary file and rename it to never expose a
+	// partially written session
+	tmp, err := os.CreateTemp(c.dir, ".session-*")
+	if err != nil {
+		return fmt.Errorf("creating temporary file: %w", err)
+	}
+	defer os.Remove(tmp.Name()) //nolint:errcheck // Only fails after successful rename
+
+	// CreateTemp already uses 0o600 but the permissions of the session
+	// files must not depend on that
+	if err = tmp.Chmod(filePerms); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("setting session file permissions: %w", err)
+	}
+
+	if _, err = tmp.Write(raw); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("writing session file: %w", err)
+	}
+
+	if err = tmp.Close(); err != nil {
+		return fmt.Errorf("closing session file: %w", err)
+	}
+
+	if err = os.Rename(tmp.Name(), c.path(id)); err != nil {
+		return fmt.Errorf("replacing session file: %w", err)
+	}
+
+	return nil
+}
+
+func (c *Cache) cleanupLoop() {
+	defer close(c.done)
+
+	t := time.NewTicker(c.cleanupInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-t.C:
+			// The next run will try again
+			if err := c.Cleanup(context.Background()); err != nil {
+				c.logger.Warn("removing expired sessions", slog.String("dir", c.dir), slog.Any("error", err))
+			}
+		}
+	}
+}
+
+func (c *Cache) list(ctx context.Context, match func(cache.Session) bool) (map[string]cache.Session, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	out := make(map[string]cache.Session)
+	err := c.walk(ctx, func(_ string, sf sessionFile, expired bool) error {
+		if !expired && match(sf.Session) {
+			out[sf.ID] = sf.Session
+		}
+		return nil
+	})
+
+	return out, err
+}
+
+// path returns the file name for the given session ID, hashing the ID
+// to get a safe file name
+func (c *Cache) path(id string) string {
+	h := sha256.Sum256([]byte(id))
+	return filepath.Join(c.dir, hex.EncodeToString(h[:])+sessionFileExt)
+}
+
+func (*Cache) read(path string) (sf sessionFile, err error) {
+	raw, err := os.ReadFile(path) //#nosec:G304 // Path is derived from the hashed session ID within the cache directory
+	if err != nil {
+		return sf, fmt.Errorf("reading session file: %w", err)
+	}
+
+	if err = json.Unmarshal(raw, &sf); err != nil {
+		return sf, fmt.Errorf("decoding session file: %w", err)
+	}
+
+	return sf, nil
+}
+
+// walk calls fn for every readable session file in the directory
+// until the context is done, the caller MUST hold the lock
+func (c *Cache) walk(ctx context.Context, fn func(path string, sf sessionFile, expired bool) error) error {
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return fmt.Errorf("reading session directory: %w", err)
+	}
+
+	now := time.Now()
+	for _, e := range entries {
+		if err = ctx.Err(); err != nil {
+			return fmt.Errorf("walking session directory: %w", err)
+		}
+
+		if e.IsDir() || strings.HasPrefix(e.Name(), ".") || filepath.Ext(e.Name()) != sessionFileExt {
+			continue
+		}
+
+		path := filepath.Join(c.dir, e.Name())
+
+		sf, err := c.read(path)
+		if err != nil {
+			if !errors.Is(err, os.ErrNotExist) {
+				// A single broken file must not make all others unusable
+				c.logger.Warn("skipping unreadable session file", slog.String("file", path), slog.Any("error", err))
+			}
+			continue
+		}
+
+		if err = fn(path, sf, sf.Expires.Before(now)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
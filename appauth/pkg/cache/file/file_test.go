@@ -0,0 +1,92 @@
+package file
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Luzifer/go_helpers/appauth/pkg/cache"
+	"github.com/Luzifer/go_helpers/appauth/pkg/cache/cachetest"
+)
+
+func newTestCache(t *testing.T) *Cache {
+	t.Helper()
+
+	c, err := New(WithDirectory(t.TempDir()))
+	require.NoError(t, err)
+	t.Cleanup(func() { assert.NoError(t, c.Close()) })
+
+	return c
+}
+
+func TestConformance(t *testing.T) {
+	cachetest.Run(t, func(t *testing.T) cache.Cache { return newTestCache(t) })
+}
+
+func TestExpiry(t *testing.T) {
+	c := newTestCache(t)
+
+	require.NoError(t, c.SetSession("fresh", cache.Session{LastSeen: time.Now()}))
+	require.NoError(t, c.SetSession("stale", cache.Session{LastSeen: time.Now().Add(-2 * defaultIdleTimeout)}))
+
+	_, err := c.GetSession("stale")
+	require.ErrorIs(t, err, cache.ErrSessionNotFound)
+
+	require.NoError(t, c.Cleanup(t.Context()))
+
+	entries, err := os.ReadDir(c.dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+
+	_, err = c.GetSession("fresh")
+	require.NoError(t, err)
+}
+
+func TestFilePermissions(t *testing.T) {
+	c := newTestCache(t)
+
+	require.NoError(t, c.SetSession("a", cache.Session{LastSeen: time.Now()}))
+
+	info, err := os.Stat(c.path("a"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(filePerms), info.Mode().Perm())
+}
+
+func TestStoreSessionTTL(t *testing.T) {
+	c := newTestCache(t)
+
+	// The ttl hint takes precedence over the idle timeout
+	require.NoError(t, c.StoreSession(t.Context(), "short", cache.Session{LastSeen: time.Now()}, time.Nanosecond))
+	require.NoError(t, c.StoreSession(t.Context(), "long", cache.Session{LastSeen: time.Now().Add(-2 * defaultIdleTimeout)}, time.Hour))
+
+	_, err := c.LoadSession(t.Context(), "short")
+	require.ErrorIs(t, err, cache.ErrSessionNotFound)
+
+	_, err = c.LoadSession(t.Context(), "long")
+	require.NoError(t, err)
+
+	require.NoError(t, c.DeleteSession(t.Context(), "long"))
+	_, err = c.LoadSession(t.Context(), "long")
+	require.ErrorIs(t, err, cache.ErrSessionNotFound)
+}
+
+func TestCloseTwice(t *testing.T) {
+	c := newTestCache(t)
+	require.NoError(t, c.Close())
+}
+
+func TestCorruptFileSkipped(t *testing.T) {
+	c := newTestCache(t)
+
+	require.NoError(t, c.SetSession("a", cache.Session{Subject: "alice", LastSeen: time.Now()}))
+	require.NoError(t, os.WriteFile(c.path("broken"), []byte("{"), filePerms))
+
+	sessions, err := c.ListSessions(t.Context(), "alice")
+	require.NoError(t, err)
+	assert.Len(t, sessions, 1)
+
+	require.NoError(t, c.Cleanup(t.Context()))
+}
@@ -2,40 +2,163 @@
 package mem
 
 import (
+	"context"
 	"sync"
+	"time"
 
 	"github.com/Luzifer/go_helpers/appauth/pkg/cache"
 )
 
+// DefaultJanitorInterval is a reasonable interval for the janitor
+// started through WithJanitorInterval
+const DefaultJanitorInterval = time.Minute
+
 type (
 	// Cache implements a very simple in-memory cache not suitable for
-	// surviving restarts or multi-instance applications
+	// surviving restarts or multi-instance applications. Sessions
+	// exceeding the ttl hint given to StoreSession or the configured
+	// idle / absolute timeouts are treated as missing and evicted by
+	// the janitor if enabled through WithJanitorInterval.
 	Cache struct {
-		sess map[string]*cache.Session
-		lock sync.RWMutex
+		sess      map[string]*entry
+		bySubject index
+		bySID     index
+		lock      sync.RWMutex
+
+		idleTimeout     time.Duration
+		absoluteTimeout time.Duration
+		janitorInterval time.Duration
+
+		stop      chan struct{}
+		done      chan struct{}
+		closeOnce sync.Once
+	}
+
+	// Opt applies configuration to a Cache.
+	Opt func(*Cache)
+
+	// entry holds the session and its deadline derived from the ttl
+	// hint (zero if none was given)
+	entry struct {
+		sess     cache.Session
+		deadline time.Time
 	}
+
+	// index maps a secondary key to the set of session IDs
+	index map[string]map[string]struct{}
 )
 
-var _ cache.Cache = &Cache{}
+var (
+	_ cache.Cache                = &Cache{}
+	_ cache.ProviderSessionIndex = &Cache{}
+	_ cache.SessionStore         = &Cache{}
+	_ cache.SubjectIndex         = &Cache{}
+)
+
+// New creates a new in-mem Cache. The janitor is only started if
+// configured through WithJanitorInterval, Close MUST be called to stop
+// it then.
+func New(opts ...Opt) *Cache {
+	c := &Cache{
+		sess:      make(map[string]*entry),
+		bySubject: make(index),
+		bySID:     make(index),
+
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	if c.janitorInterval > 0 {
+		go c.janitor()
+	} else {
+		close(c.done)
+	}
+
+	return c
+}
+
+// WithAbsoluteTimeout evicts sessions created longer ago than the
+// given duration. Set to 0 (default) to disable.
+func WithAbsoluteTimeout(d time.Duration) Opt {
+	return func(c *Cache) { c.absoluteTimeout = d }
+}
+
+// WithIdleTimeout evicts sessions not seen for the given duration.
+// Set to 0 (default) to disable.
+func WithIdleTimeout(d time.Duration) Opt {
+	return func(c *Cache) { c.idleTimeout = d }
+}
+
+// WithJanitorInterval starts a janitor evicting expired sessions in
+// the given interval (e.g. DefaultJanitorInterval) until Close is
+// called. Without it (or set to 0) expired sessions are only hidden
+// but kept in memory until they are stored or removed again.
+func WithJanitorInterval(d time.Duration) Opt {
+	return func(c *Cache) { c.janitorInterval = d }
+}
+
+// Cleanup evicts all expired sessions
+func (c *Cache) Cleanup() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
 
-// New creates a new in-mem Cache
-func New() *Cache {
-	return &Cache{
-		sess: make(map[string]*cache.Session),
+	now := time.Now()
+	for id, e := range c.sess {
+		if c.expired(e, now) {
+			c.removeSession(id)
+		}
 	}
 }
 
+// Close stops the janitor
+func (c *Cache) Close() error {
+	c.closeOnce.Do(func() { close(c.stop) })
+	<-c.done
+	return nil
+}
+
+// DeleteSession removes the session by its ID from the cache
+func (c *Cache) DeleteSession(_ context.Context, id string) error {
+	return c.RemoveSession(id)
+}
+
 // GetSession returns the session by the given ID or an error
 func (c *Cache) GetSession(id string) (cache.Session, error) {
 	c.lock.RLock()
 	defer c.lock.RUnlock()
 
-	s, ok := c.sess[id]
-	if !ok {
+	e, ok := c.sess[id]
+	if !ok || c.expired(e, time.Now()) {
 		return cache.Session{}, cache.ErrSessionNotFound
 	}
 
-	return *s, nil
+	return e.sess, nil
+}
+
+// ListProviderSessions returns all sessions of the given provider
+// session ID
+func (c *Cache) ListProviderSessions(_ context.Context, sid string) (map[string]cache.Session, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.listIndexed(c.bySID[sid]), nil
+}
+
+// ListSessions returns all sessions of the given subject
+func (c *Cache) ListSessions(_ context.Context, sub string) (map[string]cache.Session, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.listIndexed(c.bySubject[sub]), nil
+}
+
+// LoadSession returns the session by the given ID or an error
+func (c *Cache) LoadSession(_ context.Context, id string) (cache.Session, error) {
+	return c.GetSession(id)
 }
 
 // RemoveSession removes the session by its ID from the cache
@@ -43,15 +166,114 @@ func (c *Cache) RemoveSession(id string) error {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
-	delete(c.sess, id)
+	c.removeSession(id)
 	return nil
 }
 
 // SetSession stores the given session by its ID
 func (c *Cache) SetSession(id string, sess cache.Session) error {
+	return c.StoreSession(context.Background(), id, sess, 0)
+}
+
+// StoreSession stores the given session by its ID and evicts it after
+// the ttl if given
+func (c *Cache) StoreSession(_ context.Context, id string, sess cache.Session, ttl time.Duration) error {
+	e := &entry{sess: sess}
+	if ttl > 0 {
+		e.deadline = time.Now().Add(ttl)
+	}
+
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
-	c.sess[id] = &sess
+	// Drop old index entries in case the subject or sid changed
+	c.removeSession(id)
+
+	c.sess[id] = e
+	c.bySubject.add(sess.Subject, id)
+	c.bySID.add(sess.SID, id)
+
 	return nil
 }
+
+// expired checks the entry against its deadline and the configured
+// timeouts
+func (c *Cache) expired(e *entry, now time.Time) bool {
+	switch {
+	case !e.deadline.IsZero() && now.After(e.deadline):
+		return true
+	case c.idleTimeout > 0 && now.After(e.sess.LastSeen.Add(c.idleTimeout)):
+		return true
+	case c.absoluteTimeout > 0 && now.After(e.sess.CreatedAt.Add(c.absoluteTimeout)):
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *Cache) janitor() {
+	defer close(c.done)
+
+	t := time.NewTicker(c.janitorInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-t.C:
+			c.Cleanup()
+		}
+	}
+}
+
+// listIndexed resolves the unexpired sessions of an index entry, the
+// caller MUST hold the read lock
+func (c *Cache) listIndexed(ids map[string]struct{}) map[string]cache.Session {
+	now := time.Now()
+
+	out := make(map[string]cache.Session, len(ids))
+	for id := range ids {
+		if e := c.sess[id]; !c.expired(e, now) {
+			out[id] = e.sess
+		}
+	}
+
+	return out
+}
+
+// removeSession removes the session and its index entries, the caller
+// MUST hold the write lock
+func (c *Cache) removeSession(id string) {
+	e, ok := c.sess[id]
+	if !ok {
+		return
+	}
+
+	delete(c.sess, id)
+	c.bySubject.remove(e.sess.Subject, id)
+	c.bySID.remove(e.sess.SID, id)
+}
+
+func (i index) add(key, id string) {
+	if key == "" {
+		return
+	}
+
+	if i[key] == nil {
+		i[key] = make(map[string]struct{})
+	}
+	i[key][id] = struct{}{}
+}
+
+func (i index) remove(key, id string) {
+	ids := i[key]
+	if ids == nil {
+		return
+	}
+
+	delete(ids, id)
+	if len(ids) == 0 {
+		delete(i, key)
+	}
+}
@@ -0,0 +1,80 @@
+package mem
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Luzifer/go_helpers/appauth/pkg/cache"
+	"github.com/Luzifer/go_helpers/appauth/pkg/cache/cachetest"
+)
+
+func newTestCache(t *testing.T, opts ...Opt) *Cache {
+	t.Helper()
+
+	c := New(opts...)
+	t.Cleanup(func() { assert.NoError(t, c.Close()) })
+
+	return c
+}
+
+func TestConformance(t *testing.T) {
+	cachetest.Run(t, func(t *testing.T) cache.Cache { return newTestCache(t) })
+}
+
+func TestExpiry(t *testing.T) {
+	c := newTestCache(t,
+		WithAbsoluteTimeout(time.Hour),
+		WithIdleTimeout(time.Minute),
+		WithJanitorInterval(0),
+	)
+	now := time.Now()
+
+	require.NoError(t, c.SetSession("fresh", cache.Session{Subject: "alice", CreatedAt: now, LastSeen: now}))
+	require.NoError(t, c.SetSession("idle", cache.Session{Subject: "alice", CreatedAt: now, LastSeen: now.Add(-2 * time.Minute)}))
+	require.NoError(t, c.SetSession("old", cache.Session{Subject: "alice", CreatedAt: now.Add(-2 * time.Hour), LastSeen: now}))
+	require.NoError(t, c.StoreSession(t.Context(), "ttl", cache.Session{Subject: "alice", CreatedAt: now, LastSeen: now}, time.Nanosecond))
+
+	time.Sleep(time.Millisecond)
+
+	for _, id := range []string{"idle", "old", "ttl"} {
+		_, err := c.LoadSession(t.Context(), id)
+		require.ErrorIs(t, err, cache.ErrSessionNotFound, id)
+	}
+
+	sessions, err := c.ListSessions(t.Context(), "alice")
+	require.NoError(t, err)
+	assert.Len(t, sessions, 1)
+	assert.Contains(t, sessions, "fresh")
+
+	// Without janitor expired sessions are only hidden
+	assert.Len(t, c.sess, 4)
+
+	c.Cleanup()
+	assert.Len(t, c.sess, 1)
+	assert.Len(t, c.bySubject["alice"], 1)
+}
+
+func TestJanitor(t *testing.T) {
+	c := newTestCache(t, WithJanitorInterval(10*time.Millisecond))
+
+	require.NoError(t, c.StoreSession(t.Context(), "a", cache.Session{}, time.Nanosecond))
+
+	assert.Eventually(t, func() bool {
+		c.lock.RLock()
+		defer c.lock.RUnlock()
+		return len(c.sess) == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestNoJanitorByDefault(t *testing.T) {
+	c := New()
+
+	select {
+	case <-c.done:
+	default:
+		t.Fatal("janitor started without WithJanitorInterval")
+	}
+}
@@ -0,0 +1,56 @@
+package mem
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/Luzifer/go_helpers/appauth/pkg/cache"
+)
+
+// replayPruneInterval defines how often expired keys are removed
+const replayPruneInterval = time.Minute
+
+// ReplayCache implements an in-mem cache.ReplayCache. Keys are kept
+// until they expire, so its size depends on the number of keys used
+// within their lifetime.
+type ReplayCache struct {
+	keys      map[string]time.Time
+	lastPrune time.Time
+	lock      sync.Mutex
+}
+
+var _ cache.ReplayCache = &ReplayCache{}
+
+// NewReplayCache creates a new in-mem ReplayCache
+func NewReplayCache() *ReplayCache {
+	return &ReplayCache{
+		keys:      make(map[string]time.Time),
+		lastPrune: time.Now(),
+	}
+}
+
+// UseOnce stores the key until expiry or returns cache.ErrReplayed if
+// it is already stored
+func (c *ReplayCache) UseOnce(_ context.Context, key string, expires time.Time) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := time.Now()
+
+	if now.Sub(c.lastPrune) > replayPruneInterval {
+		for k, exp := range c.keys {
+			if !exp.After(now) {
+				delete(c.keys, k)
+			}
+		}
+		c.lastPrune = now
+	}
+
+	if exp, ok := c.keys[key]; ok && exp.After(now) {
+		return cache.ErrReplayed
+	}
+
+	c.keys[key] = expires
+	return nil
+}
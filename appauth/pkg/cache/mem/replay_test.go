@@ -0,0 +1,22 @@
+package mem
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/Luzifer/go_helpers/appauth/pkg/cache"
+)
+
+func TestReplayCache(t *testing.T) {
+	c := NewReplayCache()
+
+	require.NoError(t, c.UseOnce(t.Context(), "a", time.Now().Add(time.Hour)))
+	require.ErrorIs(t, c.UseOnce(t.Context(), "a", time.Now().Add(time.Hour)), cache.ErrReplayed)
+	require.NoError(t, c.UseOnce(t.Context(), "b", time.Now().Add(time.Hour)))
+
+	// Expired keys may be used again
+	require.NoError(t, c.UseOnce(t.Context(), "c", time.Now().Add(-time.Second)))
+	require.NoError(t, c.UseOnce(t.Context(), "c", time.Now().Add(time.Hour)))
+}
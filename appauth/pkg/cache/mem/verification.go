@@ -0,0 +1,83 @@
+package mem
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/Luzifer/go_helpers/appauth/pkg/cache"
+)
+
+type (
+	// VerificationCache implements a size-limited LRU cache for access
+	// token verification results
+	VerificationCache struct {
+		entries map[string]*list.Element
+		lru     *list.List
+		size    int
+		lock    sync.Mutex
+	}
+
+	verificationEntry struct {
+		key     string
+		data    []byte
+		expires time.Time
+	}
+)
+
+var _ cache.VerificationCache = &VerificationCache{}
+
+// NewVerificationCache creates a new in-mem VerificationCache holding
+// at most size entries (evicting the least recently used ones)
+func NewVerificationCache(size int) *VerificationCache {
+	return &VerificationCache{
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+		size:    max(size, 1),
+	}
+}
+
+// GetVerification returns the verification result by the given key
+// or an error
+func (c *VerificationCache) GetVerification(_ context.Context, key string) ([]byte, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, cache.ErrVerificationNotFound
+	}
+
+	e := el.Value.(*verificationEntry)
+	if !e.expires.After(time.Now()) {
+		c.lru.Remove(el)
+		delete(c.entries, key)
+		return nil, cache.ErrVerificationNotFound
+	}
+
+	c.lru.MoveToFront(el)
+	return e.data, nil
+}
+
+// SetVerification stores the given verification result until expiry
+func (c *VerificationCache) SetVerification(_ context.Context, key string, data []byte, expires time.Time) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		el.Value = &verificationEntry{key: key, data: data, expires: expires}
+		c.lru.MoveToFront(el)
+		return nil
+	}
+
+	c.entries[key] = c.lru.PushFront(&verificationEntry{key: key, data: data, expires: expires})
+
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*verificationEntry).key)
+	}
+
+	return nil
+}
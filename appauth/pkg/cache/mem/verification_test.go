@@ -0,0 +1,41 @@
+package mem
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Luzifer/go_helpers/appauth/pkg/cache"
+)
+
+func TestVerificationCacheEviction(t *testing.T) {
+	c := NewVerificationCache(2)
+	exp := time.Now().Add(time.Hour)
+
+	require.NoError(t, c.SetVerification(t.Context(), "a", []byte("a"), exp))
+	require.NoError(t, c.SetVerification(t.Context(), "b", []byte("b"), exp))
+
+	// Touch a to make b the least recently used entry
+	_, err := c.GetVerification(t.Context(), "a")
+	require.NoError(t, err)
+
+	require.NoError(t, c.SetVerification(t.Context(), "c", []byte("c"), exp))
+
+	_, err = c.GetVerification(t.Context(), "b")
+	require.ErrorIs(t, err, cache.ErrVerificationNotFound)
+
+	data, err := c.GetVerification(t.Context(), "a")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("a"), data)
+}
+
+func TestVerificationCacheExpiry(t *testing.T) {
+	c := NewVerificationCache(2)
+
+	require.NoError(t, c.SetVerification(t.Context(), "a", []byte("a"), time.Now().Add(-time.Second)))
+
+	_, err := c.GetVerification(t.Context(), "a")
+	require.ErrorIs(t, err, cache.ErrVerificationNotFound)
+}
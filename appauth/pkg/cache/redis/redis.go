@@ -3,9 +3,14 @@ package redis
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/redis/go-redis/v9"
@@ -13,26 +18,52 @@ import (
 	"github.com/Luzifer/go_helpers/appauth/pkg/cache"
 )
 
-const defaultIdleTimeout = time.Hour
+const (
+	defaultIdleTimeout = time.Hour
+	lockRetryInterval  = 50 * time.Millisecond
+	lockTokenLength    = 16
+)
+
+// unlockScript releases the lock only if it is still held by the
+// given token to not release a lock acquired by another instance
+// after ours expired
+var unlockScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
 
 type (
-	// Cache stores appauth sessions in a Redis hash.
+	// Cache stores appauth sessions in a Redis hash, sets of session
+	// IDs per subject and provider session and access token
+	// verification results in individual keys next to it.
 	Cache struct {
 		client      *redis.Client
 		idleTimeout time.Duration
 		hashKey     string
+		logger      *slog.Logger
 	}
 
 	// Opt applies configuration to a Cache.
 	Opt func(*Cache) error
 )
 
-var _ cache.Cache = (*Cache)(nil)
+var (
+	_ cache.Cache                = (*Cache)(nil)
+	_ cache.ProviderSessionIndex = (*Cache)(nil)
+	_ cache.ReplayCache          = (*Cache)(nil)
+	_ cache.SessionLocker        = (*Cache)(nil)
+	_ cache.SessionStore         = (*Cache)(nil)
+	_ cache.SubjectIndex         = (*Cache)(nil)
+	_ cache.VerificationCache    = (*Cache)(nil)
+)
 
 // New creates a Redis 8+ or Valkey 9+ backed appauth session cache.
 func New(opts ...Opt) (c *Cache, err error) {
 	c = &Cache{
 		idleTimeout: defaultIdleTimeout,
+		logger:      slog.New(slog.DiscardHandler),
 	}
 
 	for _, opt := range opts {
@@ -53,6 +84,10 @@ func New(opts ...Opt) (c *Cache, err error) {
 		return nil, fmt.Errorf("idle-timeout must be positive duration")
 	}
 
+	if c.logger == nil {
+		return nil, fmt.Errorf("cache initialized without logger")
+	}
+
 	return c, nil
 }
 
@@ -72,6 +107,15 @@ func WithIdleTimeout(d time.Duration) Opt {
 	}
 }
 
+// WithLogger configures the logger to report background errors to.
+// Defaults to discarding them.
+func WithLogger(logger *slog.Logger) Opt {
+	return func(c *Cache) error {
+		c.logger = logger
+		return nil
+	}
+}
+
 // WithRedisClient configures the Redis client used by the cache.
 func WithRedisClient(client *redis.Client) Opt {
 	return func(c *Cache) error {
@@ -80,9 +124,62 @@ func WithRedisClient(client *redis.Client) Opt {
 	}
 }
 
+// DeleteSession removes the session for the given ID.
+func (c Cache) DeleteSession(ctx context.Context, id string) (err error) {
+	// We need the subject and sid to clean up the indexes
+	s, err := c.LoadSession(ctx, id)
+	if err != nil {
+		if errors.Is(err, cache.ErrSessionNotFound) {
+			return nil
+		}
+		return fmt.Errorf("getting session: %w", err)
+	}
+
+	if _, err = c.client.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		p.HDel(ctx, c.hashKey, id)
+		for _, key := range c.indexKeys(s) {
+			p.SRem(ctx, key, id)
+		}
+		return nil
+	}); err != nil {
+		return fmt.Errorf("deleting session: %w", err)
+	}
+
+	return nil
+}
+
 // GetSession returns the session for the given ID.
-func (c Cache) GetSession(id string) (s cache.Session, err error) {
-	rawSess, err := c.client.HGet(context.TODO(), c.hashKey, id).Bytes()
+func (c Cache) GetSession(id string) (cache.Session, error) {
+	return c.LoadSession(context.Background(), id)
+}
+
+// GetVerification returns the verification result for the given key.
+func (c Cache) GetVerification(ctx context.Context, key string) (data []byte, err error) {
+	data, err = c.client.Get(ctx, c.verificationKey(key)).Bytes()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return nil, cache.ErrVerificationNotFound
+		}
+		return nil, fmt.Errorf("getting verification: %w", err)
+	}
+
+	return data, nil
+}
+
+// ListProviderSessions returns all sessions of the given provider
+// session ID.
+func (c Cache) ListProviderSessions(ctx context.Context, sid string) (map[string]cache.Session, error) {
+	return c.listIndexed(ctx, c.indexKey("sid", sid))
+}
+
+// ListSessions returns all sessions of the given subject.
+func (c Cache) ListSessions(ctx context.Context, sub string) (map[string]cache.Session, error) {
+	return c.listIndexed(ctx, c.indexKey("subject", sub))
+}
+
+// LoadSession returns the session for the given ID.
+func (c Cache) LoadSession(ctx context.Context, id string) (s cache.Session, err error) {
+	rawSess, err := c.client.HGet(ctx, c.hashKey, id).Bytes()
 	if err != nil {
 		if errors.Is(err, redis.Nil) {
 			return s, cache.ErrSessionNotFound
@@ -97,29 +194,209 @@ func (c Cache) GetSession(id string) (s cache.Session, err error) {
 	return s, nil
 }
 
+// LockSession acquires the lock for the given session ID shared
+// between all instances using the same Redis.
+func (c Cache) LockSession(ctx context.Context, id string, ttl time.Duration) (func() error, error) {
+	rawToken := make([]byte, lockTokenLength)
+	if _, err := rand.Read(rawToken); err != nil {
+		return nil, fmt.Errorf("generating lock token: %w", err)
+	}
+	token := hex.EncodeToString(rawToken)
+
+	key := c.lockKey(id)
+	ticker := time.NewTicker(lockRetryInterval)
+	defer ticker.Stop()
+
+	for {
+		acquired, err := c.client.SetNX(ctx, key, token, ttl).Result()
+		if err != nil {
+			return nil, fmt.Errorf("acquiring lock: %w", err)
+		}
+
+		if acquired {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("waiting for lock: %w", ctx.Err())
+		case <-ticker.C:
+		}
+	}
+
+	return func() error {
+		if err := unlockScript.Run(context.Background(), c.client, []string{key}, token).Err(); err != nil {
+			return fmt.Errorf("releasing lock: %w", err)
+		}
+		return nil
+	}, nil
+}
+
 // RemoveSession removes the session for the given ID.
-func (c Cache) RemoveSession(id string) (err error) {
-	if err = c.client.HDel(context.TODO(), c.hashKey, id).Err(); err != nil {
-		return fmt.Errorf("deleting hash-key field: %w", err)
+func (c Cache) RemoveSession(id string) error {
+	return c.DeleteSession(context.Background(), id)
+}
+
+// SetSession stores the session for the given ID.
+func (c Cache) SetSession(id string, sess cache.Session) error {
+	return c.StoreSession(context.Background(), id, sess, 0)
+}
+
+// SetVerification stores the verification result for the given key
+// until the given expiry.
+func (c Cache) SetVerification(ctx context.Context, key string, data []byte, expires time.Time) (err error) {
+	if err = c.client.SetArgs(ctx, c.verificationKey(key), data, redis.SetArgs{
+		ExpireAt: expires,
+	}).Err(); err != nil {
+		return fmt.Errorf("storing verification: %w", err)
 	}
 
 	return nil
 }
 
-// SetSession stores the session for the given ID.
-func (c Cache) SetSession(id string, sess cache.Session) (err error) {
+// StoreSession stores the session for the given ID. Without ttl hint
+// the session expires after the configured idle timeout.
+func (c Cache) StoreSession(ctx context.Context, id string, sess cache.Session, ttl time.Duration) (err error) {
 	//#nosec:G117 // OAuth tokens are the session payload and must be serialized into the protected Redis cache.
 	rawSess, err := json.Marshal(sess)
 	if err != nil {
 		return fmt.Errorf("encoding session: %w", err)
 	}
 
-	if err = c.client.HSetEXWithArgs(context.TODO(), c.hashKey, &redis.HSetEXOptions{
-		ExpirationType: redis.HSetEXExpirationEXAT,
-		ExpirationVal:  sess.LastSeen.Add(c.idleTimeout).Unix(),
-	}, id, string(rawSess)).Err(); err != nil {
+	expiresAt := sess.LastSeen.Add(c.idleTimeout)
+	if ttl > 0 {
+		expiresAt = time.Now().Add(ttl)
+	}
+
+	// Index entries of the previous version need to be dropped in case
+	// the subject or sid changed
+	prev, err := c.LoadSession(ctx, id)
+	if err != nil && !errors.Is(err, cache.ErrSessionNotFound) {
+		return fmt.Errorf("getting previous session: %w", err)
+	}
+	newKeys := c.indexKeys(sess)
+
+	if _, err = c.client.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		for _, key := range c.indexKeys(prev) {
+			if !slices.Contains(newKeys, key) {
+				p.SRem(ctx, key, id)
+			}
+		}
+
+		p.HSetEXWithArgs(ctx, c.hashKey, &redis.HSetEXOptions{
+			ExpirationType: redis.HSetEXExpirationEXAT,
+			ExpirationVal:  expiresAt.Unix(),
+		}, id, string(rawSess))
+
+		for _, key := range newKeys {
+			p.SAdd(ctx, key, id)
+			// Keep the index as long as the longest living session: NX
+			// sets the TTL on a new index, GT only ever extends it
+			p.ExpireNX(ctx, key, time.Until(expiresAt))
+			p.ExpireGT(ctx, key, time.Until(expiresAt))
+		}
+		return nil
+	}); err != nil {
 		return fmt.Errorf("storing session: %w", err)
 	}
 
 	return nil
 }
+
+// UseOnce stores the key until expiry or returns cache.ErrReplayed if
+// it is already stored.
+func (c Cache) UseOnce(ctx context.Context, key string, expires time.Time) error {
+	err := c.client.SetArgs(ctx, c.replayKey(key), 1, redis.SetArgs{
+		Mode:     "NX",
+		ExpireAt: expires,
+	}).Err()
+
+	switch {
+	case errors.Is(err, redis.Nil):
+		return cache.ErrReplayed
+	case err != nil:
+		return fmt.Errorf("storing replay key: %w", err)
+	default:
+		return nil
+	}
+}
+
+// indexKey derives the key of a secondary session index from the
+// configured hash-key
+func (c Cache) indexKey(kind, value string) string {
+	return strings.Join([]string{c.hashKey, kind, value}, ":")
+}
+
+// indexKeys returns the keys of all indexes the session belongs to
+func (c Cache) indexKeys(s cache.Session) (keys []string) {
+	if s.Subject != "" {
+		keys = append(keys, c.indexKey("subject", s.Subject))
+	}
+	if s.SID != "" {
+		keys = append(keys, c.indexKey("sid", s.SID))
+	}
+	return keys
+}
+
+// listIndexed returns all sessions referenced by the index set and
+// prunes references to expired sessions from it
+func (c Cache) listIndexed(ctx context.Context, indexKey string) (map[string]cache.Session, error) {
+	ids, err := c.client.SMembers(ctx, indexKey).Result()
+	if err != nil {
+		return nil, fmt.Errorf("listing indexed sessions: %w", err)
+	}
+
+	out := make(map[string]cache.Session, len(ids))
+	if len(ids) == 0 {
+		return out, nil
+	}
+
+	rawSessions, err := c.client.HMGet(ctx, c.hashKey, ids...).Result()
+	if err != nil {
+		return nil, fmt.Errorf("getting sessions: %w", err)
+	}
+
+	var expired []any
+	for i, raw := range rawSessions {
+		rawSess, ok := raw.(string)
+		if !ok {
+			// Session field expired, index entry is stale
+			expired = append(expired, ids[i])
+			continue
+		}
+
+		var s cache.Session
+		if err = json.Unmarshal([]byte(rawSess), &s); err != nil {
+			return nil, fmt.Errorf("decoding stored session: %w", err)
+		}
+		out[ids[i]] = s
+	}
+
+	if len(expired) > 0 {
+		// Stale entries are skipped anyway, so pruning is best effort
+		if err = c.client.SRem(ctx, indexKey, expired...).Err(); err != nil {
+			c.logger.Warn("pruning session index", slog.String("key", indexKey), slog.Any("error", err))
+		}
+	}
+
+	return out, nil
+}
+
+// lockKey derives the key of the session lock from the configured
+// hash-key
+func (c Cache) lockKey(id string) string {
+	return strings.Join([]string{c.hashKey, "lock", id}, ":")
+}
+
+// replayKey derives the key for one-time identifiers from the
+// configured hash-key
+func (c Cache) replayKey(key string) string {
+	return strings.Join([]string{c.hashKey, "replay", key}, ":")
+}
+
+// verificationKey derives the key for verification results from the
+// configured hash-key as they are stored as individual keys to use the
+// Redis key expiry
+func (c Cache) verificationKey(key string) string {
+	return strings.Join([]string{c.hashKey, "verification", key}, ":")
+}
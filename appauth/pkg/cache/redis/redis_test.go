@@ -0,0 +1,52 @@
+package redis
+
+import (
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Luzifer/go_helpers/appauth/pkg/cache"
+	"github.com/Luzifer/go_helpers/appauth/pkg/cache/cachetest"
+)
+
+// TestConformance requires a Redis 8+ or Valkey 9+ server given
+// through the APPAUTH_TEST_REDIS_ADDR environment variable
+func TestConformance(t *testing.T) {
+	addr := os.Getenv("APPAUTH_TEST_REDIS_ADDR")
+	if addr == "" {
+		t.Skip("APPAUTH_TEST_REDIS_ADDR not set")
+	}
+
+	client := redis.NewClient(&redis.Options{Addr: addr})
+	t.Cleanup(func() { assert.NoError(t, client.Close()) })
+
+	cachetest.Run(t, func(t *testing.T) cache.Cache {
+		hashKey := "appauth-test:" + t.Name() + ":" + strconv.FormatInt(time.Now().UnixNano(), 10)
+
+		c, err := New(WithRedisClient(client), WithHashKey(hashKey))
+		require.NoError(t, err)
+
+		return c
+	})
+}
+
+func TestReplayCache(t *testing.T) {
+	addr := os.Getenv("APPAUTH_TEST_REDIS_ADDR")
+	if addr == "" {
+		t.Skip("APPAUTH_TEST_REDIS_ADDR not set")
+	}
+
+	client := redis.NewClient(&redis.Options{Addr: addr})
+	t.Cleanup(func() { assert.NoError(t, client.Close()) })
+
+	c, err := New(WithRedisClient(client), WithHashKey("appauth-test:"+strconv.FormatInt(time.Now().UnixNano(), 10)))
+	require.NoError(t, err)
+
+	require.NoError(t, c.UseOnce(t.Context(), "a", time.Now().Add(time.Minute)))
+	require.ErrorIs(t, c.UseOnce(t.Context(), "a", time.Now().Add(time.Minute)), cache.ErrReplayed)
+}
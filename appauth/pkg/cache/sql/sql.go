@@ -0,0 +1,400 @@
+// Package sql provides a database/sql backed appauth session cache
+// for SQLite and PostgreSQL.
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Luzifer/go_helpers/appauth/pkg/cache"
+)
+
+const (
+	defaultCleanupInterval = 5 * time.Minute
+	defaultIdleTimeout     = time.Hour
+	defaultTableName       = "appauth_sessions"
+)
+
+// Supported SQL dialects
+const (
+	DialectSQLite Dialect = iota
+	DialectPostgres
+)
+
+type (
+	// Cache stores appauth sessions in a SQL table. The schema is
+	// created and migrated on New, sessions unused for the idle timeout
+	// are treated as missing and periodically removed.
+	Cache struct {
+		db              *sql.DB
+		dialect         Dialect
+		table           string
+		idleTimeout     time.Duration
+		cleanupInterval time.Duration
+		logger          *slog.Logger
+
+		stop      chan struct{}
+		done      chan struct{}
+		closeOnce sync.Once
+	}
+
+	// Dialect selects the SQL flavor to use
+	Dialect int
+
+	// Opt applies configuration to a Cache.
+	Opt func(*Cache) error
+)
+
+var (
+	_ cache.Cache                = (*Cache)(nil)
+	_ cache.ProviderSessionIndex = (*Cache)(nil)
+	_ cache.SessionStore         = (*Cache)(nil)
+	_ cache.SubjectIndex         = (*Cache)(nil)
+)
+
+var tableNameRegex = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// migrations contains the schema changes in order of their version,
+// `{table}` is replaced by the configured table name. Existing entries
+// MUST NOT be modified.
+var migrations = []string{
+	`CREATE TABLE {table} (
+		id         TEXT PRIMARY KEY,
+		subject    TEXT NOT NULL DEFAULT '',
+		sid        TEXT NOT NULL DEFAULT '',
+		data       TEXT NOT NULL,
+		expires_at BIGINT NOT NULL
+	)`,
+	`CREATE INDEX {table}_subject_idx ON {table} (subject)`,
+	`CREATE INDEX {table}_sid_idx ON {table} (sid)`,
+	`CREATE INDEX {table}_expires_at_idx ON {table} (expires_at)`,
+}
+
+// New creates a SQL backed appauth session cache, migrates the schema
+// and starts the periodic cleanup of expired sessions. Call Close to
+// stop it. The database connection is not closed by the cache.
+func New(opts ...Opt) (c *Cache, err error) {
+	c = &Cache{
+		cleanupInterval: defaultCleanupInterval,
+		idleTimeout:     defaultIdleTimeout,
+		logger:          slog.New(slog.DiscardHandler),
+		table:           defaultTableName,
+		stop:            make(chan struct{}),
+		done:            make(chan struct{}),
+	}
+
+	for _, opt := range opts {
+		if err = opt(c); err != nil {
+			return nil, fmt.Errorf("applying option: %w", err)
+		}
+	}
+
+	if c.db == nil {
+		return nil, fmt.Errorf("cache initialized without database")
+	}
+
+	if !tableNameRegex.MatchString(c.table) {
+		return nil, fmt.Errorf("invalid table name %q", c.table)
+	}
+
+	if c.idleTimeout <= 0 {
+		return nil, fmt.Errorf("idle-timeout must be positive duration")
+	}
+
+	if c.cleanupInterval <= 0 {
+		return nil, fmt.Errorf("cleanup-interval must be positive duration")
+	}
+
+	if c.logger == nil {
+		return nil, fmt.Errorf("cache initialized without logger")
+	}
+
+	if err = c.migrate(context.Background()); err != nil {
+		return nil, fmt.Errorf("migrating schema: %w", err)
+	}
+
+	go c.cleanupLoop()
+
+	return c, nil
+}
+
+// WithCleanupInterval configures how often expired sessions are
+// removed from the table.
+func WithCleanupInterval(d time.Duration) Opt {
+	return func(c *Cache) error {
+		c.cleanupInterval = d
+		return nil
+	}
+}
+
+// WithDB configures the database and its dialect used by the cache.
+func WithDB(db *sql.DB, dialect Dialect) Opt {
+	return func(c *Cache) error {
+		switch dialect {
+		case DialectPostgres, DialectSQLite:
+		default:
+			return fmt.Errorf("unknown dialect %d", dialect)
+		}
+
+		c.db = db
+		c.dialect = dialect
+		return nil
+	}
+}
+
+// WithIdleTimeout configures how long an unused session is retained.
+func WithIdleTimeout(d time.Duration) Opt {
+	return func(c *Cache) error {
+		c.idleTimeout = d
+		return nil
+	}
+}
+
+// WithLogger configures the logger to report background errors to.
+// Defaults to discarding them.
+func WithLogger(logger *slog.Logger) Opt {
+	return func(c *Cache) error {
+		c.logger = logger
+		return nil
+	}
+}
+
+// WithTableName configures the table to store the sessions in, the
+// schema version is stored in a table with `_schema` suffix.
+func WithTableName(table string) Opt {
+	return func(c *Cache) error {
+		c.table = table
+		return nil
+	}
+}
+
+// Cleanup removes all expired sessions from the table.
+func (c *Cache) Cleanup(ctx context.Context) error {
+	if _, err := c.db.ExecContext(ctx, c.query(
+		`DELETE FROM {table} WHERE expires_at <= {1}`,
+	), time.Now().Unix()); err != nil {
+		return fmt.Errorf("removing expired sessions: %w", err)
+	}
+
+	return nil
+}
+
+// Close stops the periodic cleanup.
+func (c *Cache) Close() error {
+	c.closeOnce.Do(func() { close(c.stop) })
+	<-c.done
+	return nil
+}
+
+// DeleteSession removes the session for the given ID.
+func (c *Cache) DeleteSession(ctx context.Context, id string) error {
+	if _, err := c.db.ExecContext(ctx, c.query(
+		`DELETE FROM {table} WHERE id = {1}`,
+	), id); err != nil {
+		return fmt.Errorf("deleting session: %w", err)
+	}
+
+	return nil
+}
+
+// GetSession returns the session for the given ID.
+func (c *Cache) GetSession(id string) (cache.Session, error) {
+	return c.LoadSession(context.Background(), id)
+}
+
+// ListProviderSessions returns all sessions of the given provider
+// session ID.
+func (c *Cache) ListProviderSessions(ctx context.Context, sid string) (map[string]cache.Session, error) {
+	return c.list(ctx, `sid`, sid)
+}
+
+// ListSessions returns all sessions of the given subject.
+func (c *Cache) ListSessions(ctx context.Context, sub string) (map[string]cache.Session, error) {
+	return c.list(ctx, `subject`, sub)
+}
+
+// LoadSession returns the session for the given ID.
+func (c *Cache) LoadSession(ctx context.Context, id string) (s cache.Session, err error) {
+	var raw string
+
+	err = c.db.QueryRowContext(ctx, c.query(
+		`SELECT data FROM {table} WHERE id = {1} AND expires_at > {2}`,
+	), id, time.Now().Unix()).Scan(&raw)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return s, cache.ErrSessionNotFound
+	case err != nil:
+		return s, fmt.Errorf("getting session: %w", err)
+	}
+
+	if err = json.Unmarshal([]byte(raw), &s); err != nil {
+		return s, fmt.Errorf("decoding stored session: %w", err)
+	}
+
+	return s, nil
+}
+
+// RemoveSession removes the session for the given ID.
+func (c *Cache) RemoveSession(id string) error {
+	return c.DeleteSession(context.Background(), id)
+}
+
+// SetSession stores the session for the given ID.
+func (c *Cache) SetSession(id string, sess cache.Session) error {
+	return c.StoreSession(context.Background(), id, sess, 0)
+}
+
+// StoreSession stores the session for the given ID. Without ttl hint
+// the session expires after the configured idle timeout.
+func (c *Cache) StoreSession(ctx context.Context, id string, sess cache.Session, ttl time.Duration) error {
+	//#nosec:G117 // OAuth tokens are the session payload and must be serialized into the protected database.
+	raw, err := json.Marshal(sess)
+	if err != nil {
+		return fmt.Errorf("encoding session: %w", err)
+	}
+
+	expiresAt := sess.LastSeen.Add(c.idleTimeout)
+	if ttl > 0 {
+		expiresAt = time.Now().Add(ttl)
+	}
+
+	if _, err = c.db.ExecContext(ctx, c.query(
+		`INSERT INTO {table} (id, subject, sid, data, expires_at) VALUES ({1}, {2}, {3}, {4}, {5})
+		ON CONFLICT (id) DO UPDATE SET
+			subject = excluded.subject,
+			sid = excluded.sid,
+			data = excluded.data,
+			expires_at = excluded.expires_at`,
+	), id, sess.Subject, sess.SID, string(raw), expiresAt.Unix()); err != nil {
+		return fmt.Errorf("storing session: %w", err)
+	}
+
+	return nil
+}
+
+func (c *Cache) cleanupLoop() {
+	defer close(c.done)
+
+	t := time.NewTicker(c.cleanupInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-t.C:
+			// The next run will try again
+			if err := c.Cleanup(context.Background()); err != nil {
+				c.logger.Warn("removing expired sessions", slog.String("table", c.table), slog.Any("error", err))
+			}
+		}
+	}
+}
+
+// list returns all unexpired sessions having the given value in the
+// given (fixed, non-user-supplied) column
+func (c *Cache) list(ctx context.Context, column, value string) (map[string]cache.Session, error) {
+	rows, err := c.db.QueryContext(ctx, c.query(
+		`SELECT id, data FROM {table} WHERE `+column+` = {1} AND expires_at > {2}`, //#nosec:G202 // Column is a constant of the caller
+	), value, time.Now().Unix())
+	if err != nil {
+		return nil, fmt.Errorf("listing sessions: %w", err)
+	}
+	defer rows.Close() //nolint:errcheck // Errors are reported through rows.Err
+
+	out := make(map[string]cache.Session)
+	for rows.Next() {
+		var (
+			id, raw string
+			s       cache.Session
+		)
+
+		if err = rows.Scan(&id, &raw); err != nil {
+			return nil, fmt.Errorf("scanning session: %w", err)
+		}
+
+		if err = json.Unmarshal([]byte(raw), &s); err != nil {
+			return nil, fmt.Errorf("decoding stored session: %w", err)
+		}
+
+		out[id] = s
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterating sessions: %w", err)
+	}
+
+	return out, nil
+}
+
+// migrate applies all migrations not yet applied to the database
+// within a transaction
+func (c *Cache) migrate(ctx context.Context) (err error) {
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("starting transaction: %w", err)
+	}
+	defer tx.Rollback() //nolint:errcheck // No-op after successful commit
+
+	if _, err = tx.ExecContext(ctx, c.query(
+		`CREATE TABLE IF NOT EXISTS {table}_schema (version INTEGER NOT NULL)`,
+	)); err != nil {
+		return fmt.Errorf("creating schema table: %w", err)
+	}
+
+	var version int
+	if err = tx.QueryRowContext(ctx, c.query(
+		`SELECT COALESCE(MAX(version), 0) FROM {table}_schema`,
+	)).Scan(&version); err != nil {
+		return fmt.Errorf("getting schema version: %w", err)
+	}
+
+	for i := version; i < len(migrations); i++ {
+		if _, err = tx.ExecContext(ctx, c.query(migrations[i])); err != nil {
+			return fmt.Errorf("applying migration %d: %w", i+1, err)
+		}
+	}
+
+	if version < len(migrations) {
+		if _, err = tx.ExecContext(ctx, c.query(`DELETE FROM {table}_schema`)); err != nil {
+			return fmt.Errorf("clearing schema version: %w", err)
+		}
+
+		if _, err = tx.ExecContext(ctx, c.query(
+			`INSERT INTO {table}_schema (version) VALUES ({1})`,
+		), len(migrations)); err != nil {
+			return fmt.Errorf("storing schema version: %w", err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("committing migration: %w", err)
+	}
+
+	return nil
+}
+
+// query replaces the `{table}` and `{n}` placeholders in the query
+// with the validated table name and the placeholders of the dialect
+func (c *Cache) query(q string) string {
+	q = strings.ReplaceAll(q, "{table}", c.table)
+
+	for i := 1; strings.Contains(q, "{"+strconv.Itoa(i)+"}"); i++ {
+		ph := "?"
+		if c.dialect == DialectPostgres {
+			ph = "$" + strconv.Itoa(i)
+		}
+		q = strings.ReplaceAll(q, "{"+strconv.Itoa(i)+"}", ph)
+	}
+
+	return q
+}
@@ -0,0 +1,90 @@
+package sql
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	_ "modernc.org/sqlite"
+
+	"github.com/Luzifer/go_helpers/appauth/pkg/cache"
+	"github.com/Luzifer/go_helpers/appauth/pkg/cache/cachetest"
+)
+
+func newTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "sessions.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { assert.NoError(t, db.Close()) })
+
+	return db
+}
+
+func newTestCache(t *testing.T, db *sql.DB) *Cache {
+	t.Helper()
+
+	c, err := New(WithDB(db, DialectSQLite))
+	require.NoError(t, err)
+	t.Cleanup(func() { assert.NoError(t, c.Close()) })
+
+	return c
+}
+
+func TestConformance(t *testing.T) {
+	cachetest.Run(t, func(t *testing.T) cache.Cache { return newTestCache(t, newTestDB(t)) })
+}
+
+func TestExpiry(t *testing.T) {
+	db := newTestDB(t)
+	c := newTestCache(t, db)
+
+	require.NoError(t, c.SetSession("fresh", cache.Session{LastSeen: time.Now()}))
+	require.NoError(t, c.SetSession("stale", cache.Session{LastSeen: time.Now().Add(-2 * defaultIdleTimeout)}))
+
+	_, err := c.GetSession("stale")
+	require.ErrorIs(t, err, cache.ErrSessionNotFound)
+
+	require.NoError(t, c.Cleanup(t.Context()))
+
+	var count int
+	require.NoError(t, db.QueryRow(`SELECT COUNT(*) FROM appauth_sessions`).Scan(&count))
+	assert.Equal(t, 1, count)
+}
+
+func TestMigrationIdempotent(t *testing.T) {
+	db := newTestDB(t)
+
+	c := newTestCache(t, db)
+	require.NoError(t, c.SetSession("a", cache.Session{LastSeen: time.Now()}))
+
+	// A second instance (or restart) must keep the existing data
+	c = newTestCache(t, db)
+	_, err := c.GetSession("a")
+	require.NoError(t, err)
+
+	var version int
+	require.NoError(t, db.QueryRow(`SELECT version FROM appauth_sessions_schema`).Scan(&version))
+	assert.Equal(t, len(migrations), version)
+}
+
+func TestQueryPlaceholders(t *testing.T) {
+	c := &Cache{table: "sessions", dialect: DialectPostgres}
+	assert.Equal(t, "SELECT data FROM sessions WHERE id = $1 AND x = $2", c.query("SELECT data FROM {table} WHERE id = {1} AND x = {2}"))
+
+	c.dialect = DialectSQLite
+	assert.Equal(t, "SELECT data FROM sessions WHERE id = ? AND x = ?", c.query("SELECT data FROM {table} WHERE id = {1} AND x = {2}"))
+}
+
+func TestInvalidTableName(t *testing.T) {
+	_, err := New(WithDB(newTestDB(t), DialectSQLite), WithTableName("sessions; DROP TABLE x"))
+	require.Error(t, err)
+}
+
+func TestCloseTwice(t *testing.T) {
+	c := newTestCache(t, newTestDB(t))
+	require.NoError(t, c.Close())
+}
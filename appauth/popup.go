@@ -1,58 +1,195 @@
 package appauth
 
 import (
-	_ "embed"
+	"bytes"
+	"embed"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
-	"io"
+	"io/fs"
+	"log/slog"
+	"maps"
 	"net/http"
+
+	httpHelper "github.com/Luzifer/go_helpers/http"
+)
+
+const (
+	closePageTemplate       = "closePage.html.gotmpl"
+	cspNonceLength          = 16
+	postMessagePageTemplate = "postMessagePage.html.gotmpl"
+)
+
+// Codes of the messages shown to the user when the login flows fail,
+// passed to the close page template to allow localizing them
+const (
+	MessageBadCallback      MessageCode = "bad_callback"
+	MessageBadState         MessageCode = "bad_state"
+	MessageBadVerifier      MessageCode = "bad_verifier"
+	MessageExchangeFailed   MessageCode = "exchange_failed"
+	MessageInvalidToken     MessageCode = "invalid_token"
+	MessageLoginFailed      MessageCode = "login_failed"
+	MessageOriginNotAllowed MessageCode = "origin_not_allowed"
+	MessageSessionFailed    MessageCode = "session_failed"
+)
+
+type (
+	// MessageCode identifies a message shown to the user by the login
+	// flows (see Config.PopupTemplates)
+	MessageCode string
+
+	// popupTemplates holds the parsed pages of the popup flow
+	popupTemplates struct {
+		closePage       *template.Template
+		postMessagePage *template.Template
+	}
 )
 
 var (
-	//go:embed closePage.html.gotmpl
-	closePage string
-	//go:embed postMessagePage.html.gotmpl
-	postMessagePage string
+	//go:embed closePage.html.gotmpl postMessagePage.html.gotmpl
+	embeddedTemplates embed.FS
+
+	messages = map[MessageCode]string{
+		MessageBadCallback:      "Bad callback.",
+		MessageBadState:         "Bad state.",
+		MessageBadVerifier:      "Bad verifier.",
+		MessageExchangeFailed:   "Exchange failed.",
+		MessageInvalidToken:     "Invalid token.",
+		MessageLoginFailed:      "Login failed.",
+		MessageOriginNotAllowed: "Origin not allowed.",
+		MessageSessionFailed:    "Creating session failed.",
+	}
 )
 
-func renderTemplate(w io.Writer, tpl string, fields any) error {
-	t, err := template.New("").Funcs(template.FuncMap{
-		"toJSON": func(data any) (template.JS, error) {
-			render, err := json.Marshal(data)
-			if err != nil {
-				return "", fmt.Errorf("marshalling JSON: %w", err)
+// parsePopupTemplates parses the pages of the popup flow from the
+// given FS (nil for none) falling back to the embedded templates for
+// files missing in it
+func parsePopupTemplates(fsys fs.FS) (popupTemplates, error) {
+	parse := func(name string) (*template.Template, error) {
+		var src fs.FS = embeddedTemplates
+		if fsys != nil {
+			_, err := fs.Stat(fsys, name)
+			switch {
+			case err == nil:
+				src = fsys
+			case !errors.Is(err, fs.ErrNotExist):
+				return nil, fmt.Errorf("checking template %s: %w", name, err)
 			}
-			return template.JS(render), nil //#nosec:G203 // JSON is program made
-		},
-	}).Parse(tpl)
-	if err != nil {
-		return fmt.Errorf("parsing template: %w", err)
+		}
+
+		t, err := template.New(name).Funcs(template.FuncMap{
+			"toJSON": func(data any) (template.JS, error) {
+				render, err := json.Marshal(data)
+				if err != nil {
+					return "", fmt.Errorf("marshalling JSON: %w", err)
+				}
+				return template.JS(render), nil //#nosec:G203 // JSON is program made
+			},
+		}).ParseFS(src, name)
+		if err != nil {
+			return nil, fmt.Errorf("parsing template %s: %w", name, err)
+		}
+
+		return t, nil
+	}
+
+	var (
+		tpls popupTemplates
+		err  error
+	)
+
+	if tpls.closePage, err = parse(closePageTemplate); err != nil {
+		return tpls, err
 	}
 
-	if err = t.Execute(w, fields); err != nil {
-		return fmt.Errorf("rendering template: %w", err)
+	if tpls.postMessagePage, err = parse(postMessagePageTemplate); err != nil {
+		return tpls, err
 	}
 
-	return nil
+	return tpls, nil
+}
+
+// Message returns the default (English) message for the code
+func (c MessageCode) Message() string {
+	return messages[c]
 }
 
-func writeClosePage(w http.ResponseWriter, msg string) {
+// popupCSP builds the Content-Security-Policy of the popup pages
+// allowing the inline scripts carrying the nonce
+func (a *Auth) popupCSP(nonce string) string {
+	if a.cfg.PopupCSP != nil {
+		return a.cfg.PopupCSP(nonce)
+	}
+
+	csp := httpHelper.CSP{
+		"default-src":     {httpHelper.CSPSrcNone},
+		"frame-ancestors": {httpHelper.CSPSrcNone},
+	}
+	csp.Add("script-src", httpHelper.CSPSrcNonce(nonce))
+
+	return csp.ToHeaderValue()
+}
+
+// popupTemplates returns the pages of the popup flow
+func (a *Auth) popupTemplates() popupTemplates {
+	if a.templates.closePage == nil {
+		// Auth was not created through New, the embedded templates are
+		// known to parse
+		tpls, _ := parsePopupTemplates(nil)
+		return tpls
+	}
+
+	return a.templates
+}
+
+// writeClosePage renders the page showing the message of the code and
+// closing the popup
+func (a *Auth) writeClosePage(w http.ResponseWriter, code MessageCode) {
+	a.writePopupPage(w, a.popupTemplates().closePage, map[string]any{
+		"code":    code,
+		"message": code.Message(),
+	})
+}
+
+// writePopupPage renders the given page with a fresh CSP nonce added
+// to the fields
+func (a *Auth) writePopupPage(w http.ResponseWriter, tpl *template.Template, fields map[string]any) {
+	nonce, err := randB64(cspNonceLength)
+	if err != nil {
+		http.Error(w, "nonce", http.StatusInternalServerError)
+		return
+	}
+	fields["nonce"] = nonce
+
+	// Render into a buffer to not send a partial page on errors
+	buf := new(bytes.Buffer)
+	if err = tpl.Execute(buf, fields); err != nil {
+		a.log().Error("rendering popup page", slog.String("template", tpl.Name()), slog.Any("error", err))
+		http.Error(w, "rendering page", http.StatusInternalServerError)
+		return
+	}
+
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", a.popupCSP(nonce))
 
 	// Avoid caching a token/error page
 	w.Header().Set("Cache-Control", "no-store")
 	w.Header().Set("Pragma", "no-cache")
 
-	_ = renderTemplate(w, closePage, map[string]string{"message": msg})
+	_, _ = buf.WriteTo(w)
 }
 
-func writePostMessageAndClose(w http.ResponseWriter, targetOrigin string, token string, user *User) {
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	w.Header().Set("Cache-Control", "no-store")
-	w.Header().Set("Pragma", "no-cache")
+// writePostMessageAndClose renders the page passing the session to the
+// opener through postMessage and closing the popup
+func (a *Auth) writePostMessageAndClose(w http.ResponseWriter, r *http.Request, targetOrigin string, token string, user *User) {
+	extra := make(map[string]any)
+	if a.cfg.PostMessageFields != nil {
+		maps.Copy(extra, a.cfg.PostMessageFields(r, user))
+	}
 
-	_ = renderTemplate(w, postMessagePage, map[string]any{
+	a.writePopupPage(w, a.popupTemplates().postMessagePage, map[string]any{
+		"fields": extra,
 		"token":  token,
 		"origin": targetOrigin,
 		"user":   user,
@@ -0,0 +1,132 @@
+package appauth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+
+	"github.com/Luzifer/go_helpers/appauth/pkg/cache"
+	"github.com/Luzifer/go_helpers/appauth/pkg/cache/mem"
+)
+
+var cspNonce = regexp.MustCompile(`'nonce-([^']+)'`)
+
+func TestPopupPages(t *testing.T) {
+	tpls, err := parsePopupTemplates(fstest.MapFS{
+		closePageTemplate: {Data: []byte(`<p data-code="{{ .code }}">{{ .message }}</p><script nonce="{{ .nonce }}"></script>`)},
+	})
+	require.NoError(t, err)
+
+	a := &Auth{
+		cfg: Config{
+			PostMessageFields: func(_ *http.Request, u *User) map[string]any {
+				return map[string]any{"expires_at": 1700000000, "name": u.Name}
+			},
+		},
+		templates: tpls,
+	}
+
+	rec := httptest.NewRecorder()
+	a.writeClosePage(rec, MessageBadState)
+
+	m := cspNonce.FindStringSubmatch(rec.Header().Get("Content-Security-Policy"))
+	require.Len(t, m, 2)
+	assert.Equal(t, "default-src 'none';frame-ancestors 'none';script-src 'nonce-"+m[1]+"'", rec.Header().Get("Content-Security-Policy"))
+	assert.Equal(t, `<p data-code="bad_state">Bad state.</p><script nonce="`+m[1]+`"></script>`, rec.Body.String())
+	assert.Equal(t, "no-store", rec.Header().Get("Cache-Control"))
+
+	// The post message page is not replaced and falls back to the
+	// built-in one
+	rec = httptest.NewRecorder()
+	a.writePostMessageAndClose(rec, httptest.NewRequest(http.MethodGet, "/popup", nil), "https://app.example.com", "sess", &User{Sub: "abc", Name: "Jane"})
+
+	m = cspNonce.FindStringSubmatch(rec.Header().Get("Content-Security-Policy"))
+	require.Len(t, m, 2)
+	assert.Contains(t, rec.Body.String(), `<script nonce="`+m[1]+`">`)
+	assert.Contains(t, rec.Body.String(), `Object.assign({"expires_at":1700000000,"name":"Jane"}`)
+	assert.Contains(t, rec.Body.String(), `token: "sess"`)
+}
+
+func TestPopupPagesDefaults(t *testing.T) {
+	a := &Auth{
+		cfg: Config{
+			PopupCSP: func(nonce string) string { return "script-src 'self' 'nonce-" + nonce + "'" },
+		},
+	}
+
+	first := httptest.NewRecorder()
+	a.writeClosePage(first, MessageOriginNotAllowed)
+	assert.Contains(t, first.Body.String(), "Origin not allowed.")
+	assert.Regexp(t, `^script-src 'self' 'nonce-[^']+'$`, first.Header().Get("Content-Security-Policy"))
+
+	second := httptest.NewRecorder()
+	a.writeClosePage(second, MessageOriginNotAllowed)
+	assert.NotEqual(t, first.Header().Get("Content-Security-Policy"), second.Header().Get("Content-Security-Policy"), "nonce is reused")
+}
+
+func TestParsePopupTemplatesInvalid(t *testing.T) {
+	_, err := parsePopupTemplates(fstest.MapFS{
+		postMessagePageTemplate: {Data: []byte(`{{ .token`)},
+	})
+	require.Error(t, err)
+}
+
+func TestPopupCallback(t *testing.T) {
+	accessToken := "valid"
+	tokenSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{"access_token": accessToken, "token_type": "Bearer", "expires_in": 3600})
+	}))
+	t.Cleanup(tokenSrv.Close)
+
+	vc := mem.NewVerificationCache(10)
+	data, err := json.Marshal(&User{Sub: "abc"})
+	require.NoError(t, err)
+	require.NoError(t, vc.SetVerification(t.Context(), tokenHash("valid"), data, time.Now().Add(time.Hour)))
+
+	tc := newTestCache()
+	a := &Auth{
+		cfg: Config{
+			AllowedPostMessageOrigins: []string{"https://app.example.com"},
+			PopupRedirectURL:          "https://app.example.com/popup",
+			TokenVerification:         TokenVerificationIntrospection,
+		},
+		discovery:         &discovery{endpoint: oauth2.Endpoint{TokenURL: tokenSrv.URL}},
+		oauth2:            oauth2.Config{ClientID: "client"},
+		sessionStore:      cache.FromCache(tc),
+		verificationCache: vc,
+	}
+
+	callback := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/popup?code=code&state=state", nil)
+		req.AddCookie(&http.Cookie{Name: "oidc_state", Value: "state"})
+		req.AddCookie(&http.Cookie{Name: "oidc_verifier", Value: "verifier"})
+		req.AddCookie(&http.Cookie{Name: "oidc_origin", Value: "https://app.example.com"})
+
+		rec := httptest.NewRecorder()
+		a.ServePopup(rec, req)
+		return rec
+	}
+
+	rec := callback()
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"sub":"abc"`)
+	require.Len(t, tc.sess, 1)
+	for _, sess := range tc.sess {
+		assert.Equal(t, "abc", sess.Subject)
+	}
+
+	// No session without a verified user
+	accessToken = "unverifiable"
+	rec = callback()
+	assert.Contains(t, rec.Body.String(), "Invalid token.")
+	assert.Len(t, tc.sess, 1)
+}
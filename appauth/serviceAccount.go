@@ -0,0 +1,56 @@
+package appauth
+
+import "strings"
+
+// DefaultServiceAccountDetector recognizes tokens issued through the
+// client credentials grant of common providers and returns the client
+// ID the token was issued to:
+//
+//   - Auth0: `gty` is `client-credentials`
+//   - Entra ID: `idtyp` is `app`
+//   - Keycloak: `preferred_username` / `username` starts with `service-account-`
+//   - Okta / Auth0: `sub` equals the client ID (Auth0: `<client>@clients`)
+func DefaultServiceAccountDetector(claims map[string]any) (clientID string, ok bool) {
+	for _, key := range []string{"client_id", "clientId", "azp", "cid", "appid"} {
+		if clientID = str(claims[key]); clientID != "" {
+			break
+		}
+	}
+
+	if clientID == "" {
+		return "", false
+	}
+
+	sub := str(claims["sub"])
+
+	switch {
+	case str(claims["gty"]) == "client-credentials",
+		str(claims["idtyp"]) == "app",
+		strings.HasPrefix(str(claims["preferred_username"]), "service-account-"),
+		strings.HasPrefix(str(claims["username"]), "service-account-"),
+		sub == clientID,
+		sub == clientID+"@clients":
+		return clientID, true
+
+	default:
+		return "", false
+	}
+}
+
+// detectServiceAccount marks the user as service account if the
+// configured detector recognizes the claims as such
+func (a *Auth) detectServiceAccount(u *User, claims map[string]any) bool {
+	detector := a.cfg.ServiceAccountDetector
+	if detector == nil {
+		detector = DefaultServiceAccountDetector
+	}
+
+	clientID, ok := detector(claims)
+	if !ok {
+		return false
+	}
+
+	u.ClientID = clientID
+	u.ServiceAccount = true
+	return true
+}
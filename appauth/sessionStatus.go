@@ -0,0 +1,244 @@
+package appauth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Luzifer/go_helpers/appauth/pkg/cache"
+)
+
+type (
+	// SessionStatus describes the session of the requesting user as
+	// returned by ServeSessionStatus and ServeSessionRotate. Expiry
+	// times of disabled timeouts are omitted.
+	SessionStatus struct {
+		User *User `json:"user"`
+
+		// IdleExpiresAt is the time the session expires by the
+		// SessionIdleTimeout unless it is used before
+		IdleExpiresAt time.Time `json:"idle_expires_at,omitzero"`
+		// AbsoluteExpiresAt is the time the session expires by the
+		// SessionAbsoluteTimeout
+		AbsoluteExpiresAt time.Time `json:"absolute_expires_at,omitzero"`
+
+		// Session is the new session ID issued by ServeSessionRotate,
+		// it is omitted for sessions held in the session cookie
+		Session string `json:"session,omitempty"`
+	}
+)
+
+// ServeSessionRotate is a mountable HTTP HandleFunc which replaces the
+// ID of the requesting session by a fresh one to limit the exposure of
+// long-lived session IDs. The tokens, binding and timeouts of the
+// session are kept and the old ID is invalidated.
+//
+// The session is taken from the `Authorization: Session ...` header
+// and the new ID is returned in the `session` field of the
+// SessionStatus, or from the session cookie which is then replaced
+// together with the CSRF token. Cookie based requests must carry the
+// CSRF token in the X-CSRF-Token header. Only POST is accepted.
+// Rejected requests are answered through the Config.ErrorRenderer like
+// in RequireAuth.
+func (a *Auth) ServeSessionRotate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sessID, fromCookie := a.requestSessionID(r)
+	if sessID == "" {
+		a.renderError(w, r, errMissingCredentials())
+		return
+	}
+
+	if fromCookie && !validCSRF(r, r.Header.Get(csrfHeaderName)) {
+		a.log().Warn("invalid CSRF token", slog.String("path", r.URL.Path), slog.String("method", r.Method))
+		a.renderError(w, r, a.rejectToken(r, sessionKey(sessID), errCSRF()))
+		return
+	}
+
+	token, _, err := a.sessionToken(r, sessID)
+	if err != nil {
+		a.writeSessionError(w, r, sessID, err)
+		return
+	}
+
+	// The user is fetched before the rotation as the new ID must be
+	// returned once the old one is removed
+	u, authErr, ok := a.sessionUser(r, token)
+	if !ok {
+		a.renderError(w, r, authErr)
+		return
+	}
+
+	newID, sess, err := a.rotateSession(r, sessID)
+	if err != nil {
+		a.writeSessionError(w, r, sessID, err)
+		return
+	}
+
+	status := a.sessionStatus(u, sess)
+
+	if fromCookie {
+		if err = a.setSessionCookies(w, newID); err != nil {
+			a.log().Error("setting session cookies", slog.Any("error", err))
+			http.Error(w, "setting session cookies", http.StatusInternalServerError)
+			return
+		}
+	} else {
+		status.Session = newID
+	}
+
+	writeSessionStatus(w, status)
+}
+
+// ServeSessionStatus is a mountable HTTP HandleFunc which reports the
+// User and the expiry times of the requesting session as
+// SessionStatus JSON to let the SPA renew or end the session in time.
+// The session is taken from the `Authorization: Session ...` header
+// or from the session cookie. Requesting the status does not count as
+// activity regarding the SessionIdleTimeout. Expired or unknown
+// sessions are rejected through the Config.ErrorRenderer like in
+// RequireAuth.
+func (a *Auth) ServeSessionStatus(w http.ResponseWriter, r *http.Request) {
+	if !isSafeMethod(r.Method) {
+		w.Header().Set("Allow", http.MethodGet+", "+http.MethodHead)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sessID, _ := a.requestSessionID(r)
+	if sessID == "" {
+		a.renderError(w, r, errMissingCredentials())
+		return
+	}
+
+	token, sess, err := a.sessionToken(r, sessID)
+	if err != nil {
+		a.writeSessionError(w, r, sessID, err)
+		return
+	}
+
+	u, authErr, ok := a.sessionUser(r, token)
+	if !ok {
+		a.renderError(w, r, authErr)
+		return
+	}
+
+	writeSessionStatus(w, a.sessionStatus(u, sess))
+}
+
+// requestSessionID extracts the session ID from the Authorization
+// header or the session cookie and reports whether it was taken from
+// the cookie
+func (a *Auth) requestSessionID(r *http.Request) (sessID string, fromCookie bool) {
+	if tokenType, token, ok := strings.Cut(r.Header.Get("Authorization"), " "); ok && tokenType == "Session" {
+		return token, false
+	}
+
+	if cookieSessID, ok := a.sessionFromCookie(r); ok {
+		return cookieSessID, true
+	}
+
+	return "", false
+}
+
+// rotateSession moves the session to a new session ID and removes it
+// from the old one while holding the lock of the session (see
+// lockSession) to not interfere with a refresh or another rotation
+func (a *Auth) rotateSession(r *http.Request, sessID string) (string, cache.Session, error) {
+	ctx, cancel := context.WithTimeout(r.Context(), sessionRefreshTimeout)
+	defer cancel()
+
+	oldKey := sessionKey(sessID)
+
+	unlock, err := a.lockSession(ctx, oldKey)
+	if err != nil {
+		return "", cache.Session{}, err
+	}
+	defer unlock()
+
+	// Load the session again to get the tokens of a possible refresh, a
+	// parallel rotation removed it already
+	sess, err := a.sessionStore.LoadSession(ctx, oldKey)
+	if err != nil {
+		return "", sess, fmt.Errorf("getting session from cache: %w", err)
+	}
+
+	// The rotation counts as activity of the session
+	sess.LastSeen = time.Now()
+
+	newID, err := randB64(sessionIDLength)
+	if err != nil {
+		return "", sess, fmt.Errorf("generating session ID: %w", err)
+	}
+
+	if err = a.sessionStore.StoreSession(ctx, sessionKey(newID), sess, a.sessionTTL(sess)); err != nil {
+		return "", sess, fmt.Errorf("writing session: %w", err)
+	}
+
+	if err = a.sessionStore.DeleteSession(ctx, oldKey); err != nil {
+		return "", sess, fmt.Errorf("removing old session: %w", err)
+	}
+
+	a.emit(r, Event{
+		Type:                EventSessionRotated,
+		Subject:             sess.Subject,
+		SessionHash:         sessionKey(newID),
+		PreviousSessionHash: oldKey,
+	})
+
+	return newID, sess, nil
+}
+
+// sessionStatus builds the status of the session of the user
+func (a *Auth) sessionStatus(u *User, sess cache.Session) SessionStatus {
+	status := SessionStatus{User: u}
+
+	if a.cfg.SessionIdleTimeout > 0 {
+		status.IdleExpiresAt = sess.LastSeen.Add(a.cfg.SessionIdleTimeout)
+	}
+
+	if a.cfg.SessionAbsoluteTimeout > 0 {
+		status.AbsoluteExpiresAt = sess.CreatedAt.Add(a.cfg.SessionAbsoluteTimeout)
+	}
+
+	return status
+}
+
+// sessionUser fetches the user of the session using its access token
+func (a *Auth) sessionUser(r *http.Request, token string) (*User, AuthError, bool) {
+	t, err := a.primaryTenant(r.Context())
+	if err != nil {
+		a.log().Warn("selecting issuer", slog.String("path", r.URL.Path), slog.Any("error", err))
+		return nil, errProviderUnavailable(), false
+	}
+
+	u, err := a.verifyAccessToken(r.Context(), t, token)
+	if err != nil {
+		a.log().Info("invalid token", slog.String("path", r.URL.Path), slog.Any("error", err))
+		return nil, a.rejectToken(r, "", errInvalidToken("access token invalid or expired")), false
+	}
+
+	return u, AuthError{}, true
+}
+
+// writeSessionError rejects requests whose session could not be used
+// (see rejectSession)
+func (a *Auth) writeSessionError(w http.ResponseWriter, r *http.Request, sessID string, err error) {
+	a.log().Info("using session", slog.String("path", r.URL.Path), slog.Any("error", err))
+	a.renderError(w, r, a.rejectSession(r, sessID, err))
+}
+
+// writeSessionStatus sends the status as JSON
+func writeSessionStatus(w http.ResponseWriter, status SessionStatus) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,265 @@
+package appauth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Luzifer/go_helpers/appauth/pkg/cache"
+	"github.com/Luzifer/go_helpers/appauth/pkg/cache/mem"
+)
+
+func newSessionStatusAuth(t *testing.T, tc *testCache) *Auth {
+	t.Helper()
+
+	vc := mem.NewVerificationCache(10)
+	data, err := json.Marshal(&User{Sub: "abc"})
+	require.NoError(t, err)
+	require.NoError(t, vc.SetVerification(t.Context(), tokenHash("valid"), data, time.Now().Add(time.Hour)))
+
+	return &Auth{
+		cfg: Config{
+			ErrorRenderer:          BearerErrorRenderer(""),
+			InsecureCookie:         true,
+			SessionAbsoluteTimeout: 24 * time.Hour,
+			SessionIdleTimeout:     time.Hour,
+			TokenVerification:      TokenVerificationIntrospection,
+		},
+		discovery:         &discovery{},
+		sessionStore:      cache.FromCache(tc),
+		verificationCache: vc,
+	}
+}
+
+func TestServeSessionStatus(t *testing.T) {
+	created := time.Now().Add(-time.Hour).Truncate(time.Second)
+	lastSeen := time.Now().Add(-time.Minute).Truncate(time.Second)
+
+	tc := newTestCache()
+	tc.sess[sessionKey("sess")] = cache.Session{
+		AccessToken: "valid",
+		Expires:     time.Now().Add(time.Hour),
+		CreatedAt:   created,
+		LastSeen:    lastSeen,
+	}
+
+	a := newSessionStatusAuth(t, tc)
+
+	req := httptest.NewRequest(http.MethodGet, "/session", nil)
+	req.Header.Set("Authorization", "Session sess")
+	rec := httptest.NewRecorder()
+	a.ServeSessionStatus(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var status SessionStatus
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&status))
+	require.NotNil(t, status.User)
+	assert.Equal(t, "abc", status.User.Sub)
+	assert.True(t, lastSeen.Add(time.Hour).Equal(status.IdleExpiresAt))
+	assert.True(t, created.Add(24*time.Hour).Equal(status.AbsoluteExpiresAt))
+	assert.Empty(t, status.Session)
+
+	// Asking for the status is no activity
+	assert.True(t, lastSeen.Equal(tc.sess[sessionKey("sess")].LastSeen))
+
+	req = httptest.NewRequest(http.MethodGet, "/session", nil)
+	req.Header.Set("Authorization", "Session unknown")
+	rec = httptest.NewRecorder()
+	a.ServeSessionStatus(rec, req)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Contains(t, rec.Header().Get("WWW-Authenticate"), `error="invalid_token"`)
+
+	rec = httptest.NewRecorder()
+	a.ServeSessionStatus(rec, httptest.NewRequest(http.MethodGet, "/session", nil))
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+}
+
+func TestServeSessionRotate(t *testing.T) {
+	orig := cache.Session{
+		AccessToken:  "valid",
+		RefreshToken: "refresh",
+		Expires:      time.Now().Add(time.Hour),
+		CreatedAt:    time.Now().Add(-time.Hour),
+		LastSeen:     time.Now().Add(-time.Minute),
+		Subject:      "abc",
+		SID:          "provider-session",
+	}
+
+	tc := newTestCache()
+	tc.sess[sessionKey("sess")] = orig
+
+	var events []Event
+	a := newSessionStatusAuth(t, tc)
+	a.cfg.OnEvent = func(ev Event) { events = append(events, ev) }
+
+	rec := httptest.NewRecorder()
+	a.ServeSessionRotate(rec, httptest.NewRequest(http.MethodGet, "/session/rotate", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+
+	req := httptest.NewRequest(http.MethodPost, "/session/rotate", nil)
+	req.Header.Set("Authorization", "Session sess")
+	rec = httptest.NewRecorder()
+	a.ServeSessionRotate(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var status SessionStatus
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&status))
+	require.NotEmpty(t, status.Session)
+	assert.NotEqual(t, "sess", status.Session)
+	assert.Equal(t, "abc", status.User.Sub)
+
+	_, ok := tc.sess[sessionKey("sess")]
+	assert.False(t, ok, "old session still exists")
+
+	rotated, ok := tc.sess[sessionKey(status.Session)]
+	require.True(t, ok)
+	assert.Equal(t, orig.RefreshToken, rotated.RefreshToken)
+	assert.Equal(t, orig.SID, rotated.SID)
+	assert.True(t, orig.CreatedAt.Equal(rotated.CreatedAt), "absolute timeout must not be reset")
+
+	require.Len(t, events, 1)
+	assert.Equal(t, EventSessionRotated, events[0].Type)
+	assert.Equal(t, sessionKey(status.Session), events[0].SessionHash)
+	assert.Equal(t, sessionKey("sess"), events[0].PreviousSessionHash)
+	assert.Empty(t, events[0].Reason)
+
+	// Cookie sessions need the CSRF token and get new cookies
+	req = httptest.NewRequest(http.MethodPost, "/session/rotate", nil)
+	req.AddCookie(&http.Cookie{Name: defaultSessionCookieName, Value: status.Session})
+	req.AddCookie(&http.Cookie{Name: csrfCookieName, Value: "csrf"})
+	rec = httptest.NewRecorder()
+	a.ServeSessionRotate(rec, req)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+
+	req.Header.Set(csrfHeaderName, "csrf")
+	rec = httptest.NewRecorder()
+	a.ServeSessionRotate(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var cookieStatus SessionStatus
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&cookieStatus))
+	assert.Empty(t, cookieStatus.Session)
+
+	var newID string
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == defaultSessionCookieName {
+			newID = c.Value
+		}
+	}
+	require.NotEmpty(t, newID)
+	assert.NotEqual(t, status.Session, newID)
+	assert.Contains(t, tc.sess, sessionKey(newID))
+	assert.NotContains(t, tc.sess, sessionKey(status.Session))
+}
+
+func TestServeSessionRotateDPoP(t *testing.T) {
+	jkt, proof := dpopTestKey(t)
+
+	tc := newTestCache()
+	tc.sess[sessionKey("sess")] = cache.Session{
+		AccessToken: "valid",
+		Expires:     time.Now().Add(time.Hour),
+		DPoPKey:     jkt,
+	}
+
+	a := newSessionStatusAuth(t, tc)
+	a.dpopReplayCache = mem.NewReplayCache()
+
+	req := httptest.NewRequest(http.MethodPost, "/session/rotate", nil)
+	req.Header.Set("Authorization", "Session sess")
+	rec := httptest.NewRecorder()
+	a.ServeSessionRotate(rec, req)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	req.Header.Set("DPoP", proof(http.MethodPost, "http://example.com/session/rotate", "sess", nil))
+	rec = httptest.NewRecorder()
+	a.ServeSessionRotate(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var status SessionStatus
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&status))
+	assert.Equal(t, jkt, tc.sess[sessionKey(status.Session)].DPoPKey)
+}
+
+func TestServeSessionRotateUnverified(t *testing.T) {
+	tc := newTestCache()
+	tc.sess[sessionKey("sess")] = cache.Session{
+		AccessToken: "unverifiable",
+		Expires:     time.Now().Add(time.Hour),
+	}
+
+	a := newSessionStatusAuth(t, tc)
+
+	req := httptest.NewRequest(http.MethodPost, "/session/rotate", nil)
+	req.Header.Set("Authorization", "Session sess")
+	rec := httptest.NewRecorder()
+	a.ServeSessionRotate(rec, req)
+	assert.NotEqual(t, http.StatusOK, rec.Code)
+
+	// The session is kept as the new ID was never returned
+	assert.Len(t, tc.sess, 1)
+	assert.Contains(t, tc.sess, sessionKey("sess"))
+}
+
+func TestServeSessionRotateConcurrent(t *testing.T) {
+	store := mem.New()
+	t.Cleanup(func() { assert.NoError(t, store.Close()) })
+
+	require.NoError(t, store.SetSession(sessionKey("sess"), cache.Session{
+		AccessToken: "valid",
+		Expires:     time.Now().Add(time.Hour),
+		CreatedAt:   time.Now(),
+		LastSeen:    time.Now(),
+		Subject:     "abc",
+	}))
+
+	a := newSessionStatusAuth(t, newTestCache())
+	a.sessionStore = slowSessionStore{store}
+
+	const rotations = 10
+
+	var (
+		codes = make(chan int, rotations)
+		wg    sync.WaitGroup
+	)
+	for range rotations {
+		wg.Go(func() {
+			req := httptest.NewRequest(http.MethodPost, "/session/rotate", nil)
+			req.Header.Set("Authorization", "Session sess")
+			rec := httptest.NewRecorder()
+			a.ServeSessionRotate(rec, req)
+			codes <- rec.Code
+		})
+	}
+	wg.Wait()
+	close(codes)
+
+	// The old ID is only rotated once, all others fail to use it
+	var succeeded int
+	for code := range codes {
+		if code == http.StatusOK {
+			succeeded++
+		}
+	}
+	assert.Equal(t, 1, succeeded)
+
+	sessions, err := store.ListSessions(t.Context(), "abc")
+	require.NoError(t, err)
+	assert.Len(t, sessions, 1)
+	assert.NotContains(t, sessions, sessionKey("sess"))
+}
+
+// slowSessionStore widens the window for races by delaying writes
+type slowSessionStore struct{ *mem.Cache }
+
+func (s slowSessionStore) StoreSession(ctx context.Context, id string, sess cache.Session, ttl time.Duration) error {
+	time.Sleep(5 * time.Millisecond)
+	return s.Cache.StoreSession(ctx, id, sess, ttl) //nolint:wrapcheck // Test helper
+}
@@ -0,0 +1,224 @@
+package appauth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/Luzifer/go_helpers/appauth/pkg/cache"
+)
+
+type (
+	// SessionInfo describes a session of a user without exposing the
+	// session ID or tokens. The Handle (the key the session is stored
+	// under) identifies the session for RevokeSession.
+	SessionInfo struct {
+		Handle    string    `json:"handle"`
+		Subject   string    `json:"subject"`
+		UserAgent string    `json:"user_agent,omitempty"`
+		IP        string    `json:"ip,omitempty"`
+		CreatedAt time.Time `json:"created_at"`
+		LastSeen  time.Time `json:"last_seen"`
+	}
+)
+
+var (
+	// ErrSessionListingUnsupported is returned when the configured
+	// cache does not implement the cache.SubjectIndex
+	ErrSessionListingUnsupported = errors.New("cache does not support listing sessions by subject")
+
+	// ErrUnknownSession is returned by RevokeSession when the subject
+	// has no session with the given handle
+	ErrUnknownSession = errors.New("unknown session")
+)
+
+// ListSessions returns all sessions of the given subject ordered by
+// their creation time
+func (a *Auth) ListSessions(ctx context.Context, sub string) ([]SessionInfo, error) {
+	sessions, err := a.subjectSessions(ctx, sub)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]SessionInfo, 0, len(sessions))
+	for key, sess := range sessions {
+		out = append(out, SessionInfo{
+			Handle:    key,
+			Subject:   sess.Subject,
+			UserAgent: sess.UserAgent,
+			IP:        sess.IP,
+			CreatedAt: sess.CreatedAt,
+			LastSeen:  sess.LastSeen,
+		})
+	}
+
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.Before(out[j].CreatedAt) })
+
+	return out, nil
+}
+
+// RevokeAllSessions removes all sessions of the given subject ("log
+// out everywhere") and revokes their refresh tokens at the provider
+func (a *Auth) RevokeAllSessions(ctx context.Context, sub string) error {
+	return a.revokeAll(ctx, nil, sub)
+}
+
+// RevokeSession removes the session of the given subject identified
+// by the handle taken from ListSessions and revokes its refresh token
+// at the provider
+func (a *Auth) RevokeSession(ctx context.Context, sub, handle string) error {
+	return a.revokeHandle(ctx, nil, sub, handle)
+}
+
+// SessionAdminHandler returns a Handler to manage the sessions of a
+// subject given in the `sub` query parameter:
+//
+//   - GET lists the sessions as JSON
+//   - DELETE with `handle` revokes a single session
+//   - DELETE without `handle` revokes all sessions
+//
+// The handler does not check any permissions and MUST be shielded
+// through RequireAuth with appropriate Opts.
+func (a *Auth) SessionAdminHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sub := r.URL.Query().Get("sub")
+		if sub == "" {
+			http.Error(w, "missing sub", http.StatusBadRequest)
+			return
+		}
+
+		var err error
+
+		switch r.Method {
+		case http.MethodGet:
+			var sessions []SessionInfo
+			if sessions, err = a.ListSessions(r.Context(), sub); err != nil {
+				break
+			}
+
+			w.Header().Set("Cache-Control", "no-store")
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(sessions)
+			return
+
+		case http.MethodDelete:
+			if handle := r.URL.Query().Get("handle"); handle != "" {
+				err = a.revokeHandle(r.Context(), r, sub, handle)
+			} else {
+				err = a.revokeAll(r.Context(), r, sub)
+			}
+
+		default:
+			w.Header().Set("Allow", http.MethodGet+", "+http.MethodDelete)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		switch {
+		case err == nil:
+			w.WriteHeader(http.StatusNoContent)
+
+		case errors.Is(err, ErrUnknownSession):
+			http.Error(w, "unknown session", http.StatusNotFound)
+
+		case errors.Is(err, ErrSessionListingUnsupported):
+			http.Error(w, "session listing unsupported", http.StatusNotImplemented)
+
+		default:
+			a.log().Error("managing sessions", slog.String("sub", sub), slog.Any("error", err))
+			http.Error(w, "managing sessions", http.StatusInternalServerError)
+		}
+	})
+}
+
+// clientIP determines the client IP to record with a new session
+func (a *Auth) clientIP(r *http.Request) string {
+	if a.cfg.ClientIPResolver != nil {
+		return a.cfg.ClientIPResolver(r)
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+// revokeAll revokes all sessions of the subject, the request (may be
+// nil) issuing the revocation is attached to the emitted events
+func (a *Auth) revokeAll(ctx context.Context, r *http.Request, sub string) error {
+	sessions, err := a.subjectSessions(ctx, sub)
+	if err != nil {
+		return err
+	}
+
+	for key, sess := range sessions {
+		if err = a.revokeSession(ctx, r, key, sess); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// revokeHandle revokes the session of the subject identified by the
+// handle, the request (may be nil) issuing the revocation is attached
+// to the emitted event
+func (a *Auth) revokeHandle(ctx context.Context, r *http.Request, sub, handle string) error {
+	sessions, err := a.subjectSessions(ctx, sub)
+	if err != nil {
+		return err
+	}
+
+	sess, ok := sessions[handle]
+	if !ok {
+		return ErrUnknownSession
+	}
+
+	return a.revokeSession(ctx, r, handle, sess)
+}
+
+// revokeSession removes the session stored under the given key and
+// revokes its refresh token, failing revocations are only logged as
+// the session is gone anyway
+func (a *Auth) revokeSession(ctx context.Context, r *http.Request, key string, sess cache.Session) error {
+	if err := a.sessionStore.DeleteSession(ctx, key); err != nil {
+		return fmt.Errorf("removing session: %w", err)
+	}
+
+	a.emit(r, Event{Type: EventSessionRevoked, Subject: sess.Subject, SessionHash: key, Reason: "revoked"})
+
+	if sess.RefreshToken != "" {
+		if err := a.revokeToken(ctx, sess.RefreshToken, "refresh_token"); err != nil {
+			a.log().Warn("revoking refresh token", slog.String("sub", sess.Subject), slog.Any("error", err))
+		}
+	}
+
+	return nil
+}
+
+// subjectSessions fetches the sessions of the subject from the index
+// keyed by the key they are stored under
+func (a *Auth) subjectSessions(ctx context.Context, sub string) (map[string]cache.Session, error) {
+	idx, ok := a.sessionStore.(cache.SubjectIndex)
+	if !ok {
+		return nil, ErrSessionListingUnsupported
+	}
+
+	sessions, err := idx.ListSessions(ctx, sub)
+	switch {
+	case errors.Is(err, cache.ErrUnsupported):
+		return nil, ErrSessionListingUnsupported
+	case err != nil:
+		return nil, fmt.Errorf("listing sessions: %w", err)
+	}
+
+	return sessions, nil
+}
@@ -0,0 +1,100 @@
+package appauth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Luzifer/go_helpers/appauth/pkg/cache"
+	"github.com/Luzifer/go_helpers/appauth/pkg/cache/mem"
+)
+
+func TestSessionManagement(t *testing.T) {
+	c := mem.New()
+	now := time.Now()
+
+	require.NoError(t, c.SetSession("a", cache.Session{Subject: "alice", UserAgent: "curl", IP: "192.0.2.1", CreatedAt: now}))
+	require.NoError(t, c.SetSession("b", cache.Session{Subject: "alice", CreatedAt: now.Add(time.Minute)}))
+	require.NoError(t, c.SetSession("c", cache.Session{Subject: "bob", CreatedAt: now}))
+
+	a := &Auth{sessionStore: c}
+
+	sessions, err := a.ListSessions(t.Context(), "alice")
+	require.NoError(t, err)
+	require.Len(t, sessions, 2)
+	assert.Equal(t, "a", sessions[0].Handle)
+	assert.Equal(t, "curl", sessions[0].UserAgent)
+	assert.Equal(t, "192.0.2.1", sessions[0].IP)
+	assert.Equal(t, "b", sessions[1].Handle)
+
+	assert.ErrorIs(t, a.RevokeSession(t.Context(), "bob", "a"), ErrUnknownSession)
+
+	require.NoError(t, a.RevokeSession(t.Context(), "alice", "a"))
+	_, err = c.GetSession("a")
+	require.ErrorIs(t, err, cache.ErrSessionNotFound)
+
+	require.NoError(t, a.RevokeAllSessions(t.Context(), "alice"))
+	_, err = c.GetSession("b")
+	require.ErrorIs(t, err, cache.ErrSessionNotFound)
+
+	_, err = c.GetSession("c")
+	require.NoError(t, err)
+}
+
+func TestSessionManagementUnsupported(t *testing.T) {
+	a := &Auth{sessionStore: cache.FromCache(newTestCache())}
+
+	_, err := a.ListSessions(t.Context(), "alice")
+	require.ErrorIs(t, err, ErrSessionListingUnsupported)
+}
+
+func TestSessionAdminHandler(t *testing.T) {
+	c := mem.New()
+	require.NoError(t, c.SetSession("a", cache.Session{Subject: "alice"}))
+	require.NoError(t, c.SetSession("b", cache.Session{Subject: "alice"}))
+
+	var events []Event
+	h := (&Auth{
+		cfg:          Config{OnEvent: func(ev Event) { events = append(events, ev) }},
+		sessionStore: c,
+	}).SessionAdminHandler()
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/sessions?sub=alice", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var sessions []SessionInfo
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&sessions))
+	assert.Len(t, sessions, 2)
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/sessions?sub=alice&handle=unknown", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/sessions?sub=alice&handle="+"a", nil))
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+
+	// Revocations carry the request of the admin
+	require.Len(t, events, 1)
+	assert.Equal(t, EventSessionRevoked, events[0].Type)
+	assert.Equal(t, "/sessions", events[0].Path)
+	assert.Equal(t, "192.0.2.1", events[0].ClientIP)
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/sessions?sub=alice", nil))
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+
+	remaining, err := c.ListSessions(t.Context(), "alice")
+	require.NoError(t, err)
+	assert.Empty(t, remaining)
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/sessions", nil))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
@@ -0,0 +1,85 @@
+package appauth
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// promptValues lists the `prompt` values defined by OIDC Core
+// Section 3.1.2.1
+var promptValues = []string{"none", "login", "consent", "select_account"}
+
+// stepUpParams validates the step-up parameters of the login request
+// and converts them into parameters for the authorization URL
+func stepUpParams(q url.Values) ([]oauth2.AuthCodeOption, error) {
+	var params []oauth2.AuthCodeOption
+
+	if acr := strings.Fields(q.Get("acr_values")); len(acr) > 0 {
+		params = append(params, oauth2.SetAuthURLParam("acr_values", strings.Join(acr, " ")))
+	}
+
+	if maxAge := q.Get("max_age"); maxAge != "" {
+		if n, err := strconv.Atoi(maxAge); err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid max_age %q", maxAge)
+		}
+		params = append(params, oauth2.SetAuthURLParam("max_age", maxAge))
+	}
+
+	if prompt := strings.Fields(q.Get("prompt")); len(prompt) > 0 {
+		for _, p := range prompt {
+			if !slices.Contains(promptValues, p) {
+				return nil, fmt.Errorf("invalid prompt %q", p)
+			}
+		}
+
+		if len(prompt) > 1 && slices.Contains(prompt, "none") {
+			return nil, errors.New("prompt none must not be combined")
+		}
+
+		params = append(params, oauth2.SetAuthURLParam("prompt", strings.Join(prompt, " ")))
+	}
+
+	return params, nil
+}
+
+// sufficientAuthentication checks the authentication of the user
+// against the step-up requirements of the opts
+func (a *Auth) sufficientAuthentication(u *User, opts Opts) bool {
+	if len(opts.AnyACR) > 0 && !slices.Contains(opts.AnyACR, u.ACR) {
+		return false
+	}
+
+	if !containsAll(u.AMR, opts.AllAMR) {
+		return false
+	}
+
+	if opts.MaxAuthAge > 0 &&
+		(u.AuthTime.IsZero() || time.Since(u.AuthTime) > opts.MaxAuthAge+a.cfg.ClockSkew) {
+		return false
+	}
+
+	return true
+}
+
+// applyAuthenticationContext takes the `acr`, `amr` and `auth_time`
+// claims present in the given claims into the user
+func (u *User) applyAuthenticationContext(claims map[string]any) {
+	if acr := str(claims["acr"]); acr != "" {
+		u.ACR = acr
+	}
+
+	if amr := extractStringSlice(claims["amr"]); len(amr) > 0 {
+		u.AMR = amr
+	}
+
+	if authTime := numericDate(claims["auth_time"]); !authTime.IsZero() {
+		u.AuthTime = authTime
+	}
+}
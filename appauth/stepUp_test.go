@@ -0,0 +1,98 @@
+package appauth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+
+	"github.com/Luzifer/go_helpers/appauth/pkg/cache/mem"
+)
+
+func TestRequireAuthStepUp(t *testing.T) {
+	vc := mem.NewVerificationCache(10)
+	for raw, u := range map[string]User{
+		"weak":   {Sub: "abc", ACR: "1", AMR: []string{"pwd"}, AuthTime: time.Now().Add(-2 * time.Hour)},
+		"strong": {Sub: "abc", ACR: "2", AMR: []string{"pwd", "hwk", "mfa"}, AuthTime: time.Now().Add(-time.Minute)},
+	} {
+		data, err := json.Marshal(u)
+		require.NoError(t, err)
+		require.NoError(t, vc.SetVerification(t.Context(), tokenHash(raw), data, time.Now().Add(time.Hour)))
+	}
+
+	a := &Auth{cfg: Config{ErrorRenderer: BearerErrorRenderer("")}, discovery: &discovery{}, verificationCache: vc}
+	next := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusNoContent) })
+
+	for name, tc := range map[string]struct {
+		token      string
+		opts       Opts
+		wantStatus int
+		wantHeader string
+	}{
+		"no requirements": {"weak", Opts{}, http.StatusNoContent, ""},
+		"acr":             {"weak", Opts{AnyACR: []string{"2", "3"}}, http.StatusUnauthorized, `Bearer error="insufficient_user_authentication", error_description="a different authentication level is required", acr_values="2 3"`},
+		"amr":             {"weak", Opts{AllAMR: []string{"mfa"}}, http.StatusUnauthorized, `Bearer error="insufficient_user_authentication", error_description="a different authentication level is required"`},
+		"max age":         {"weak", Opts{MaxAuthAge: time.Hour}, http.StatusUnauthorized, `Bearer error="insufficient_user_authentication", error_description="a different authentication level is required", max_age="3600"`},
+		"strong":          {"strong", Opts{AnyACR: []string{"2"}, AllAMR: []string{"mfa", "hwk"}, MaxAuthAge: time.Hour}, http.StatusNoContent, ""},
+		"nested":          {"weak", Opts{AllOf: []Opts{{AnyACR: []string{"2"}}}}, http.StatusForbidden, `Bearer error="insufficient_scope", error_description="insufficient permissions"`},
+		"nested any":      {"weak", Opts{AnyOf: []Opts{{AnyACR: []string{"2"}}, {MaxAuthAge: time.Hour}}}, http.StatusForbidden, `Bearer error="insufficient_scope", error_description="insufficient permissions"`},
+		"nested strong":   {"strong", Opts{AnyOf: []Opts{{AnyACR: []string{"3"}}, {AllOf: []Opts{{AllAMR: []string{"hwk"}}}}}}, http.StatusNoContent, ""},
+	} {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/admin", nil)
+			req.Header.Set("Authorization", "Bearer "+tc.token)
+
+			rec := httptest.NewRecorder()
+			a.RequireAuth(next, tc.opts).ServeHTTP(rec, req)
+
+			assert.Equal(t, tc.wantStatus, rec.Code)
+			assert.Equal(t, tc.wantHeader, rec.Header().Get("WWW-Authenticate"))
+		})
+	}
+}
+
+func TestUserAuthenticationContext(t *testing.T) {
+	tn := &tenant{}
+
+	u := tn.userFromClaims(map[string]any{
+		"sub":       "abc",
+		"acr":       "urn:mace:incommon:iap:silver",
+		"amr":       []any{"pwd", "otp"},
+		"auth_time": float64(1700000000),
+	})
+
+	assert.Equal(t, "urn:mace:incommon:iap:silver", u.ACR)
+	assert.Equal(t, []string{"pwd", "otp"}, u.AMR)
+	assert.Equal(t, time.Unix(1700000000, 0), u.AuthTime)
+}
+
+func TestServePopupStepUp(t *testing.T) {
+	a := &Auth{
+		cfg:       Config{PopupRedirectURL: "https://app.example.com/popup"},
+		discovery: &discovery{endpoint: oauth2.Endpoint{AuthURL: "https://idp.example.com/auth"}},
+		oauth2:    oauth2.Config{ClientID: "client"},
+	}
+
+	rec := httptest.NewRecorder()
+	a.ServePopup(rec, httptest.NewRequest(http.MethodGet, "/popup?acr_values=gold+silver&max_age=0&prompt=login", nil))
+	require.Equal(t, http.StatusFound, rec.Code)
+
+	loc, err := url.Parse(rec.Header().Get("Location"))
+	require.NoError(t, err)
+	assert.Equal(t, "gold silver", loc.Query().Get("acr_values"))
+	assert.Equal(t, "0", loc.Query().Get("max_age"))
+	assert.Equal(t, "login", loc.Query().Get("prompt"))
+	assert.Equal(t, "S256", loc.Query().Get("code_challenge_method"))
+
+	for _, query := range []string{"max_age=-1", "max_age=soon", "prompt=later", "prompt=none+login"} {
+		rec = httptest.NewRecorder()
+		a.ServePopup(rec, httptest.NewRequest(http.MethodGet, "/popup?"+query, nil))
+		assert.Equal(t, http.StatusBadRequest, rec.Code, query)
+	}
+}
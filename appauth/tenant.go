@@ -0,0 +1,427 @@
+package appauth
+
+import (
+	"container/list"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+)
+
+const (
+	// defaultMaxResolvedIssuers is the default of the
+	// Config.MaxResolvedIssuers
+	defaultMaxResolvedIssuers = 100
+
+	// jwtParts is the number of parts of a JWS in compact serialization
+	jwtParts = 3
+)
+
+type (
+	// Issuer configures an additional provider (e.g. the realm of a
+	// customer tenant) whose access tokens are accepted by RequireAuth
+	// and OptionalAuth. The login flows and sessions are always bound to
+	// the Config.IssuerURL.
+	Issuer struct {
+		// Name identifies the tenant and is exposed as User.Tenant
+		Name string
+
+		IssuerURL string
+
+		// ClientID and ClientSecret are used for the client specific
+		// claims (see ClaimSelector) and to authenticate against the
+		// introspection endpoint
+		ClientID     string
+		ClientSecret string
+
+		// IntrospectionURL overrides the introspection_endpoint
+		// announced by the provider for TokenVerificationIntrospection
+		IntrospectionURL string
+
+		// Empty selectors of the ClaimMapping default to the ones of the
+		// Config.ClaimMapping
+		ClaimMapping ClaimMapping
+
+		// Audiences defaults to the Config.Audiences
+		Audiences []string
+	}
+
+	// tenant holds everything required to verify the access tokens of
+	// a single issuer
+	tenant struct {
+		name      string
+		issuerURL string
+		primary   bool
+
+		clientID         string
+		clientSecret     string
+		introspectionURL string
+		claimMapping     ClaimMapping
+		audiences        []string
+
+		provider *oidc.Provider
+		verifier *oidc.IDTokenVerifier
+		meta     providerMetadata
+	}
+
+	// tenantLRU holds the tenants returned by the IssuerResolver and
+	// evicts the least recently used ones beyond its size. It is
+	// guarded by the tenantLock of the Auth.
+	tenantLRU struct {
+		entries map[string]*list.Element
+		lru     *list.List
+		size    int
+	}
+)
+
+// newTenant discovers the provider of the given issuer
+func newTenant(ctx context.Context, iss Issuer, cfg Config) (*tenant, error) {
+	if iss.IssuerURL == "" {
+		return nil, errors.New("IssuerURL is required")
+	}
+
+	iss.ClaimMapping = iss.ClaimMapping.withDefaults(cfg.ClaimMapping)
+
+	if err := iss.ClaimMapping.validate(); err != nil {
+		return nil, fmt.Errorf("validating claim mapping: %w", err)
+	}
+
+	if len(iss.Audiences) == 0 {
+		iss.Audiences = cfg.Audiences
+	}
+
+	provider, err := oidc.NewProvider(ctx, iss.IssuerURL)
+	if err != nil {
+		return nil, fmt.Errorf("creating OIDC provider: %w", err)
+	}
+
+	t := &tenant{
+		name:             iss.Name,
+		issuerURL:        iss.IssuerURL,
+		clientID:         iss.ClientID,
+		clientSecret:     iss.ClientSecret,
+		introspectionURL: iss.IntrospectionURL,
+		claimMapping:     iss.ClaimMapping,
+		audiences:        iss.Audiences,
+		provider:         provider,
+		verifier:         accessTokenVerifier(provider, cfg),
+	}
+
+	if err = provider.Claims(&t.meta); err != nil {
+		return nil, fmt.Errorf("parsing provider metadata: %w", err)
+	}
+
+	if cfg.TokenVerification == TokenVerificationIntrospection && t.introspectionEndpoint() == "" {
+		return nil, fmt.Errorf("provider %q does not announce introspection_endpoint and no IntrospectionURL is set", iss.IssuerURL)
+	}
+
+	return t, nil
+}
+
+// newTenantLRU creates a tenantLRU holding at most size tenants
+func newTenantLRU(size int) *tenantLRU {
+	if size <= 0 {
+		size = defaultMaxResolvedIssuers
+	}
+
+	return &tenantLRU{
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+		size:    size,
+	}
+}
+
+// unverifiedIssuer reads the `iss` claim from the payload of a JWT
+// without verifying it to select the tenant to verify it with. Returns
+// an empty string for opaque tokens.
+func unverifiedIssuer(raw string) string {
+	parts := strings.Split(raw, ".")
+	if len(parts) != jwtParts {
+		return ""
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return ""
+	}
+
+	var claims struct {
+		Issuer string `json:"iss"`
+	}
+	if err = json.Unmarshal(payload, &claims); err != nil {
+		return ""
+	}
+
+	return claims.Issuer
+}
+
+// cachedTenant returns the already discovered tenant of the given
+// IssuerURL
+func (a *Auth) cachedTenant(issuerURL string) (*tenant, bool) {
+	a.tenantLock.RLock()
+	t, ok := a.tenants[issuerURL]
+	a.tenantLock.RUnlock()
+
+	if ok || a.cfg.IssuerResolver == nil {
+		return t, ok
+	}
+
+	// Looking up resolved tenants updates their recent use
+	a.tenantLock.Lock()
+	defer a.tenantLock.Unlock()
+
+	return a.resolvedTenants.get(issuerURL)
+}
+
+// isConfiguredIssuer checks whether the IssuerURL is one of the
+// configured Issuers
+func (a *Auth) isConfiguredIssuer(issuerURL string) bool {
+	return slices.ContainsFunc(a.cfg.Issuers, func(iss Issuer) bool { return iss.IssuerURL == issuerURL })
+}
+
+// knownTenants returns all discovered tenants
+func (a *Auth) knownTenants() []*tenant {
+	a.tenantLock.RLock()
+	defer a.tenantLock.RUnlock()
+
+	tenants := slices.Collect(maps.Values(a.tenants))
+	if a.resolvedTenants != nil {
+		tenants = append(tenants, a.resolvedTenants.values()...)
+	}
+
+	return tenants
+}
+
+// primaryTenant returns the tenant of the Config.IssuerURL
+func (a *Auth) primaryTenant(ctx context.Context) (*tenant, error) {
+	d, err := a.discovered(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tenant{
+		issuerURL:        a.cfg.IssuerURL,
+		primary:          true,
+		clientID:         a.cfg.ClientID,
+		clientSecret:     a.cfg.ClientSecret,
+		introspectionURL: a.cfg.IntrospectionURL,
+		claimMapping:     a.cfg.ClaimMapping,
+		audiences:        a.cfg.Audiences,
+		provider:         d.provider,
+		verifier:         d.verifier,
+		meta:             d.meta,
+	}, nil
+}
+
+// replaceTenant puts the re-discovered tenant in place of the old one
+// unless it was evicted in the meantime
+func (a *Auth) replaceTenant(t *tenant) {
+	a.tenantLock.Lock()
+	defer a.tenantLock.Unlock()
+
+	if _, ok := a.tenants[t.issuerURL]; ok {
+		a.tenants[t.issuerURL] = t
+		return
+	}
+
+	a.resolvedTenants.replace(t)
+}
+
+// requestTenant selects the tenant to verify the access token of the
+// request with: the IssuerResolver decides if configured, otherwise
+// the unverified `iss` claim of the token is matched against the
+// configured Issuers. Tokens not matching any of them (including
+// opaque tokens) are verified against the primary issuer.
+func (a *Auth) requestTenant(r *http.Request, raw string) (*tenant, error) {
+	if a.cfg.IssuerResolver != nil {
+		iss, err := a.cfg.IssuerResolver(r)
+		if err != nil {
+			return nil, fmt.Errorf("resolving issuer: %w", err)
+		}
+
+		return a.tenant(r.Context(), iss)
+	}
+
+	if tokenIssuer := unverifiedIssuer(raw); tokenIssuer != "" {
+		for _, iss := range a.cfg.Issuers {
+			if iss.IssuerURL == tokenIssuer {
+				return a.tenant(r.Context(), iss)
+			}
+		}
+	}
+
+	return a.primaryTenant(r.Context())
+}
+
+// storeTenant caches the discovered tenant: configured Issuers are
+// kept forever, resolved ones in the bounded resolvedTenants
+func (a *Auth) storeTenant(t *tenant) {
+	a.tenantLock.Lock()
+	defer a.tenantLock.Unlock()
+
+	if a.cfg.IssuerResolver == nil || a.isConfiguredIssuer(t.issuerURL) {
+		if a.tenants == nil {
+			a.tenants = make(map[string]*tenant)
+		}
+		a.tenants[t.issuerURL] = t
+		return
+	}
+
+	if a.resolvedTenants == nil {
+		a.resolvedTenants = newTenantLRU(a.cfg.MaxResolvedIssuers)
+	}
+	a.resolvedTenants.put(t)
+}
+
+// tenant returns the tenant for the given issuer discovering its
+// provider on first use. Tenants are cached by their IssuerURL.
+func (a *Auth) tenant(ctx context.Context, iss Issuer) (*tenant, error) {
+	if iss.IssuerURL == a.cfg.IssuerURL {
+		return a.primaryTenant(ctx)
+	}
+
+	if t, ok := a.cachedTenant(iss.IssuerURL); ok {
+		return t, nil
+	}
+
+	// Parallel first requests of the same tenant share the discovery
+	// which must therefore not be aborted by the cancellation of the
+	// request starting it
+	res := a.tenantGroup.DoChan(iss.IssuerURL, func() (any, error) {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), discoveryTimeout)
+		defer cancel()
+
+		return newTenant(ctx, iss, a.cfg)
+	})
+
+	select {
+	case <-ctx.Done():
+		return nil, fmt.Errorf("%w: discovering issuer %q: %w", ErrProviderUnavailable, iss.IssuerURL, ctx.Err())
+	case r := <-res:
+		if r.Err != nil {
+			return nil, fmt.Errorf("%w: discovering issuer %q: %w", ErrProviderUnavailable, iss.IssuerURL, r.Err)
+		}
+
+		t := r.Val.(*tenant)
+		a.storeTenant(t)
+
+		return t, nil
+	}
+}
+
+// effectiveClaimMapping returns the configured ClaimMapping with empty
+// selectors taken from the default ClaimMapping
+func (t *tenant) effectiveClaimMapping() ClaimMapping {
+	return t.claimMapping.withDefaults(ClaimMappingKeycloak)
+}
+
+func (t *tenant) introspectionEndpoint() string {
+	if t.introspectionURL != "" {
+		return t.introspectionURL
+	}
+
+	return t.meta.IntrospectionEndpoint
+}
+
+// issuer returns the configuration the tenant was created from
+func (t *tenant) issuer() Issuer {
+	return Issuer{
+		Name:             t.name,
+		IssuerURL:        t.issuerURL,
+		ClientID:         t.clientID,
+		ClientSecret:     t.clientSecret,
+		IntrospectionURL: t.introspectionURL,
+		ClaimMapping:     t.claimMapping,
+		Audiences:        t.audiences,
+	}
+}
+
+// userFromClaims maps the given claims into a User
+func (t *tenant) userFromClaims(claims map[string]any) *User {
+	m := t.effectiveClaimMapping()
+
+	u := &User{
+		Sub:    m.Subject.stringValue(claims, t.clientID),
+		Email:  m.Email.stringValue(claims, t.clientID),
+		Name:   m.Name.stringValue(claims, t.clientID),
+		Groups: m.groups(claims, t.clientID),
+		Roles:  m.roles(claims, t.clientID),
+		Raw:    claims,
+	}
+	u.applyAuthenticationContext(claims)
+
+	return u
+}
+
+// verificationKey derives the verification cache key of the token.
+// Other tenants include their issuer to not accept a token verified
+// for another tenant.
+func (t *tenant) verificationKey(raw string) string {
+	if t.primary {
+		return tokenHash(raw)
+	}
+
+	return tokenHash(t.issuerURL + " " + raw)
+}
+
+// get returns the tenant of the IssuerURL and marks it as recently
+// used
+func (c *tenantLRU) get(issuerURL string) (*tenant, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	el, ok := c.entries[issuerURL]
+	if !ok {
+		return nil, false
+	}
+
+	c.lru.MoveToFront(el)
+	return el.Value.(*tenant), true
+}
+
+// put stores the tenant evicting the least recently used ones beyond
+// the size
+func (c *tenantLRU) put(t *tenant) {
+	if el, ok := c.entries[t.issuerURL]; ok {
+		el.Value = t
+		c.lru.MoveToFront(el)
+		return
+	}
+
+	c.entries[t.issuerURL] = c.lru.PushFront(t)
+
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*tenant).issuerURL)
+	}
+}
+
+// replace updates a stored tenant without changing its recent use
+func (c *tenantLRU) replace(t *tenant) {
+	if c == nil {
+		return
+	}
+
+	if el, ok := c.entries[t.issuerURL]; ok {
+		el.Value = t
+	}
+}
+
+// values returns all stored tenants
+func (c *tenantLRU) values() []*tenant {
+	out := make([]*tenant, 0, c.lru.Len())
+	for el := c.lru.Front(); el != nil; el = el.Next() {
+		out = append(out, el.Value.(*tenant))
+	}
+
+	return out
+}
@@ -0,0 +1,229 @@
+package appauth
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Luzifer/go_helpers/appauth/pkg/cache/mem"
+)
+
+func TestUnverifiedIssuer(t *testing.T) {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(`{"iss":"https://idp.example.com/realms/acme"}`))
+
+	assert.Equal(t, "https://idp.example.com/realms/acme", unverifiedIssuer("header."+payload+".signature"))
+	assert.Empty(t, unverifiedIssuer("opaque"))
+	assert.Empty(t, unverifiedIssuer("header.!!!.signature"))
+}
+
+func TestRequestTenant(t *testing.T) {
+	acme := &tenant{name: "acme", issuerURL: "https://idp.example.com/realms/acme"}
+	a := &Auth{
+		cfg: Config{
+			IssuerURL: "https://idp.example.com/realms/main",
+			Issuers:   []Issuer{{Name: "acme", IssuerURL: acme.issuerURL}},
+		},
+		discovery: &discovery{},
+		tenants:   map[string]*tenant{acme.issuerURL: acme},
+	}
+
+	jwt := func(iss string) string {
+		return "header." + base64.RawURLEncoding.EncodeToString([]byte(`{"iss":"`+iss+`"}`)) + ".signature"
+	}
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	tn, err := a.requestTenant(req, jwt(acme.issuerURL))
+	require.NoError(t, err)
+	assert.Same(t, acme, tn)
+
+	for _, raw := range []string{jwt("https://evil.example.com/"), "opaque"} {
+		tn, err = a.requestTenant(req, raw)
+		require.NoError(t, err)
+		assert.True(t, tn.primary, raw)
+	}
+
+	a.cfg.IssuerResolver = func(*http.Request) (Issuer, error) { return Issuer{}, errors.New("unknown host") }
+	_, err = a.requestTenant(req, jwt(acme.issuerURL))
+	require.Error(t, err)
+}
+
+func TestIssuerResolver(t *testing.T) {
+	var tenantSrv *httptest.Server
+	tenantSrv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/.well-known/openid-configuration" {
+			_ = json.NewEncoder(w).Encode(map[string]any{
+				"issuer":                 tenantSrv.URL,
+				"authorization_endpoint": tenantSrv.URL + "/auth",
+				"token_endpoint":         tenantSrv.URL + "/token",
+				"jwks_uri":               tenantSrv.URL + "/certs",
+				"introspection_endpoint": tenantSrv.URL + "/introspect",
+			})
+			return
+		}
+
+		user, _, _ := r.BasicAuth()
+		assert.Equal(t, "acme-client", user)
+
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"active": true,
+			"sub":    "abc",
+			"exp":    time.Now().Add(time.Hour).Unix(),
+		})
+	}))
+	t.Cleanup(tenantSrv.Close)
+
+	primarySrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]any{"active": false})
+	}))
+	t.Cleanup(primarySrv.Close)
+
+	a := &Auth{
+		cfg: Config{
+			IssuerURL:         "https://idp.example.com/realms/main",
+			IntrospectionURL:  primarySrv.URL,
+			TokenVerification: TokenVerificationIntrospection,
+			ErrorRenderer:     BearerErrorRenderer(""),
+			IssuerResolver: func(r *http.Request) (Issuer, error) {
+				if r.Host == "acme.example.com" {
+					return Issuer{Name: "acme", IssuerURL: tenantSrv.URL, ClientID: "acme-client"}, nil
+				}
+				return Issuer{IssuerURL: "https://idp.example.com/realms/main"}, nil
+			},
+		},
+		discovery:         &discovery{},
+		verificationCache: mem.NewVerificationCache(10),
+	}
+
+	h := a.RequireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, _ := UserFromContext(r.Context())
+		_ = json.NewEncoder(w).Encode(u)
+	}), Opts{})
+
+	serve := func(host string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Host = host
+		req.Header.Set("Authorization", "Bearer opaque")
+
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := serve("acme.example.com")
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var u User
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &u))
+	assert.Equal(t, "abc", u.Sub)
+	assert.Equal(t, "acme", u.Tenant)
+	assert.Equal(t, tenantSrv.URL, u.Issuer)
+
+	// The verification of the tenant must not be used for others
+	assert.Equal(t, http.StatusUnauthorized, serve("app.example.com").Code)
+}
+
+func TestTenantLRU(t *testing.T) {
+	c := newTenantLRU(2)
+	for _, iss := range []string{"a", "b"} {
+		c.put(&tenant{issuerURL: iss})
+	}
+
+	// Using a makes b the least recently used one to be evicted
+	_, ok := c.get("a")
+	require.True(t, ok)
+	c.put(&tenant{issuerURL: "c"})
+
+	_, ok = c.get("b")
+	assert.False(t, ok)
+	assert.Len(t, c.values(), 2)
+
+	replaced := &tenant{issuerURL: "a", name: "new"}
+	c.replace(replaced)
+	c.replace(&tenant{issuerURL: "b"})
+
+	tn, ok := c.get("a")
+	require.True(t, ok)
+	assert.Same(t, replaced, tn)
+
+	_, ok = c.get("b")
+	assert.False(t, ok, "evicted tenant must not be re-added")
+}
+
+func TestResolvedTenantsBounded(t *testing.T) {
+	a := &Auth{
+		cfg: Config{
+			Issuers:            []Issuer{{IssuerURL: "https://idp.example.com/realms/acme"}},
+			IssuerResolver:     func(*http.Request) (Issuer, error) { return Issuer{}, nil },
+			MaxResolvedIssuers: 1,
+		},
+	}
+
+	a.storeTenant(&tenant{issuerURL: "https://idp.example.com/realms/acme"})
+	a.storeTenant(&tenant{issuerURL: "https://idp.example.com/realms/one"})
+	a.storeTenant(&tenant{issuerURL: "https://idp.example.com/realms/two"})
+
+	for iss, want := range map[string]bool{
+		"https://idp.example.com/realms/acme": true,
+		"https://idp.example.com/realms/one":  false,
+		"https://idp.example.com/realms/two":  true,
+	} {
+		_, ok := a.cachedTenant(iss)
+		assert.Equal(t, want, ok, iss)
+	}
+
+	assert.Len(t, a.knownTenants(), 2)
+}
+
+func TestTenantUnavailable(t *testing.T) {
+	release := make(chan struct{})
+	hangingSrv := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) { <-release }))
+	t.Cleanup(hangingSrv.Close)
+	t.Cleanup(func() { close(release) })
+
+	downSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(downSrv.Close)
+
+	a := &Auth{
+		cfg: Config{
+			IssuerURL:     "https://idp.example.com/realms/main",
+			ErrorRenderer: BearerErrorRenderer(""),
+			IssuerResolver: func(r *http.Request) (Issuer, error) {
+				if r.Host == "hanging.example.com" {
+					return Issuer{IssuerURL: hangingSrv.URL}, nil
+				}
+				return Issuer{IssuerURL: downSrv.URL}, nil
+			},
+		},
+		discovery: &discovery{},
+	}
+
+	h := a.RequireAuth(http.NotFoundHandler(), Opts{})
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer opaque")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+
+	// The request does not wait for the hanging discovery beyond its
+	// own context
+	ctx, cancel := context.WithTimeout(t.Context(), 100*time.Millisecond)
+	defer cancel()
+
+	req = httptest.NewRequestWithContext(ctx, http.MethodGet, "/", nil)
+	req.Host = "hanging.example.com"
+	req.Header.Set("Authorization", "Bearer opaque")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+}
@@ -0,0 +1,98 @@
+package appauth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/oauth2"
+)
+
+const (
+	tokenStoreDirPerms  = 0o700
+	tokenStoreFilePerms = 0o600
+)
+
+type (
+	// TokenStore persists tokens of the DeviceFlow between runs of a
+	// CLI tool
+	TokenStore interface {
+		// LoadToken returns the stored token or ErrTokenNotFound
+		LoadToken() (*oauth2.Token, error)
+		// SaveToken stores the token replacing the previous one
+		SaveToken(tok *oauth2.Token) error
+	}
+
+	// FileTokenStore stores the token as JSON file readable only by the
+	// current user
+	FileTokenStore struct {
+		Path string
+	}
+)
+
+// ErrTokenNotFound signals the TokenStore does not contain a token
+var ErrTokenNotFound = errors.New("token not found")
+
+var _ TokenStore = FileTokenStore{}
+
+// LoadToken reads the token from the file
+func (f FileTokenStore) LoadToken() (*oauth2.Token, error) {
+	raw, err := os.ReadFile(f.Path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, ErrTokenNotFound
+		}
+		return nil, fmt.Errorf("reading token file: %w", err)
+	}
+
+	tok := new(oauth2.Token)
+	if err = json.Unmarshal(raw, tok); err != nil {
+		return nil, fmt.Errorf("decoding token file: %w", err)
+	}
+
+	return tok, nil
+}
+
+// SaveToken writes the token into the file
+func (f FileTokenStore) SaveToken(tok *oauth2.Token) error {
+	//#nosec:G117 // The token is the payload to persist into the user-only readable file.
+	raw, err := json.Marshal(tok)
+	if err != nil {
+		return fmt.Errorf("encoding token: %w", err)
+	}
+
+	if err = os.MkdirAll(filepath.Dir(f.Path), tokenStoreDirPerms); err != nil {
+		return fmt.Errorf("creating token directory: %w", err)
+	}
+
+	// Write to a temporary file and rename it to never expose a
+	// partially written token and to not keep the permissions of an
+	// existing file
+	tmp, err := os.CreateTemp(filepath.Dir(f.Path), ".token-*")
+	if err != nil {
+		return fmt.Errorf("creating temporary file: %w", err)
+	}
+	defer os.Remove(tmp.Name()) //nolint:errcheck // Only fails after successful rename
+
+	if err = tmp.Chmod(tokenStoreFilePerms); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("setting token file permissions: %w", err)
+	}
+
+	if _, err = tmp.Write(raw); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("writing token file: %w", err)
+	}
+
+	if err = tmp.Close(); err != nil {
+		return fmt.Errorf("closing token file: %w", err)
+	}
+
+	if err = os.Rename(tmp.Name(), f.Path); err != nil {
+		return fmt.Errorf("replacing token file: %w", err)
+	}
+
+	return nil
+}
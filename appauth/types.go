@@ -1,44 +1,202 @@
 package appauth
 
 import (
+	"context"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"sync"
 	"time"
 
-	"github.com/coreos/go-oidc/v3/oidc"
 	"golang.org/x/oauth2"
+	"golang.org/x/sync/singleflight"
 
 	"github.com/Luzifer/go_helpers/appauth/pkg/cache"
+	"github.com/Luzifer/go_helpers/appauth/pkg/cache/mem"
 )
 
 const userKey ctxKey = 1
 
+const (
+	// TokenVerificationUserInfo verifies JWT access tokens against the
+	// provider keys and fetches the user from the userinfo endpoint
+	TokenVerificationUserInfo TokenVerificationMode = iota
+	// TokenVerificationIntrospection validates (possibly opaque) access
+	// tokens through the providers RFC 7662 introspection endpoint
+	TokenVerificationIntrospection
+	// TokenVerificationJWT verifies JWT access tokens locally against
+	// the provider keys and the expected Audiences and builds the user
+	// from the token claims only
+	TokenVerificationJWT
+)
+
 type (
 	// Auth contains the parts required for authentication and authorization
 	// against an OIDC server
 	Auth struct {
 		cfg Config
 
-		provider *oidc.Provider
-		verifier *oidc.IDTokenVerifier // We will verify JWTs; access tokens are JWTs in KC by default.
+		// discovery is nil until the provider was discovered, the
+		// discoveryGroup deduplicates the lazy discovery
+		discovery      *discovery
+		discoveryLock  sync.RWMutex
+		discoveryGroup singleflight.Group
+		// stopRediscovery cancels the periodic re-discovery
+		stopRediscovery context.CancelFunc
 
+		// oauth2 holds the client configuration, the endpoint is taken
+		// from the discovery (see oauth2Config)
 		oauth2 oauth2.Config
 
-		sessionCache cache.Cache
+		logger *slog.Logger
+
+		sessionStore cache.SessionStore
+		// defaultStore is the sessionStore created by New if none was
+		// configured, its janitor is stopped by Close
+		defaultStore      *mem.Cache
+		verificationCache cache.VerificationCache
+		dpopReplayCache   cache.ReplayCache
+
+		templates popupTemplates
+
+		// refreshGroup deduplicates parallel refreshes of a session,
+		// sessionLocks serializes refreshes and rotations of a session
+		// if the session store cannot lock it (see lockSession)
+		refreshGroup singleflight.Group
+		sessionLocks sessionLocks
+
+		// tenants holds the configured Issuers and resolvedTenants the
+		// ones returned by the IssuerResolver by their IssuerURL,
+		// tenantGroup deduplicates their discovery
+		tenants         map[string]*tenant
+		resolvedTenants *tenantLRU
+		tenantLock      sync.RWMutex
+		tenantGroup     singleflight.Group
 	}
 
 	// Config holds the configuration for the Auth adapter
 	Config struct {
 		IssuerURL string
 
-		// Popup client
-		ClientID         string
-		ClientSecret     string
-		PopupRedirectURL string // MUST be the same route you mount the handler on
+		ClientID     string
+		ClientSecret string
+
+		// PopupRedirectURL enables the popup flow (ServePopup) and MUST be
+		// the same route you mount the handler on
+		PopupRedirectURL string
+		// LoginRedirectURL enables the redirect flow (ServeLogin) and MUST
+		// be the route ServeCallback is mounted on
+		LoginRedirectURL string
 
 		Scopes []string // e.g. []string{oidc.ScopeOpenID, "profile", "email"}
 
+		// DiscoveryRetry retries the provider discovery within New using
+		// the given discover function, e.g. with the backoff helper of
+		// this repository:
+		//
+		//	DiscoveryRetry: func(_ context.Context, discover func() error) error {
+		//		return backoff.NewBackoff().WithMaxTotalTime(time.Minute).Retry(discover)
+		//	},
+		//
+		// Once the context is done the discover function returns a
+		// backoff.ErrCannotRetry to stop the backoff. Defaults to the
+		// exponential backoff for up to 30s, with LazyDiscovery to a
+		// single attempt.
+		DiscoveryRetry func(ctx context.Context, discover func() error) error
+		// LazyDiscovery lets New succeed while the provider is unavailable.
+		// The discovery is then retried by the requests requiring it (which
+		// fail with 503 Service Unavailable until it succeeds) and by Ready.
+		LazyDiscovery bool
+		// RediscoveryInterval re-fetches the discovery documents of all
+		// issuers in this interval to pick up rotated provider metadata
+		// without a restart. Set to 0 to disable, stop it through Close.
+		RediscoveryInterval time.Duration
+
+		// Issuers lists additional issuers whose access tokens are
+		// accepted next to the ones of the IssuerURL. The issuer is
+		// selected by the `iss` claim of the token, so opaque tokens are
+		// only accepted from the IssuerURL.
+		Issuers []Issuer
+		// IssuerResolver selects the only issuer to accept access tokens
+		// from for the request (e.g. by host or header) instead of the
+		// Issuers list. Resolved issuers are discovered on first use and
+		// cached by their IssuerURL (see MaxResolvedIssuers).
+		//
+		// The server fetches the discovery document of the returned
+		// IssuerURL: it MUST be taken from a trusted list of tenants and
+		// never be built from request input without checking it against
+		// that list, otherwise clients can make the server connect to
+		// arbitrary URLs.
+		IssuerResolver func(r *http.Request) (Issuer, error)
+		// MaxResolvedIssuers limits the number of issuers returned by the
+		// IssuerResolver kept discovered, the least recently used ones are
+		// discovered again on their next use. Defaults to 100.
+		MaxResolvedIssuers int
+
+		// TokenVerification selects how access tokens are verified.
+		// Defaults to TokenVerificationUserInfo.
+		TokenVerification TokenVerificationMode
+		// IntrospectionURL overrides the introspection_endpoint announced
+		// by the provider for TokenVerificationIntrospection
+		IntrospectionURL string
+		// Audiences lists the accepted `aud` values of access tokens for
+		// TokenVerificationJWT (required), one of them must be present
+		Audiences []string
+		// AccessTokenTypes lists the accepted `typ` header values of
+		// access tokens for TokenVerificationJWT, e.g. "at+jwt" (RFC
+		// 9068) to reject other JWTs signed by the provider such as ID
+		// tokens. The comparison ignores the case and an "application/"
+		// prefix. Empty accepts any type as Keycloak issues its access
+		// tokens with type "JWT" unless configured otherwise.
+		AccessTokenTypes []string
+		// ClockSkew is tolerated when checking `exp` and `nbf` of access
+		// tokens for TokenVerificationJWT and `iat` of DPoP proofs
+		ClockSkew time.Duration
+
+		// DPoPReplayCache detects replayed DPoP proofs. Defaults to an
+		// in-memory cache, use a shared one with multiple instances.
+		DPoPReplayCache cache.ReplayCache
+		// DPoPProofMaxAge is the maximum age of DPoP proofs by their
+		// `iat`. Defaults to 1 minute.
+		DPoPProofMaxAge time.Duration
+
+		// ClaimMapping defines where to find the user information within
+		// the claims. Defaults to ClaimMappingKeycloak.
+		ClaimMapping ClaimMapping
+
 		// Who may receive tokens via postMessage (strict allowlist)
 		AllowedPostMessageOrigins []string
 
+		// PopupTemplates replaces the pages of the popup flow by the
+		// html/template files closePage.html.gotmpl (gets .message, .code
+		// and .nonce) and postMessagePage.html.gotmpl (gets .token, .user,
+		// .origin, .fields and .nonce) found in it. Missing files fall
+		// back to the built-in pages. Scripts MUST carry the nonce to be
+		// executed, the toJSON function is available to embed values.
+		PopupTemplates fs.FS
+		// PopupCSP builds the Content-Security-Policy header of the popup
+		// pages for the per-request nonce, e.g. with the http helper of
+		// this repository:
+		//
+		//	PopupCSP: func(nonce string) string {
+		//		csp := http.CSP{"default-src": {http.CSPSrcSelf}}
+		//		csp.Add("script-src", http.CSPSrcNonce(nonce))
+		//		return csp.ToHeaderValue()
+		//	},
+		//
+		// Defaults to a policy only allowing the nonced scripts.
+		PopupCSP func(nonce string) string
+		// PostMessageFields adds fields (e.g. the session expiry) to the
+		// SESSION_TOKEN message posted to the opener. The type, token
+		// and user can not be replaced.
+		PostMessageFields func(r *http.Request, u *User) map[string]any
+
+		// PostLogoutRedirectURL enables the RP-initiated logout redirect
+		// to the providers end_session_endpoint in ServeLogout. It MUST
+		// be registered as post logout redirect URI at the provider.
+		// Leave empty to only end the local session.
+		PostLogoutRedirectURL string
+
 		// SessionIdleTimeout expires sessions after this much inactivity.
 		// Set to 0 to disable.
 		SessionIdleTimeout time.Duration
@@ -46,25 +204,124 @@ type (
 		// Set to 0 to disable.
 		SessionAbsoluteTimeout time.Duration
 
-		// InsecureCookie disables the Secure flag on popup flow cookies.
+		// SessionCookieName is the name of the HttpOnly cookie holding
+		// the session ID in the redirect flow. Defaults to appauth_session.
+		SessionCookieName string
+		// SessionCookieSameSite defaults to http.SameSiteLaxMode
+		SessionCookieSameSite http.SameSite
+
+		// InsecureCookie disables the Secure flag on flow and session cookies.
 		// Use this only for local HTTP development or test servers.
 		InsecureCookie bool
 
-		Logger Logger      // optional
-		Cache  cache.Cache // optional
+		// ClientIPResolver determines the client IP recorded with new
+		// sessions. Defaults to the host of the requests RemoteAddr, set
+		// this when running behind a trusted reverse proxy.
+		ClientIPResolver func(r *http.Request) string
+
+		// ServiceAccountDetector recognizes tokens issued to service
+		// accounts through the client credentials grant from the token
+		// claims. Defaults to DefaultServiceAccountDetector.
+		ServiceAccountDetector func(claims map[string]any) (clientID string, ok bool)
+
+		// ErrorRenderer writes the response for requests rejected by
+		// RequireAuth. Defaults to StealthErrorRenderer (404 Not Found),
+		// use BearerErrorRenderer or ProblemErrorRenderer for RFC 6750
+		// compliant responses.
+		ErrorRenderer ErrorRenderer
+
+		// SlogLogger receives the diagnostics of the adapter as
+		// structured logs. Takes precedence over Logger.
+		SlogLogger *slog.Logger
+		// Logger receives the diagnostics as formatted lines
+		Logger Logger // optional
+
+		// OnEvent receives the authentication lifecycle events for
+		// auditing (see SlogEventHandler). It is called synchronously
+		// and MUST NOT block.
+		OnEvent func(Event)
+
+		// SessionStore stores the sessions. Defaults to an in-memory
+		// store, takes precedence over Cache.
+		SessionStore cache.SessionStore
+		// Cache stores the sessions through an existing cache.Cache
+		// implementation (see cache.FromCache)
+		Cache cache.Cache
+
+		// VerificationCache stores verified users by token hash until
+		// the token expires. Defaults to an in-memory LRU cache.
+		VerificationCache cache.VerificationCache
+		// DisableVerificationCache verifies every request against the
+		// provider. Use this when live revocation checks are required.
+		DisableVerificationCache bool
 	}
 
 	// Logger defines what a log-provider must implement in order to be
-	// usable for this library
+	// usable for this library. The structured logs are passed to it as
+	// formatted lines, prefer Config.SlogLogger for new code.
 	Logger interface {
 		// Printf logs a formatted message.
 		Printf(format string, v ...any)
 	}
 
-	// Opts controls the authorization within a route
+	// ClaimMatcher requires a claim of the User (see User.Raw) to equal
+	// one of the Values. For array claims one matching element is
+	// sufficient.
+	ClaimMatcher struct {
+		Claim  string
+		Values []any
+	}
+
+	// Opts controls the authorization within a route. All given
+	// requirements must be satisfied (AND), an empty Opts only requires
+	// the user to be authenticated.
 	Opts struct {
-		AnyRole  []string // realm or client roles
-		AnyGroup []string
+		// AnyRole, AnyGroup and AnyClient are satisfied if the user has
+		// at least one of the listed roles or groups or is a service
+		// account of one of the listed clients (OR across all lists)
+		AnyRole   []string // realm or client roles
+		AnyGroup  []string
+		AnyClient []string
+
+		AllRoles  []string
+		AllGroups []string
+
+		// AllScopes requires all listed OAuth scopes to be granted to
+		// the token (`scope` or `scp` claim)
+		AllScopes []string
+
+		// AnyACR, AllAMR and MaxAuthAge require a strong and recent
+		// authentication of the user: one of the listed `acr` values,
+		// all listed `amr` methods (e.g. "mfa", "hwk") and an
+		// `auth_time` not older than MaxAuthAge. Unmet requirements of
+		// the top level Opts are rejected with the RFC 9470
+		// insufficient_user_authentication error to trigger a step-up
+		// login (see ServePopup), nested ones deny the request.
+		AnyACR     []string
+		AllAMR     []string
+		MaxAuthAge time.Duration
+
+		// Claims requires all matchers to match
+		Claims []ClaimMatcher
+
+		// Check is a custom predicate which must approve the request
+		Check func(*User, *http.Request) bool
+
+		// AllOf requires all nested Opts to be satisfied, AnyOf requires
+		// at least one of them to be satisfied
+		AllOf []Opts
+		AnyOf []Opts
+	}
+
+	// TokenVerificationMode defines how access tokens are verified
+	TokenVerificationMode int
+
+	// providerMetadata holds the parts of the provider discovery
+	// document not exposed through the oidc.Provider
+	providerMetadata struct {
+		EndSessionEndpoint    string `json:"end_session_endpoint"`
+		IntrospectionEndpoint string `json:"introspection_endpoint"`
+		RevocationEndpoint    string `json:"revocation_endpoint"`
 	}
 
 	ctxKey int
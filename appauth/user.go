@@ -1,16 +1,43 @@
 package appauth
 
-import "context"
+import (
+	"context"
+	"time"
+)
 
 type (
 	// User holds information about a user after successful authentication
 	User struct {
-		Sub    string         `json:"sub,omitempty"`
-		Email  string         `json:"email,omitempty"`
-		Name   string         `json:"name,omitempty"`
-		Groups []string       `json:"groups,omitempty"`
-		Roles  []string       `json:"roles,omitempty"` // merged realm+client roles (best effort)
-		Raw    map[string]any `json:"raw,omitempty"`
+		Sub    string   `json:"sub,omitempty"`
+		Email  string   `json:"email,omitempty"`
+		Name   string   `json:"name,omitempty"`
+		Groups []string `json:"groups,omitempty"`
+		Roles  []string `json:"roles,omitempty"` // merged realm+client roles (best effort)
+		Scopes []string `json:"scopes,omitempty"`
+
+		// ClientID and ServiceAccount are set for tokens issued through
+		// the client credentials grant (see Config.ServiceAccountDetector)
+		ClientID       string `json:"client_id,omitempty"`
+		ServiceAccount bool   `json:"service_account,omitempty"`
+
+		// Issuer is the issuer the access token was verified against,
+		// Tenant the Name of the matched Issuer (empty for the IssuerURL)
+		Issuer string `json:"iss,omitempty"`
+		Tenant string `json:"tenant,omitempty"`
+
+		// ACR, AMR and AuthTime describe the authentication of the user
+		// (`acr`, `amr` and `auth_time` claims) if the provider
+		// announces it
+		ACR      string    `json:"acr,omitempty"`
+		AMR      []string  `json:"amr,omitempty"`
+		AuthTime time.Time `json:"auth_time,omitzero"`
+
+		// DPoPKey is the JWK SHA-256 thumbprint the access token is
+		// bound to through its `cnf.jkt` claim (RFC 9449), empty for
+		// bearer tokens
+		DPoPKey string `json:"dpop_jkt,omitempty"`
+
+		Raw map[string]any `json:"raw,omitempty"`
 	}
 )
 
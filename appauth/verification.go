@@ -0,0 +1,53 @@
+package appauth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/Luzifer/go_helpers/appauth/pkg/cache"
+)
+
+// cachedVerification returns the user of a previously verified token
+// if the verification cache is enabled and holds it
+func (a *Auth) cachedVerification(ctx context.Context, key string) (*User, bool) {
+	if a.verificationCache == nil {
+		return nil, false
+	}
+
+	data, err := a.verificationCache.GetVerification(ctx, key)
+	if err != nil {
+		if !errors.Is(err, cache.ErrVerificationNotFound) {
+			a.log().Warn("reading verification cache", slog.Any("error", err))
+		}
+		return nil, false
+	}
+
+	u := new(User)
+	if err = json.Unmarshal(data, u); err != nil {
+		a.log().Warn("decoding cached verification", slog.Any("error", err))
+		return nil, false
+	}
+
+	return u, true
+}
+
+// storeVerification puts the user into the verification cache until
+// the token expires. Tokens without known expiry are not cached.
+func (a *Auth) storeVerification(ctx context.Context, key string, u *User, expires time.Time) {
+	if a.verificationCache == nil || !expires.After(time.Now()) {
+		return
+	}
+
+	data, err := json.Marshal(u)
+	if err != nil {
+		a.log().Warn("encoding verification", slog.Any("error", err))
+		return
+	}
+
+	if err = a.verificationCache.SetVerification(ctx, key, data, expires); err != nil {
+		a.log().Warn("writing verification cache", slog.Any("error", err))
+	}
+}